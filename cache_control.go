@@ -1,10 +1,14 @@
 package grpccache
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -15,36 +19,236 @@ type CacheControl struct {
 	// MaxAge is maximum duration (since the original retrieval) that
 	// an item is considered fresh.
 	MaxAge time.Duration
+
+	// SharedMaxAge, if non-zero, overrides MaxAge for shared caches
+	// (those with Cache.Shared set), such as an intermediary cache
+	// that serves many clients. It is like HTTP's s-maxage.
+	SharedMaxAge time.Duration
+
+	// ExpiresAt, if non-zero, is the time at which the item stops
+	// being fresh. It takes precedence over MaxAge and SharedMaxAge.
+	// Servers that know exactly when a result becomes invalid (e.g.,
+	// when a token expires) should set it instead of computing a
+	// MaxAge, which would be skewed by the time the response takes to
+	// reach the client. (It is still limited by Cache.MaxAgeCap,
+	// measured from when the result is stored, and so it is subject to
+	// any clock skew between the server and the client.)
+	ExpiresAt time.Time
+
+	// ErrorCode, if not codes.OK, is the gRPC status code of an error
+	// response that may be cached. It is set by SetCacheControlError.
+	ErrorCode codes.Code
+
+	// NoStore, if true, prevents the response from being cached,
+	// regardless of MaxAge. It can be used by a server method
+	// implementation to override a default MaxAge (set by middleware,
+	// for example) for a particular response.
+	NoStore bool
+
+	// NoCache, if true, means that the result may be stored but must
+	// not be served from the cache without first revalidating it with
+	// the server (like HTTP's no-cache). The client keeps the result
+	// (and its ETag) for its MaxAge, and when the call is made again,
+	// it sends the ETag to the server, which may return ErrNotModified
+	// instead of sending the result again. The result is still served
+	// by GetIfError (see Cache.MaxStale). A NoCache result with a zero
+	// MaxAge is kept for an hour (or Cache.MaxAgeCap, if shorter) if it
+	// has an ETag, and otherwise it is not stored.
+	NoCache bool
+
+	// StaleWhileRevalidate is the duration after MaxAge elapses during
+	// which a stale item may still be returned by GetStale, while the
+	// caller refreshes it in the background.
+	StaleWhileRevalidate time.Duration
+
+	// Immutable, if true, means that the result will never change
+	// (e.g., it is a content-addressed blob). An immutable result never
+	// expires, regardless of MaxAge, SharedMaxAge, and ExpiresAt (so
+	// they may be zero), and it is returned even to calls made with
+	// WithForceRefresh. It is still subject to Cache.MaxAgeCap (which,
+	// if set, is its lifetime), eviction (to satisfy Cache.MaxSize and
+	// Cache.MaxEntries), and invalidation.
+	Immutable bool
+
+	// ETag, if set, identifies the version of the result. When the
+	// client revalidates a stale item (see StaleWhileRevalidate) or a
+	// NoCache item, it sends the item's ETag to the server, which may return
+	// ErrNotModified (if the result is unchanged) to avoid sending the
+	// result again. See RequestETag.
+	ETag string
+
+	// Vary lists the request metadata keys whose values the result
+	// depends on. The client includes the values of these keys in the
+	// cache key, so that (for example) results for requests with
+	// different languages are cached separately.
+	//
+	// The client remembers the Vary of the most recent response for
+	// each method and uses it for subsequent calls to that method, so
+	// all responses for a method should have the same Vary.
+	Vary []string
+
+	// Trailer holds the values of the response trailer keys listed in
+	// Cache.PreserveTrailers. It is recorded by the client when it
+	// stores a result, and it is returned to callers (see WithTrailer)
+	// when the result is served from the cache. Servers should not set
+	// it (it is not sent to the client).
+	Trailer metadata.MD
+
+	// StoredAt is the time when the client stored the result (or last
+	// revalidated it). It is recorded by the client; servers should
+	// not set it. See WithFreshnessBudget.
+	StoredAt time.Time
+
+	// MinFresh is only set in the caching hints that a client sends
+	// with a request (see CacheControlFromContext). It is ignored in
+	// responses.
+	MinFresh time.Duration
+
+	notModified bool // set by the server wrapper (see ErrNotModified)
+}
+
+// maxAge returns the MaxAge that applies to a cache (which is shared
+// if shared is true).
+func (cc *CacheControl) maxAge(shared bool) time.Duration {
+	if shared && cc.SharedMaxAge != 0 {
+		return cc.SharedMaxAge
+	}
+	return cc.MaxAge
 }
 
-func (cc *CacheControl) cacheable() bool {
-	return cc.MaxAge > 0
+// freshFor returns how long an item stored at now is fresh for in a
+// cache (which is shared if shared is true).
+func (cc *CacheControl) freshFor(shared bool, now time.Time) time.Duration {
+	if !cc.ExpiresAt.IsZero() {
+		return cc.ExpiresAt.Sub(now)
+	}
+	return cc.maxAge(shared)
 }
 
+func (cc *CacheControl) cacheable(shared bool, now time.Time) bool {
+	return !cc.NoStore && (cc.Immutable || (cc.NoCache && cc.ETag != "") || cc.freshFor(shared, now) > 0)
+}
+
+// noCacheRetention is how long a NoCache result with an ETag but no
+// MaxAge is kept (so that it can be revalidated).
+const noCacheRetention = time.Hour
+
+// immutableExpiry is the expiry of immutable results (see
+// CacheControl.Immutable), which is effectively never.
+var immutableExpiry = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
 // IsZero returns true if cc refers to an empty CacheControl struct.
 func (cc *CacheControl) IsZero() bool {
-	return *cc == CacheControl{}
+	return cc.MaxAge == 0 && cc.SharedMaxAge == 0 && cc.ExpiresAt.IsZero() && cc.ErrorCode == codes.OK && !cc.NoStore && !cc.NoCache && cc.StaleWhileRevalidate == 0 && !cc.Immutable && cc.ETag == "" && len(cc.Vary) == 0 && !cc.notModified
 }
 
 // SetCacheControl is called by gRPC server method implementations to
 // tell the client how to cache the result.
 //
-// The last CacheControl set on ctx in the course of handling a
-// request is written a gRPC header and/or trailer to communicate the
-// cache control info to the client. It may be called multiple times;
-// only the last value is used.
+// The CacheControl set on ctx in the course of handling a request is
+// written to a gRPC trailer to communicate the cache control info to
+// the client. It may be called multiple times (by middleware and by
+// the server method implementation, for example); the values are
+// merged so that the strictest policy wins:
+//
+//   - MaxAge, SharedMaxAge, and StaleWhileRevalidate are the minimum
+//     non-zero value
+//   - ExpiresAt is the earliest non-zero value
+//   - NoStore and NoCache are true if any value set them
+//   - Immutable is true if any value set it
+//   - ErrorCode and ETag are the last non-empty value
+//   - Vary is the union of all values
 //
 // If ctx was not previously wrapped with Internal_WithCacheControl,
 // then nothing will happen and the cache control info will not be
-// returned. Ensure that the CachedXyzServer wrapper methods are being
-// used.
+// returned. Ensure that the CachedXyzServer wrapper methods (or
+// UnaryServerInterceptor) are being used.
 func SetCacheControl(ctx context.Context, cc CacheControl) {
-	existingCC := cacheControlFromContext(ctx)
+	existingCC := responseCacheControl(ctx)
 	if existingCC != nil {
-		*existingCC = cc
+		existingCC.merge(cc)
 	}
 }
 
+// merge merges other into cc. See SetCacheControl for the rules.
+func (cc *CacheControl) merge(other CacheControl) {
+	cc.MaxAge = minNonZero(cc.MaxAge, other.MaxAge)
+	cc.SharedMaxAge = minNonZero(cc.SharedMaxAge, other.SharedMaxAge)
+	if !other.ExpiresAt.IsZero() && (cc.ExpiresAt.IsZero() || other.ExpiresAt.Before(cc.ExpiresAt)) {
+		cc.ExpiresAt = other.ExpiresAt
+	}
+	cc.StaleWhileRevalidate = minNonZero(cc.StaleWhileRevalidate, other.StaleWhileRevalidate)
+	cc.NoStore = cc.NoStore || other.NoStore
+	cc.NoCache = cc.NoCache || other.NoCache
+	cc.Immutable = cc.Immutable || other.Immutable
+	if other.ErrorCode != codes.OK {
+		cc.ErrorCode = other.ErrorCode
+	}
+	if other.ETag != "" {
+		cc.ETag = other.ETag
+	}
+	for _, key := range other.Vary {
+		if !containsString(cc.Vary, key) {
+			cc.Vary = append(cc.Vary, key)
+		}
+	}
+}
+
+func minNonZero(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCacheControlError is like SetCacheControl, but it allows the
+// client to cache an error response (with the given gRPC status code)
+// from a server method implementation. This is useful for avoiding
+// repeated requests for items that don't exist (codes.NotFound), for
+// example.
+//
+// Only an error response whose code equals code is cached; a
+// successful response is not cached.
+func SetCacheControlError(ctx context.Context, cc CacheControl, code codes.Code) {
+	cc.ErrorCode = code
+	SetCacheControl(ctx, cc)
+}
+
+// SetCacheControlHeader is like SetCacheControl, but it immediately
+// sends the cache control info to the client in the gRPC response
+// header (instead of the trailer), so the client learns whether the
+// result is cacheable before the full response arrives. The client
+// uses the header's cache control info in preference to the trailer's.
+//
+// It must be called before the response is sent, and at most once per
+// request (because the header can only be sent once).
+func SetCacheControlHeader(ctx context.Context, cc CacheControl) error {
+	return Internal_SetCacheControlHeader(ctx, cc)
+}
+
+// Internal_CacheControlMetadata is an internal func called by the
+// code-genned CachedXyzClient wrapper methods. It returns the
+// response metadata that contains the cache control info: header if
+// the server sent it there (see SetCacheControlHeader), or trailer
+// otherwise. It should not be called by user code.
+func Internal_CacheControlMetadata(header, trailer metadata.MD) metadata.MD {
+	for k := range header {
+		if strings.HasPrefix(k, mdPrefix) || strings.HasPrefix(k, legacyMDPrefix) || k == httpCacheControlKey {
+			return header
+		}
+	}
+	return trailer
+}
+
 // Internal_WithCacheControl is an internal func called by the
 // code-genned CachedXyzServer wrapper methods. It should not be
 // called by user code.
@@ -57,20 +261,154 @@ func Internal_WithCacheControl(ctx context.Context) (context.Context, *CacheCont
 // code-genned CachedXyzServer wrapper methods. It should not be
 // called by user code.
 func Internal_SetCacheControlTrailer(ctx context.Context, cc CacheControl) error {
-	return grpc.SetTrailer(ctx, metadata.MD{"cache-control:max-age": cc.MaxAge.String()})
+	return grpc.SetTrailer(ctx, cacheControlMetadata(cc))
+}
+
+// Internal_SetCacheControlHeader is an internal func that sends cc in
+// the response header (see SetCacheControlHeader and
+// Internal_SetCacheControlHeaderOrTrailer). It should not be called by
+// user code.
+func Internal_SetCacheControlHeader(ctx context.Context, cc CacheControl) error {
+	return grpc.SendHeader(ctx, cacheControlMetadata(cc))
+}
+
+// Internal_SetCacheControlHeaderOrTrailer is an internal func called
+// by the code-genned CachedXyzServer wrapper methods (for
+// server-streaming methods, and for unary methods listed in the
+// generator's -header flag) instead of
+// Internal_SetCacheControlTrailer. It sends cc in the response header,
+// or in the trailer if the header can't be sent (e.g., because the
+// method implementation already sent it), so that a successful call
+// doesn't fail just because of where its cache control info is sent.
+// It should not be called by user code.
+func Internal_SetCacheControlHeaderOrTrailer(ctx context.Context, cc CacheControl) error {
+	if err := Internal_SetCacheControlHeader(ctx, cc); err == nil {
+		return nil
+	}
+	return Internal_SetCacheControlTrailer(ctx, cc)
+}
+
+// cacheControlMetadata is called on the server to encode cc as
+// response metadata. It is the inverse of cacheControlFromMetadata.
+func cacheControlMetadata(cc CacheControl) metadata.MD {
+	md := metadata.MD{mdPrefix + "max-age": cc.MaxAge.String()}
+	if cc.SharedMaxAge != 0 {
+		md[mdPrefix+"s-maxage"] = cc.SharedMaxAge.String()
+	}
+	if !cc.ExpiresAt.IsZero() {
+		md[mdPrefix+"expires-at"] = cc.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+	if cc.ErrorCode != codes.OK {
+		md[mdPrefix+"error-code"] = strconv.FormatUint(uint64(cc.ErrorCode), 10)
+	}
+	if cc.NoStore {
+		md[mdPrefix+"no-store"] = strconv.FormatBool(cc.NoStore)
+	}
+	if cc.NoCache {
+		md[mdPrefix+"no-cache"] = strconv.FormatBool(cc.NoCache)
+	}
+	if cc.StaleWhileRevalidate != 0 {
+		md[mdPrefix+"stale-while-revalidate"] = cc.StaleWhileRevalidate.String()
+	}
+	if cc.ETag != "" {
+		md[mdPrefix+"etag"] = cc.ETag
+	}
+	if len(cc.Vary) != 0 {
+		md[mdPrefix+"vary"] = strings.Join(cc.Vary, ",")
+	}
+	if cc.Immutable {
+		md[mdPrefix+"immutable"] = strconv.FormatBool(cc.Immutable)
+	}
+	if cc.notModified {
+		md[mdPrefix+"not-modified"] = strconv.FormatBool(cc.notModified)
+	}
+	if v := cc.HTTPCacheControl(); v != "" {
+		md[httpCacheControlKey] = v
+	}
+	return md
 }
 
+// mdPrefix is the prefix of the metadata keys that hold cache control
+// info (e.g., "grpccache-max-age").
+const mdPrefix = "grpccache-"
+
+// legacyMDPrefix is the prefix of the metadata keys that were
+// previously used to hold cache control info. It contains a colon,
+// which is not valid in a gRPC metadata key, so it is no longer sent,
+// but it is still read (for compatibility with older servers).
+//
+// TODO(sqs): stop reading it once all servers send mdPrefix keys.
+const legacyMDPrefix = "cache-control:"
+
+// lookupMetadata returns the value of the cache control metadata
+// with the given name (e.g., "max-age"). It also checks the legacy
+// key.
+func lookupMetadata(md metadata.MD, name string) (string, bool) {
+	if v, present := md[mdPrefix+name]; present {
+		return v, true
+	}
+	v, present := md[legacyMDPrefix+name]
+	return v, present
+}
+
+// responseCacheControl returns the CacheControl (set by
+// Internal_WithCacheControl) for the response to the request in ctx,
+// or nil if there is none.
+//
 // TODO(sqs): warn if nil?
-func cacheControlFromContext(ctx context.Context) *CacheControl {
+func responseCacheControl(ctx context.Context) *CacheControl {
 	cc, _ := ctx.Value(cacheControlKey).(*CacheControl)
 	return cc
 }
 
-// cacheControlFromContext is called on the client to retrieve the
+// withRequestMetadata returns a copy of ctx whose request metadata
+// includes the cache control info with the given name (e.g.,
+// "min-fresh").
+func withRequestMetadata(ctx context.Context, name, value string) context.Context {
+	md := metadata.MD{}
+	if existing, ok := metadata.FromContext(ctx); ok {
+		for k, v := range existing {
+			md[k] = v
+		}
+	}
+	md[mdPrefix+name] = value
+	return metadata.NewContext(ctx, md)
+}
+
+// CacheControlFromContext is called by gRPC server method
+// implementations to get the caching hints that the client sent with
+// the request, so that they can tailor the response (e.g., its
+// MaxAge). The hints are:
+//
+//   - MaxAge: the client only accepts results at most this old (see
+//     WithFreshnessBudget)
+//   - MinFresh: the client only accepts results that remain fresh for
+//     at least this long (see WithMinFresh)
+//
+// The other fields are not set. It returns false if the client sent no
+// (well-formed) hints.
+func CacheControlFromContext(ctx context.Context) (CacheControl, bool) {
+	md, _ := metadata.FromContext(ctx)
+	var cc CacheControl
+	var ok bool
+	if v, present := lookupMetadata(md, "max-age"); present {
+		if d, err := time.ParseDuration(v); err == nil {
+			cc.MaxAge, ok = d, true
+		}
+	}
+	if v, present := lookupMetadata(md, "min-fresh"); present {
+		if d, err := time.ParseDuration(v); err == nil {
+			cc.MinFresh, ok = d, true
+		}
+	}
+	return cc, ok
+}
+
+// cacheControlFromMetadata is called on the client to retrieve the
 // server's CacheControl response metadata.
 func cacheControlFromMetadata(md metadata.MD) (*CacheControl, error) {
 	var cc *CacheControl
-	if maxAgeStr, present := md["cache-control:max-age"]; present {
+	if maxAgeStr, present := lookupMetadata(md, "max-age"); present {
 		maxAge, err := time.ParseDuration(maxAgeStr)
 		if err != nil {
 			return nil, err
@@ -80,5 +418,197 @@ func cacheControlFromMetadata(md metadata.MD) (*CacheControl, error) {
 		}
 		cc.MaxAge = maxAge
 	}
+	if sMaxAgeStr, present := lookupMetadata(md, "s-maxage"); present {
+		sMaxAge, err := time.ParseDuration(sMaxAgeStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.SharedMaxAge = sMaxAge
+	}
+	if expiresAtStr, present := lookupMetadata(md, "expires-at"); present {
+		expiresAt, err := time.Parse(time.RFC3339, expiresAtStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.ExpiresAt = expiresAt
+	}
+	if codeStr, present := lookupMetadata(md, "error-code"); present {
+		code, err := strconv.ParseUint(codeStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.ErrorCode = codes.Code(code)
+	}
+	if noStoreStr, present := lookupMetadata(md, "no-store"); present {
+		noStore, err := strconv.ParseBool(noStoreStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.NoStore = noStore
+	}
+	if noCacheStr, present := lookupMetadata(md, "no-cache"); present {
+		noCache, err := strconv.ParseBool(noCacheStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.NoCache = noCache
+	}
+	if swrStr, present := lookupMetadata(md, "stale-while-revalidate"); present {
+		swr, err := time.ParseDuration(swrStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.StaleWhileRevalidate = swr
+	}
+	if etag, present := lookupMetadata(md, "etag"); present {
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.ETag = etag
+	}
+	if varyStr, present := lookupMetadata(md, "vary"); present {
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		for _, key := range strings.Split(varyStr, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cc.Vary = append(cc.Vary, key)
+			}
+		}
+	}
+	if immutableStr, present := lookupMetadata(md, "immutable"); present {
+		immutable, err := strconv.ParseBool(immutableStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.Immutable = immutable
+	}
+	if notModifiedStr, present := lookupMetadata(md, "not-modified"); present {
+		notModified, err := strconv.ParseBool(notModifiedStr)
+		if err != nil {
+			return nil, err
+		}
+		if cc == nil {
+			cc = new(CacheControl)
+		}
+		cc.notModified = notModified
+	}
+	if v, present := md[httpCacheControlKey]; present && cc == nil {
+		// Only the standard HTTP syntax was sent (e.g., by a server
+		// or proxy that doesn't use this package).
+		httpCC, err := ParseHTTPCacheControl(v)
+		if err != nil {
+			return nil, err
+		}
+		cc = &httpCC
+	}
+	return cc, nil
+}
+
+// httpCacheControlKey is the metadata key that holds cache control
+// info in standard HTTP Cache-Control syntax (e.g., "max-age=300,
+// no-store"), for interoperability with proxies and other HTTP/2
+// intermediaries. It is sent alongside the mdPrefix keys, which the
+// client prefers because they hold all of the CacheControl fields at
+// full precision.
+const httpCacheControlKey = "cache-control"
+
+// HTTPCacheControl returns the directives of cc in standard HTTP
+// Cache-Control syntax, such as "max-age=300, no-store". Only the
+// fields with HTTP equivalents (MaxAge, SharedMaxAge, NoStore,
+// NoCache, StaleWhileRevalidate, and Immutable) are included, and durations are
+// truncated to whole seconds. It returns "" for the zero
+// CacheControl.
+func (cc CacheControl) HTTPCacheControl() string {
+	var directives []string
+	if cc.MaxAge != 0 || cc.SharedMaxAge != 0 || cc.NoStore || cc.NoCache || cc.StaleWhileRevalidate != 0 || cc.Immutable {
+		directives = append(directives, "max-age="+httpSeconds(cc.MaxAge))
+	}
+	if cc.SharedMaxAge != 0 {
+		directives = append(directives, "s-maxage="+httpSeconds(cc.SharedMaxAge))
+	}
+	if cc.StaleWhileRevalidate != 0 {
+		directives = append(directives, "stale-while-revalidate="+httpSeconds(cc.StaleWhileRevalidate))
+	}
+	if cc.NoStore {
+		directives = append(directives, "no-store")
+	}
+	if cc.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if cc.Immutable {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// httpSeconds formats d as a number of whole seconds.
+func httpSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
+
+// ParseHTTPCacheControl parses a value in standard HTTP Cache-Control
+// syntax (e.g., "max-age=300, no-store") into a CacheControl. It
+// supports the max-age, s-maxage, stale-while-revalidate, no-store,
+// no-cache, and immutable directives. Unlike in HTTP (where
+// it only applies while the result is fresh), immutable means that the
+// result never expires (see CacheControl.Immutable). Directive names are
+// case-insensitive, and other directives (e.g., "public") are ignored.
+func ParseHTTPCacheControl(s string) (CacheControl, error) {
+	var cc CacheControl
+	for _, directive := range strings.Split(s, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i != -1 {
+			name, value = strings.TrimSpace(directive[:i]), strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "max-age", "s-maxage", "stale-while-revalidate":
+			secs, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return CacheControl{}, fmt.Errorf("grpccache: invalid Cache-Control directive %q", directive)
+			}
+			d := time.Duration(secs) * time.Second
+			switch name {
+			case "max-age":
+				cc.MaxAge = d
+			case "s-maxage":
+				cc.SharedMaxAge = d
+			default:
+				cc.StaleWhileRevalidate = d
+			}
+		case "no-store":
+			cc.NoStore = true
+		case "no-cache":
+			cc.NoCache = true
+		case "immutable":
+			cc.Immutable = true
+		}
+	}
 	return cc, nil
 }
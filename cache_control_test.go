@@ -0,0 +1,629 @@
+package grpccache_test
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCacheControl_metadataRoundTrip(t *testing.T) {
+	tests := []grpccache.CacheControl{
+		{MaxAge: time.Hour},
+		{MaxAge: time.Hour, ErrorCode: codes.NotFound},
+		{MaxAge: time.Hour, NoStore: true},
+		{NoStore: true},
+		{MaxAge: time.Minute, StaleWhileRevalidate: time.Hour},
+		{MaxAge: time.Minute, ETag: "v1"},
+		{MaxAge: time.Minute, SharedMaxAge: time.Hour},
+		{MaxAge: time.Minute, Vary: []string{"a", "b"}},
+		{ExpiresAt: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)},
+		{MaxAge: time.Minute, Immutable: true},
+		{MaxAge: time.Minute, ETag: "v1", NoCache: true},
+	}
+	for _, cc := range tests {
+		md := grpccache.CacheControlMetadata(cc)
+		got, err := grpccache.CacheControlFromMetadata(md)
+		if err != nil {
+			t.Errorf("%+v: %s", cc, err)
+			continue
+		}
+		if got == nil || !reflect.DeepEqual(*got, cc) {
+			t.Errorf("%+v: got %+v after round-trip (metadata %v)", cc, got, md)
+		}
+	}
+}
+
+// noStoreServer is a testpb.TestServer whose responses have a MaxAge
+// but are marked NoStore.
+type noStoreServer struct {
+	calls int
+}
+
+func (s *noStoreServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour, NoStore: true})
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestCacheControl_NoStore(t *testing.T) {
+	var ts noStoreServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 2; ts.calls != want {
+		t.Errorf("got %d server calls, want %d (the response should not have been cached)", ts.calls, want)
+	}
+	if got := c.Cache.Len(); got != 0 {
+		t.Errorf("got %d entries, want 0", got)
+	}
+}
+
+// headerServer is a testpb.TestServer that sends its cache control
+// info in the response header.
+type headerServer struct {
+	calls int
+}
+
+func (s *headerServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls++
+	if err := grpccache.SetCacheControlHeader(ctx, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+		return nil, err
+	}
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestSetCacheControlHeader(t *testing.T) {
+	var ts headerServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 1; ts.calls != want {
+		t.Errorf("got %d server calls, want %d (the response should have been cached)", ts.calls, want)
+	}
+}
+
+// headerWrapperServer is a testpb.TestServer that wraps another like
+// the CachedTestServer wrapper generated with -header does, sending
+// the cache control info in the response header (or trailer).
+type headerWrapperServer struct {
+	testpb.TestServer
+}
+
+func (s *headerWrapperServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	ctx, cc := grpccache.Internal_WithCacheControl(ctx)
+	result, err := s.TestServer.TestMethod(ctx, op)
+	if !cc.IsZero() {
+		if err := grpccache.Internal_SetCacheControlHeaderOrTrailer(ctx, *cc); err != nil {
+			return nil, err
+		}
+	}
+	return result, err
+}
+
+// headerSendingServer is a testpb.TestServer that sends its own
+// response header before returning its result.
+type headerSendingServer struct {
+	testServer
+}
+
+func (s *headerSendingServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	if err := grpc.SendHeader(ctx, metadata.MD{"x-custom": "1"}); err != nil {
+		return nil, err
+	}
+	return s.testServer.TestMethod(ctx, op)
+}
+
+func TestInternal_SetCacheControlHeader(t *testing.T) {
+	ts := testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, &headerWrapperServer{&ts})
+	defer done()
+
+	var header, trailer metadata.MD
+	if _, err := testpb.NewTestClient(cc).TestMethod(context.Background(), &testpb.TestOp{A: 1}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if header["grpccache-max-age"] != "1h0m0s" {
+		t.Errorf("got header %v, want it to contain the cache control info", header)
+	}
+	if len(trailer) != 0 {
+		t.Errorf("got trailer %v, want it to be empty", trailer)
+	}
+
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{})
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 2; len(ts.calls) != want {
+		t.Errorf("got %d server calls, want %d (the response should have been cached)", len(ts.calls), want)
+	}
+}
+
+func TestInternal_SetCacheControlHeaderOrTrailer_headerSent(t *testing.T) {
+	ts := headerSendingServer{testServer{maxAge: time.Hour}}
+	cc, done := newTestClient(t, &headerWrapperServer{&ts})
+	defer done()
+
+	// The header was already sent, so the cache control info is sent
+	// in the trailer (and the call doesn't fail).
+	var header, trailer metadata.MD
+	if _, err := testpb.NewTestClient(cc).TestMethod(context.Background(), &testpb.TestOp{A: 1}, grpc.Header(&header), grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, present := header["grpccache-max-age"]; present {
+		t.Errorf("got header %v, want it to not contain the cache control info", header)
+	}
+	if trailer["grpccache-max-age"] != "1h0m0s" {
+		t.Errorf("got trailer %v, want it to contain the cache control info", trailer)
+	}
+
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{})
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 2; len(ts.calls) != want {
+		t.Errorf("got %d server calls, want %d (the response should have been cached)", len(ts.calls), want)
+	}
+}
+
+func TestSetCacheControl_merge(t *testing.T) {
+	tests := []struct {
+		a, b grpccache.CacheControl
+		want grpccache.CacheControl
+	}{
+		{
+			a:    grpccache.CacheControl{MaxAge: time.Hour},
+			b:    grpccache.CacheControl{MaxAge: time.Minute},
+			want: grpccache.CacheControl{MaxAge: time.Minute},
+		},
+		{
+			a:    grpccache.CacheControl{MaxAge: time.Minute},
+			b:    grpccache.CacheControl{MaxAge: time.Hour},
+			want: grpccache.CacheControl{MaxAge: time.Minute},
+		},
+		{
+			a:    grpccache.CacheControl{MaxAge: time.Minute},
+			b:    grpccache.CacheControl{},
+			want: grpccache.CacheControl{MaxAge: time.Minute},
+		},
+		{
+			a:    grpccache.CacheControl{MaxAge: time.Hour},
+			b:    grpccache.CacheControl{NoStore: true},
+			want: grpccache.CacheControl{MaxAge: time.Hour, NoStore: true},
+		},
+		{
+			a:    grpccache.CacheControl{MaxAge: time.Hour, StaleWhileRevalidate: time.Hour, Vary: []string{"a"}},
+			b:    grpccache.CacheControl{StaleWhileRevalidate: time.Minute, ErrorCode: codes.NotFound, ETag: "e", Vary: []string{"a", "b"}},
+			want: grpccache.CacheControl{MaxAge: time.Hour, StaleWhileRevalidate: time.Minute, ErrorCode: codes.NotFound, ETag: "e", Vary: []string{"a", "b"}},
+		},
+		{
+			a:    grpccache.CacheControl{ExpiresAt: time.Unix(200, 0)},
+			b:    grpccache.CacheControl{ExpiresAt: time.Unix(100, 0)},
+			want: grpccache.CacheControl{ExpiresAt: time.Unix(100, 0)},
+		},
+		{
+			a:    grpccache.CacheControl{ExpiresAt: time.Unix(100, 0)},
+			b:    grpccache.CacheControl{MaxAge: time.Hour},
+			want: grpccache.CacheControl{MaxAge: time.Hour, ExpiresAt: time.Unix(100, 0)},
+		},
+	}
+	for _, test := range tests {
+		ctx, cc := grpccache.Internal_WithCacheControl(context.Background())
+		grpccache.SetCacheControl(ctx, test.a)
+		grpccache.SetCacheControl(ctx, test.b)
+		if !reflect.DeepEqual(*cc, test.want) {
+			t.Errorf("%+v then %+v: got %+v, want %+v", test.a, test.b, *cc, test.want)
+		}
+	}
+}
+
+// badTrailerServer is a testpb.TestServer that sends a malformed
+// cache-control trailer.
+type badTrailerServer struct {
+	calls int
+}
+
+func (s *badTrailerServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls++
+	if err := grpc.SetTrailer(ctx, metadata.MD{"grpccache-max-age": "garbage"}); err != nil {
+		return nil, err
+	}
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestCacheControl_malformedTrailer(t *testing.T) {
+	var ts badTrailerServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	for i := 0; i < 2; i++ {
+		r, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+		if r.X != 1 {
+			t.Errorf("call %d: got result %d, want 1", i, r.X)
+		}
+	}
+	if want := 2; ts.calls != want {
+		t.Errorf("got %d server calls, want %d (the response should not have been cached)", ts.calls, want)
+	}
+}
+
+func TestCacheControl_metadataKeys(t *testing.T) {
+	var ts testServer
+	ts.maxAge = time.Hour
+	cc, done := newTestClient(t, &ts)
+	defer done()
+
+	// Call the server without the caching client wrapper to see the
+	// raw trailer.
+	var trailer metadata.MD
+	if _, err := testpb.NewTestClient(cc).TestMethod(context.Background(), &testpb.TestOp{A: 1}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := trailer["grpccache-max-age"], time.Hour.String(); got != want {
+		t.Errorf("got grpccache-max-age %q, want %q (trailer %v)", got, want, trailer)
+	}
+	for k := range trailer {
+		if strings.Contains(k, ":") {
+			t.Errorf("got invalid metadata key %q", k)
+		}
+	}
+}
+
+func TestCacheControl_legacyMetadataKeys(t *testing.T) {
+	cc, err := grpccache.CacheControlFromMetadata(metadata.MD{
+		"cache-control:max-age":    time.Hour.String(),
+		"cache-control:error-code": "5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grpccache.CacheControl{MaxAge: time.Hour, ErrorCode: codes.NotFound}); cc == nil || !reflect.DeepEqual(*cc, want) {
+		t.Errorf("got %+v, want %+v", cc, want)
+	}
+}
+
+func TestCacheControl_SharedMaxAge(t *testing.T) {
+	ctx := context.Background()
+	trailer := metadata.MD{
+		"grpccache-max-age":  time.Minute.String(),
+		"grpccache-s-maxage": time.Hour.String(),
+	}
+
+	for _, shared := range []bool{false, true} {
+		clock := &fakeClock{t: time.Now()}
+		c := &grpccache.Cache{Shared: shared}
+		grpccache.SetNow(c, clock.Now)
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, trailer); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Advance(30 * time.Minute)
+		if got, want := isCached(t, c, 1), shared; got != want {
+			t.Errorf("shared %v: got cached %v after 30m, want %v", shared, got, want)
+		}
+
+		clock.Advance(time.Hour)
+		if isCached(t, c, 1) {
+			t.Errorf("shared %v: got cached after 90m, want expired", shared)
+		}
+	}
+}
+
+func TestCacheControl_ExpiresAt(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{ExpiryJitter: time.Minute}
+	grpccache.SetNow(c, clock.Now)
+
+	// ExpiresAt takes precedence over MaxAge (and is not jittered).
+	expiresAt := clock.Now().Add(10 * time.Minute)
+	trailer := grpccache.CacheControlMetadata(grpccache.CacheControl{MaxAge: time.Hour, ExpiresAt: expiresAt})
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, trailer); err != nil {
+		t.Fatal(err)
+	}
+	// A result that has already expired is not stored.
+	trailer = grpccache.CacheControlMetadata(grpccache.CacheControl{MaxAge: time.Hour, ExpiresAt: clock.Now().Add(-time.Second)})
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, trailer); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Len(), 1; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+
+	clock.Advance(expiresAt.Sub(clock.Now()) - time.Millisecond)
+	if !isCached(t, c, 1) {
+		t.Error("not cached just before ExpiresAt")
+	}
+	clock.Advance(2 * time.Millisecond)
+	if isCached(t, c, 1) {
+		t.Error("cached just after ExpiresAt, want expired")
+	}
+}
+
+// rateLimitServer is a testpb.TestServer that sends the number of
+// calls remaining in its rate limit in the response trailer.
+// hintServer is a testpb.TestServer that sets MaxAge from the
+// client's caching hints (or to an hour, if there are none).
+type hintServer struct{}
+
+func (s *hintServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	maxAge := time.Hour
+	if hint, ok := grpccache.CacheControlFromContext(ctx); ok && hint.MaxAge != 0 {
+		maxAge = hint.MaxAge
+	}
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: maxAge})
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestCacheControlFromContext(t *testing.T) {
+	cc, done := newTestClient(t, &hintServer{})
+	defer done()
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{})
+
+	tests := map[int32]struct {
+		ctx        context.Context
+		wantMaxAge time.Duration
+	}{
+		1: {context.Background(), time.Hour},
+		2: {grpccache.WithFreshnessBudget(context.Background(), 5*time.Minute), 5 * time.Minute},
+		3: {grpccache.WithMinFresh(context.Background(), time.Minute), time.Hour},
+	}
+	for a, test := range tests {
+		if _, err := c.TestMethod(test.ctx, &testpb.TestOp{A: a}); err != nil {
+			t.Fatal(err)
+		}
+		var result testpb.TestResult
+		cached, gotCC, _, err := c.Cache.GetWithControl(context.Background(), "Test.TestMethod", &testpb.TestOp{A: a}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached || gotCC.MaxAge != test.wantMaxAge {
+			t.Errorf("%d: got cached %v with MaxAge %s, want MaxAge %s", a, cached, gotCC.MaxAge, test.wantMaxAge)
+		}
+	}
+
+	// Parse the hints directly.
+	ctx := grpccache.WithMinFresh(grpccache.WithFreshnessBudget(context.Background(), 5*time.Minute), time.Minute)
+	if hint, ok := grpccache.CacheControlFromContext(ctx); !ok || hint.MaxAge != 5*time.Minute || hint.MinFresh != time.Minute {
+		t.Errorf("got hint %+v (ok %v), want MaxAge 5m and MinFresh 1m", hint, ok)
+	}
+	if _, ok := grpccache.CacheControlFromContext(context.Background()); ok {
+		t.Error("got ok true with no hints, want false")
+	}
+}
+
+type rateLimitServer struct {
+	remaining int
+}
+
+func (s *rateLimitServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.remaining--
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour})
+	if err := grpc.SetTrailer(ctx, metadata.MD{"ratelimit-remaining": strconv.Itoa(s.remaining), "other": "x"}); err != nil {
+		return nil, err
+	}
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestCache_PreserveTrailers(t *testing.T) {
+	ts := rateLimitServer{remaining: 100}
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{PreserveTrailers: []string{"ratelimit-remaining"}})
+
+	for i, wantOther := range []string{"x", ""} { // miss, then hit
+		var md metadata.MD
+		if _, err := c.TestMethod(grpccache.WithTrailer(context.Background(), &md), &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := md["ratelimit-remaining"], "99"; got != want {
+			t.Errorf("call %d: got ratelimit-remaining trailer %q, want %q", i, got, want)
+		}
+		if got := md["other"]; got != wantOther {
+			t.Errorf("call %d: got other trailer %q, want %q (only preserved trailers are returned on a hit)", i, got, wantOther)
+		}
+	}
+	if ts.remaining != 99 {
+		t.Errorf("got %d calls remaining, want 99 (second call should be cached)", ts.remaining)
+	}
+}
+
+func TestParseHTTPCacheControl(t *testing.T) {
+	tests := map[string]grpccache.CacheControl{
+		"":                                      {},
+		"max-age=300":                           {MaxAge: 300 * time.Second},
+		"max-age=300, no-store":                 {MaxAge: 300 * time.Second, NoStore: true},
+		"no-store":                              {NoStore: true},
+		"no-cache":                              {NoCache: true},
+		"max-age=300, no-cache":                 {MaxAge: 300 * time.Second, NoCache: true},
+		"max-age=10, s-maxage=3600":             {MaxAge: 10 * time.Second, SharedMaxAge: time.Hour},
+		"public, max-age=31536000, immutable":   {MaxAge: 31536000 * time.Second, Immutable: true},
+		"max-age=60, stale-while-revalidate=30": {MaxAge: time.Minute, StaleWhileRevalidate: 30 * time.Second},
+		`MAX-AGE="5" ,No-Store`:                 {MaxAge: 5 * time.Second, NoStore: true},
+	}
+	for s, want := range tests {
+		cc, err := grpccache.ParseHTTPCacheControl(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(cc, want) {
+			t.Errorf("%q: got %+v, want %+v", s, cc, want)
+		}
+
+		// Round-trip.
+		v := cc.HTTPCacheControl()
+		cc2, err := grpccache.ParseHTTPCacheControl(v)
+		if err != nil {
+			t.Errorf("%q: round-trip of %q: %s", s, v, err)
+			continue
+		}
+		if !reflect.DeepEqual(cc2, cc) {
+			t.Errorf("%q: got %+v after round-trip (via %q), want %+v", s, cc2, v, cc)
+		}
+	}
+
+	for _, s := range []string{"max-age=abc", "max-age=-1", "s-maxage", "max-age=1.5"} {
+		if _, err := grpccache.ParseHTTPCacheControl(s); err == nil {
+			t.Errorf("%q: got nil error, want an error", s)
+		}
+	}
+}
+
+func TestCacheControl_HTTPCacheControl(t *testing.T) {
+	tests := map[string]grpccache.CacheControl{
+		"":                                     {},
+		"max-age=300":                          {MaxAge: 300 * time.Second},
+		"max-age=1":                            {MaxAge: 1500 * time.Millisecond},
+		"max-age=0, no-store":                  {NoStore: true},
+		"max-age=60, no-cache":                 {MaxAge: time.Minute, NoCache: true},
+		"max-age=60, s-maxage=3600, immutable": {MaxAge: time.Minute, SharedMaxAge: time.Hour, Immutable: true},
+	}
+	for want, cc := range tests {
+		if got := cc.HTTPCacheControl(); got != want {
+			t.Errorf("%+v: got %q, want %q", cc, got, want)
+		}
+	}
+}
+
+func TestCacheControl_httpMetadata(t *testing.T) {
+	// The server sends the HTTP syntax alongside the other metadata.
+	md := grpccache.CacheControlMetadata(grpccache.CacheControl{MaxAge: time.Minute, NoStore: true})
+	if got, want := md["cache-control"], "max-age=60, no-store"; got != want {
+		t.Errorf("got cache-control %q, want %q", got, want)
+	}
+
+	// Clients understand responses (e.g., from proxies) that only
+	// have the HTTP syntax.
+	cc, err := grpccache.CacheControlFromMetadata(metadata.MD{"cache-control": "public, max-age=60, s-maxage=3600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grpccache.CacheControl{MaxAge: time.Minute, SharedMaxAge: time.Hour}); cc == nil || !reflect.DeepEqual(*cc, want) {
+		t.Errorf("got %+v, want %+v", cc, want)
+	}
+
+	// The other metadata takes precedence.
+	cc, err = grpccache.CacheControlFromMetadata(metadata.MD{"grpccache-max-age": "1.5s", "cache-control": "max-age=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (grpccache.CacheControl{MaxAge: 1500 * time.Millisecond}); cc == nil || !reflect.DeepEqual(*cc, want) {
+		t.Errorf("got %+v, want %+v", cc, want)
+	}
+
+	if _, err := grpccache.CacheControlFromMetadata(metadata.MD{"cache-control": "max-age=x"}); err == nil {
+		t.Error("got nil error for malformed cache-control, want an error")
+	}
+}
+
+func TestCacheControl_Immutable(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{MaxEntries: 3}
+	grpccache.SetNow(c, clock.Now)
+
+	for a, cc := range map[int32]grpccache.CacheControl{
+		1: {MaxAge: time.Minute, Immutable: true},
+		2: {Immutable: true}, // no MaxAge is needed
+		3: {MaxAge: time.Minute},
+	} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, grpccache.CacheControlMetadata(cc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(ctx context.Context, a int32) bool {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cached
+	}
+	forceRefresh := grpccache.WithForceRefresh(ctx)
+	if !get(forceRefresh, 1) {
+		t.Error("immutable result not returned with WithForceRefresh")
+	}
+	if get(forceRefresh, 3) {
+		t.Error("mutable result returned with WithForceRefresh")
+	}
+	if get(grpccache.WithNoCache(ctx), 1) {
+		t.Error("immutable result returned with WithNoCache")
+	}
+
+	// Immutable results never expire (regardless of MaxAge).
+	clock.Advance(100 * 365 * 24 * time.Hour)
+	for a, want := range map[int32]bool{1: true, 2: true, 3: false} {
+		if got := get(ctx, a); got != want {
+			t.Errorf("after 100 years: %d: got cached %v, want %v", a, got, want)
+		}
+	}
+
+	// But they may be evicted.
+	for a := int32(4); a <= 6; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if get(ctx, 1) || get(ctx, 2) {
+		t.Error("immutable results cached, want them to have been evicted")
+	}
+}
+
+func TestCacheControl_Immutable_MaxAgeCap(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{MaxAgeCap: time.Hour}
+	grpccache.SetNow(c, clock.Now)
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControlMetadata(grpccache.CacheControl{Immutable: true})); err != nil {
+		t.Fatal(err)
+	}
+
+	// MaxAgeCap limits the lifetime of immutable results, and Touch
+	// extends it (up to MaxAgeCap from now).
+	clock.Advance(50 * time.Minute)
+	if !isCached(t, c, 1) {
+		t.Fatal("immutable result not cached before MaxAgeCap")
+	}
+	if touched, err := c.Touch(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, 30*time.Minute); err != nil || !touched {
+		t.Fatalf("got Touch (%v, %v), want (true, nil)", touched, err)
+	}
+	clock.Advance(20 * time.Minute)
+	if !isCached(t, c, 1) {
+		t.Error("immutable result not cached after Touch")
+	}
+	clock.Advance(30 * time.Minute)
+	if isCached(t, c, 1) {
+		t.Error("immutable result cached past MaxAgeCap")
+	}
+}
@@ -0,0 +1,107 @@
+package grpccache
+
+import (
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// anyFullName is the full name of the google.protobuf.Any message.
+const anyFullName protoreflect.FullName = "google.protobuf.Any"
+
+// canonicalizeAny returns m, or (if m contains google.protobuf.Any
+// messages, at any depth) a copy of m in which each Any's payload is
+// re-encoded deterministically. The encoding of an Any's payload is
+// opaque to the marshaler, so without this, semantically equal args
+// could produce different cache keys (e.g., if their payloads encode
+// map entries in different orders).
+//
+// Payloads whose types are not registered (in
+// protoregistry.GlobalTypes) are left as is.
+func canonicalizeAny(m protov2.Message) (protov2.Message, error) {
+	if !containsAny(m.ProtoReflect()) {
+		return m, nil
+	}
+	m = protov2.Clone(m)
+	if err := canonicalizeAnyIn(m.ProtoReflect()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// containsAny reports whether m is or contains an Any message.
+func containsAny(m protoreflect.Message) bool {
+	if m.Descriptor().FullName() == anyFullName {
+		return true
+	}
+	found := false
+	rangeMessages(m, func(m protoreflect.Message) bool {
+		found = containsAny(m)
+		return !found
+	})
+	return found
+}
+
+// canonicalizeAnyIn re-encodes the payloads of m (if it is an Any) and
+// all Any messages that m contains.
+func canonicalizeAnyIn(m protoreflect.Message) error {
+	if m.Descriptor().FullName() == anyFullName {
+		return canonicalizeAnyPayload(m)
+	}
+	var err error
+	rangeMessages(m, func(m protoreflect.Message) bool {
+		err = canonicalizeAnyIn(m)
+		return err == nil
+	})
+	return err
+}
+
+// canonicalizeAnyPayload re-encodes the payload of a, an Any message.
+func canonicalizeAnyPayload(a protoreflect.Message) error {
+	fields := a.Descriptor().Fields()
+	typeURL, value := fields.ByName("type_url"), fields.ByName("value")
+	mt, err := protoregistry.GlobalTypes.FindMessageByURL(a.Get(typeURL).String())
+	if err != nil {
+		return nil // unknown type; leave it as is
+	}
+	payload := mt.New()
+	if err := protov2.Unmarshal(a.Get(value).Bytes(), payload.Interface()); err != nil {
+		return err
+	}
+	if err := canonicalizeAnyIn(payload); err != nil {
+		return err
+	}
+	data, err := protov2.MarshalOptions{Deterministic: true}.Marshal(payload.Interface())
+	if err != nil {
+		return err
+	}
+	a.Set(value, protoreflect.ValueOfBytes(data))
+	return nil
+}
+
+// rangeMessages calls f for each message that is the value of a
+// populated field of m (or an element of a list or map field), until
+// f returns false.
+func rangeMessages(m protoreflect.Message, f func(protoreflect.Message) bool) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				if !f(list.Get(i).Message()) {
+					return false
+				}
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			cont := true
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				cont = f(v.Message())
+				return cont
+			})
+			return cont
+		case fd.Message() != nil && !fd.IsMap():
+			return f(v.Message())
+		}
+		return true
+	})
+}
@@ -0,0 +1,59 @@
+package grpccache_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/typepb"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_anyArgDeterministic(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	// Encode the same Struct payload with its map entries in two
+	// different orders (concatenated encodings are merged).
+	marshal := func(s *structpb.Struct) []byte {
+		data, err := protov2.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	a := marshal(&structpb.Struct{Fields: map[string]*structpb.Value{"a": structpb.NewNumberValue(1)}})
+	b := marshal(&structpb.Struct{Fields: map[string]*structpb.Value{"b": structpb.NewStringValue("x")}})
+	newArg := func(payload []byte) *typepb.Option {
+		return &typepb.Option{Name: "opt", Value: &anypb.Any{TypeUrl: "type.googleapis.com/google.protobuf.Struct", Value: payload}}
+	}
+	arg1, arg2 := newArg(append(append([]byte{}, a...), b...)), newArg(append(append([]byte{}, b...), a...))
+
+	if err := c.Store(ctx, "Test.TestMethod", arg1, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var result testpb.TestResult
+	cached, err := c.Get(ctx, "Test.TestMethod", arg2, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached {
+		t.Error("not cached, want args with equal Any payloads to share a key")
+	}
+	if string(arg1.Value.Value) == string(arg2.Value.Value) {
+		t.Error("arg was modified, want the cache key to be computed from a copy")
+	}
+
+	// Args with different Any payloads have different keys.
+	cached, err = c.Get(ctx, "Test.TestMethod", newArg(a), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached {
+		t.Error("cached, want args with different Any payloads to have different keys")
+	}
+}
@@ -1,3 +1,9 @@
 // Package grpccache provides caching for gRPC calls with HTTP
 // semantics.
+//
+// The funcs named Internal_Xyz are called by the code that
+// grpccache-gen generates, so their signatures are kept as stable as
+// the rest of the exported API (even though user code should not call
+// them). The grpccache-gen tests check that the generated code in
+// testpb is up to date, and the grpccache tests build and exercise it.
 package grpccache
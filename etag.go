@@ -0,0 +1,167 @@
+package grpccache
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// ErrNotModified is returned by a gRPC server method implementation
+// to indicate that the result identified by the request's ETag (see
+// RequestETag) has not changed. The CachedXyzServer wrapper sends an
+// empty result to the client, and the client reuses its cached result
+// (refreshing its expiry with the CacheControl set by the server
+// method implementation, if any, and keeping the cached result's ETag
+// if the server set none).
+//
+// It must only be returned if RequestETag returned a non-empty ETag
+// for the request.
+var ErrNotModified = errors.New("grpccache: not modified")
+
+// errNotModifiedMissing is returned by Store if the server said the
+// result was not modified but the cached result is not known (because
+// the call was not made with withCachedETag, and the cached result is
+// no longer present).
+var errNotModifiedMissing = errors.New("grpccache: server returned not modified but the cached result is gone")
+
+// RequestETag is called by gRPC server method implementations to get
+// the ETag (see CacheControl.ETag) of the client's cached result for
+// the request. If it matches the current result's ETag, the server
+// may return ErrNotModified. It returns "" if the client did not send
+// an ETag.
+func RequestETag(ctx context.Context) string {
+	md, _ := metadata.FromContext(ctx)
+	etag, _ := lookupMetadata(md, "if-none-match")
+	return etag
+}
+
+// withRequestETag returns a copy of ctx whose request metadata
+// includes etag.
+func withRequestETag(ctx context.Context, etag string) context.Context {
+	return withRequestMetadata(ctx, "if-none-match", etag)
+}
+
+// revalidated is the cached result whose ETag was sent with a call
+// (see withCachedETag).
+type revalidated struct {
+	cacheKey string
+	data     []byte
+	cc       CacheControl
+}
+
+// withCachedETag returns a copy of ctx whose request metadata includes
+// the ETag of the cached result for the call, if there is one (and an
+// error is not cached). The returned ctx also holds the cached result,
+// so that a "not modified" response can be handled even if the result
+// is evicted (or replaced) during the call (see storeNotModified).
+func (c *Cache) withCachedETag(ctx context.Context, method string, arg proto.Message) context.Context {
+	cacheKey, err := c.cacheKey(ctx, method, arg)
+	if err != nil {
+		return ctx
+	}
+	data, cc, _, present, err := c.storage().Get(cacheKey)
+	if err != nil {
+		c.logStorageError("Get", cacheKey, err)
+		return ctx
+	}
+	if !present || cc.ErrorCode != codes.OK || cc.ETag == "" {
+		return ctx
+	}
+	ctx = withRequestETag(ctx, cc.ETag)
+	return context.WithValue(ctx, revalidatedKey, revalidated{cacheKey: cacheKey, data: data, cc: cc})
+}
+
+// Internal_WithCachedETag is an internal func called by the
+// code-genned CachedXyzClient wrapper methods before they make a call
+// whose result was not served from the cache. It should not be called
+// by user code. If a result for the call is still stored (e.g.,
+// because it is NoCache), it returns a copy of ctx whose request
+// metadata includes the result's ETag, so that the server may return
+// ErrNotModified instead of sending the result again.
+func Internal_WithCachedETag(ctx context.Context, c *Cache, method string, arg proto.Message) context.Context {
+	if getNoCache(ctx) {
+		// Store ignores the response, so a "not modified" response
+		// would leave the result empty.
+		return ctx
+	}
+	return c.withCachedETag(ctx, method, arg)
+}
+
+// Internal_SetNotModified is an internal func called by the
+// code-genned CachedXyzServer wrapper methods when the server method
+// implementation returns ErrNotModified. It should not be called by
+// user code.
+func Internal_SetNotModified(cc *CacheControl) {
+	cc.notModified = true
+}
+
+// storeNotModified handles a "not modified" response (see
+// ErrNotModified) in Store. It writes the cached result whose ETag was
+// sent with the call to result and stores it again (with a refreshed
+// expiry).
+//
+// The response's cache control (cc) determines the new expiry. The
+// cached result's ETag, Vary, and Trailer are kept unless cc has its
+// own. If the server set no cache control at all, the cached result
+// is left as is.
+func (c *Cache) storeNotModified(ctx context.Context, cacheKey string, arg, result proto.Message, cc CacheControl) error {
+	storage := c.storage()
+	var data []byte
+	var storedCC CacheControl
+	if r, ok := ctx.Value(revalidatedKey).(revalidated); ok && r.cacheKey == cacheKey {
+		// Use the result that the server validated, which is still
+		// known even if the stored result was evicted (or replaced)
+		// during the call.
+		data, storedCC = r.data, r.cc
+	} else {
+		var present bool
+		var err error
+		data, storedCC, _, present, err = storage.Get(cacheKey)
+		if err != nil {
+			c.logStorageError("Get", cacheKey, err)
+			return errNotModifiedMissing
+		}
+		if !present {
+			return errNotModifiedMissing
+		}
+	}
+	if err := c.unmarshal(data, result); err != nil {
+		return err
+	}
+
+	cc.notModified = false
+	if cc.IsZero() {
+		if c.logging() {
+			c.logf("Cache: REUSE   %s %+v: result %s", cacheKey, arg, truncate(result))
+		}
+		return nil
+	}
+	if cc.ETag == "" {
+		cc.ETag = storedCC.ETag
+	}
+	if len(cc.Vary) == 0 {
+		cc.Vary = storedCC.Vary
+	}
+	if cc.Trailer == nil {
+		cc.Trailer = storedCC.Trailer
+	}
+	cc.StoredAt = c.timeNow()
+	if !cc.cacheable(c.Shared, c.timeNow()) {
+		c.delete(cacheKey)
+		return nil
+	}
+	if err := storage.Set(cacheKey, data, cc, c.expiry(&cc)); err != nil {
+		c.logStorageError("Set", cacheKey, err)
+		return nil
+	}
+	atomic.AddUint64(&c.stats.stores, 1)
+
+	if c.logging() {
+		c.logf("Cache: REFRESH %s %+v: result %s", cacheKey, arg, truncate(result))
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package grpccache_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// etagServer is a testpb.TestServer whose result is its current
+// version. It returns ErrNotModified if the client's cached result has
+// the current version. If noCache is set, its results are NoCache.
+type etagServer struct {
+	mu          sync.Mutex
+	version     int32
+	noCache     bool
+	noMaxAge    bool // don't set a MaxAge (or StaleWhileRevalidate)
+	calls       int
+	notModified int
+
+	beforeNotModified func() // called (if set) before returning ErrNotModified
+
+	// notModifiedCC, if set, is the cache control of "not modified"
+	// responses (instead of the full cache control). If it is zero,
+	// SetCacheControl is not called for them.
+	notModifiedCC *grpccache.CacheControl
+}
+
+func (s *etagServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	etag := strconv.Itoa(int(s.version))
+	cc := grpccache.CacheControl{MaxAge: time.Minute, StaleWhileRevalidate: time.Minute, ETag: etag, NoCache: s.noCache}
+	if s.noMaxAge {
+		cc.MaxAge, cc.StaleWhileRevalidate = 0, 0
+	}
+	if grpccache.RequestETag(ctx) == etag {
+		if s.notModifiedCC != nil {
+			cc = *s.notModifiedCC
+		}
+		if !cc.IsZero() {
+			grpccache.SetCacheControl(ctx, cc)
+		}
+		s.notModified++
+		if s.beforeNotModified != nil {
+			s.beforeNotModified()
+		}
+		return nil, grpccache.ErrNotModified
+	}
+	grpccache.SetCacheControl(ctx, cc)
+	return &testpb.TestResult{X: s.version}, nil
+}
+
+func (s *etagServer) setVersion(v int32) {
+	s.mu.Lock()
+	s.version = v
+	s.mu.Unlock()
+}
+
+func (s *etagServer) counts() (calls, notModified int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, s.notModified
+}
+
+func TestCache_ETag(t *testing.T) {
+	ts := &etagServer{version: 1}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	clock := &fakeClock{t: time.Now()}
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	grpccache.SetNow(c.Cache, clock.Now)
+	ctx := context.Background()
+
+	call := func(wantX int32) {
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != wantX {
+			t.Errorf("got result %d, want %d", r.X, wantX)
+		}
+	}
+
+	// waitFresh waits until the background revalidation has stored a
+	// fresh result equal to wantX.
+	waitFresh := func(wantX int32) {
+		deadline := time.Now().Add(time.Second)
+		for {
+			var result testpb.TestResult
+			cached, err := c.Cache.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached && result.X == wantX {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("result %d was not revalidated in the background", wantX)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	call(1)
+
+	// Unchanged: the server says it's not modified, and the cached
+	// result's expiry is refreshed.
+	clock.Advance(90 * time.Second)
+	call(1)
+	waitFresh(1)
+	if calls, notModified := ts.counts(); calls != 2 || notModified != 1 {
+		t.Errorf("got %d calls (%d not modified), want 2 calls (1 not modified)", calls, notModified)
+	}
+
+	// Changed: the server sends the new result.
+	ts.setVersion(2)
+	clock.Advance(90 * time.Second)
+	call(1)
+	waitFresh(2)
+	if calls, notModified := ts.counts(); calls != 3 || notModified != 1 {
+		t.Errorf("got %d calls (%d not modified), want 3 calls (1 not modified)", calls, notModified)
+	}
+	call(2)
+}
+
+func TestCache_NoCache(t *testing.T) {
+	ts := &etagServer{version: 1, noCache: true}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	ctx := context.Background()
+
+	call := func(wantX int32, wantCalls, wantNotModified int) {
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != wantX {
+			t.Errorf("got result %d, want %d", r.X, wantX)
+		}
+		if calls, notModified := ts.counts(); calls != wantCalls || notModified != wantNotModified {
+			t.Errorf("got %d calls (%d not modified), want %d (%d not modified)", calls, notModified, wantCalls, wantNotModified)
+		}
+	}
+
+	// The result is stored, but it is not served without
+	// revalidation.
+	call(1, 1, 0)
+	if n := c.Cache.Len(); n != 1 {
+		t.Errorf("got %d cached items, want 1", n)
+	}
+	if isCached(t, c.Cache, 1) {
+		t.Error("NoCache result served by Get")
+	}
+
+	// Each call revalidates it with its ETag.
+	call(1, 2, 1)
+	call(1, 3, 2)
+
+	// A changed result replaces it.
+	ts.setVersion(2)
+	call(2, 4, 2)
+	call(2, 5, 3)
+}
+
+func TestCache_NoCache_noMaxAge(t *testing.T) {
+	ts := &etagServer{version: 1, noCache: true, noMaxAge: true}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	clock := &fakeClock{t: time.Now()}
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	grpccache.SetNow(c.Cache, clock.Now)
+	ctx := context.Background()
+
+	call := func(wantCalls, wantNotModified int) {
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != 1 {
+			t.Errorf("got result %d, want 1", r.X)
+		}
+		if calls, notModified := ts.counts(); calls != wantCalls || notModified != wantNotModified {
+			t.Errorf("got %d calls (%d not modified), want %d (%d not modified)", calls, notModified, wantCalls, wantNotModified)
+		}
+	}
+
+	// The result is stored (because it has an ETag) and revalidated.
+	call(1, 0)
+	if n := c.Cache.Len(); n != 1 {
+		t.Errorf("got %d cached items, want 1", n)
+	}
+	call(2, 1)
+
+	// It is kept for a while after each revalidation, but not
+	// forever.
+	clock.Advance(30 * time.Minute)
+	call(3, 2)
+	clock.Advance(2 * time.Hour)
+	call(4, 2)
+}
+
+func TestCache_ETag_notModifiedCacheControl(t *testing.T) {
+	tests := map[string]grpccache.CacheControl{
+		"no cache control": {},
+		"no ETag":          {MaxAge: time.Minute, NoCache: true},
+	}
+	for name, notModifiedCC := range tests {
+		notModifiedCC := notModifiedCC
+		ts := &etagServer{version: 1, noCache: true, notModifiedCC: &notModifiedCC}
+		cc, done := newTestClient(t, ts)
+		c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+		ctx := context.Background()
+
+		// Each call after the first is revalidated with the cached
+		// result's ETag, even though the "not modified" responses
+		// don't include it.
+		for i := 1; i <= 3; i++ {
+			r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if r.X != 1 {
+				t.Errorf("%s: call %d: got result %d, want 1", name, i, r.X)
+			}
+			if calls, notModified := ts.counts(); calls != i || notModified != i-1 {
+				t.Errorf("%s: call %d: got %d calls (%d not modified), want %d (%d not modified)", name, i, calls, notModified, i, i-1)
+			}
+			var etags []string
+			c.Cache.ForEach(func(_ string, _ int, cc grpccache.CacheControl, _ time.Time) bool {
+				etags = append(etags, cc.ETag)
+				return true
+			})
+			if len(etags) != 1 || etags[0] != "1" {
+				t.Errorf("%s: call %d: got cached ETags %q, want [1]", name, i, etags)
+			}
+		}
+		done()
+	}
+}
+
+func TestCache_ETag_evictedDuringCall(t *testing.T) {
+	ts := &etagServer{version: 1, noCache: true}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	ctx := context.Background()
+
+	if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached result is evicted after its ETag is sent to the
+	// server but before the "not modified" response arrives.
+	ts.beforeNotModified = func() {
+		if removed, err := c.Cache.Invalidate(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}); err != nil || !removed {
+			t.Errorf("got Invalidate (%v, %v), want (true, nil)", removed, err)
+		}
+	}
+	r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.X != 1 {
+		t.Errorf("got result %d, want 1", r.X)
+	}
+	if calls, notModified := ts.counts(); calls != 2 || notModified != 1 {
+		t.Errorf("got %d calls (%d not modified), want 2 (1 not modified)", calls, notModified)
+	}
+	if n := c.Cache.Len(); n != 1 {
+		t.Errorf("got %d cached items, want 1 (the revalidated result stored again)", n)
+	}
+}
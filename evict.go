@@ -0,0 +1,48 @@
+package grpccache
+
+// An EvictReason describes why an item was removed from a Cache (see
+// Cache.OnEvict).
+type EvictReason int
+
+const (
+	// EvictExpired means the item was removed because it expired
+	// (and, if MaxStale is set, its MaxStale window has passed).
+	EvictExpired EvictReason = iota
+
+	// EvictSize means the item was removed to make room for other
+	// items under MaxSize or MaxEntries (it was the least recently
+	// used) or after Resize lowered MaxSize, or because an item stored
+	// under its key was larger than MaxSize.
+	EvictSize
+
+	// EvictInvalidated means the item was removed by Invalidate,
+	// InvalidateMethod, or Clear.
+	EvictInvalidated
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictExpired:
+		return "expired"
+	case EvictSize:
+		return "size"
+	case EvictInvalidated:
+		return "invalidated"
+	}
+	return "unknown"
+}
+
+// onEvict calls c.OnEvict (if set) for the item with the given key.
+// The caller must not hold any locks.
+func (c *Cache) onEvict(key string, reason EvictReason) {
+	if c.OnEvict != nil {
+		c.OnEvict(key, reason)
+	}
+}
+
+// onEvictKeys calls c.OnEvict (if set) for each of keys.
+func (c *Cache) onEvictKeys(keys []string, reason EvictReason) {
+	for _, key := range keys {
+		c.onEvict(key, reason)
+	}
+}
@@ -0,0 +1,107 @@
+package grpccache_test
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_OnEvict(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{MaxEntries: 2}
+	grpccache.SetNow(c, clock.Now)
+
+	var (
+		mu      sync.Mutex
+		reasons []grpccache.EvictReason
+	)
+	c.OnEvict = func(key string, reason grpccache.EvictReason) {
+		if !strings.HasPrefix(key, "Test.TestMethod|") {
+			t.Errorf("got evicted key %q, want a Test.TestMethod key", key)
+		}
+		// Call back into the cache, which would deadlock if OnEvict
+		// were called with a lock held.
+		c.ForEach(func(string, int, grpccache.CacheControl, time.Time) bool { return true })
+
+		mu.Lock()
+		reasons = append(reasons, reason)
+		mu.Unlock()
+	}
+	checkReasons := func(label string, want ...grpccache.EvictReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(reasons, want) {
+			t.Errorf("%s: got evict reasons %v, want %v", label, reasons, want)
+		}
+		reasons = nil
+	}
+	store := func(a int32, maxAge time.Duration) {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(maxAge)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Eviction to satisfy MaxEntries.
+	store(1, time.Hour)
+	store(2, time.Hour)
+	checkReasons("before limit")
+	store(3, time.Hour)
+	checkReasons("MaxEntries", grpccache.EvictSize)
+	c.MaxEntries = 0
+
+	// Expiry found by Get.
+	store(4, time.Minute)
+	clock.Advance(2 * time.Minute)
+	if isCached(t, c, 4) {
+		t.Error("4 cached, want it to have expired")
+	}
+	checkReasons("Get expired", grpccache.EvictExpired)
+
+	// Expiry found by the janitor.
+	store(5, time.Minute)
+	clock.Advance(2 * time.Minute)
+	c.StartJanitor(5 * time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d entries, want the expired entry to be removed by the janitor", c.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.StopJanitor()
+	checkReasons("janitor expired", grpccache.EvictExpired)
+
+	// Invalidation.
+	if _, err := c.Invalidate(ctx, "Test.TestMethod", &testpb.TestOp{A: 3}); err != nil {
+		t.Fatal(err)
+	}
+	checkReasons("Invalidate", grpccache.EvictInvalidated)
+	store(6, time.Hour)
+	if n := c.InvalidateMethod("Test.TestMethod"); n != 2 {
+		t.Errorf("got %d invalidated, want 2", n)
+	}
+	checkReasons("InvalidateMethod", grpccache.EvictInvalidated, grpccache.EvictInvalidated)
+	store(7, time.Hour)
+	c.Clear()
+	checkReasons("Clear", grpccache.EvictInvalidated)
+}
+
+func TestEvictReason_String(t *testing.T) {
+	tests := map[grpccache.EvictReason]string{
+		grpccache.EvictExpired:     "expired",
+		grpccache.EvictSize:        "size",
+		grpccache.EvictInvalidated: "invalidated",
+	}
+	for reason, want := range tests {
+		if got := reason.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
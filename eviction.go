@@ -0,0 +1,231 @@
+package grpccache
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+)
+
+// An EvictionPolicy chooses which items the default in-memory storage
+// evicts when the cache exceeds MaxSize or MaxEntries (see
+// Cache.EvictionPolicy). The storage tells the policy about each item
+// that is stored, accessed, or removed, and it asks the policy for
+// items to evict.
+//
+// Implementations must be safe for concurrent use. They are called
+// while the storage holds locks, so they must not call methods on
+// the Cache.
+type EvictionPolicy interface {
+	// RecordAccess records that the item with the given key was
+	// retrieved.
+	RecordAccess(key string)
+
+	// RecordStore records that an item of the given size was stored
+	// under key (replacing any existing item).
+	RecordStore(key string, size uint64)
+
+	// Evict chooses items to evict, stops tracking them, and returns
+	// their keys. The items' total size must be at least need (or,
+	// if need is 0, there must be at least one item), unless the
+	// policy tracks too few items.
+	Evict(need uint64) []string
+
+	// Remove records that the item with the given key was removed
+	// (other than by Evict).
+	Remove(key string)
+}
+
+// NewLRUPolicy returns an EvictionPolicy that evicts the least
+// recently used (stored or retrieved) items first. It is like the
+// storage's default behavior, except that it orders items across all
+// shards (see Cache.Shards).
+func NewLRUPolicy() EvictionPolicy {
+	return &listPolicy{items: map[string]*list.Element{}, list: list.New(), recency: true}
+}
+
+// NewFIFOPolicy returns an EvictionPolicy that evicts the least
+// recently added items first, regardless of how recently they were
+// retrieved. Replacing an item does not change its position.
+func NewFIFOPolicy() EvictionPolicy {
+	return &listPolicy{items: map[string]*list.Element{}, list: list.New()}
+}
+
+// listPolicy is an EvictionPolicy that evicts items in list order
+// (LRU if recency is set, otherwise FIFO).
+type listPolicy struct {
+	recency bool // move items to the front when they are used
+
+	mu    sync.Mutex
+	items map[string]*list.Element // key -> element (of *policyItem) in list
+	list  *list.List               // items to evict last at the front
+}
+
+// policyItem is an item tracked by an EvictionPolicy.
+type policyItem struct {
+	key  string
+	size uint64
+}
+
+func (p *listPolicy) RecordAccess(key string) {
+	if !p.recency {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.items[key]; ok {
+		p.list.MoveToFront(elem)
+	}
+}
+
+func (p *listPolicy) RecordStore(key string, size uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.items[key]; ok {
+		elem.Value.(*policyItem).size = size
+		if p.recency {
+			p.list.MoveToFront(elem)
+		}
+		return
+	}
+	p.items[key] = p.list.PushFront(&policyItem{key: key, size: size})
+}
+
+func (p *listPolicy) Evict(need uint64) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var keys []string
+	var freed uint64
+	for freed < need || len(keys) == 0 {
+		elem := p.list.Back()
+		if elem == nil {
+			break
+		}
+		item := p.list.Remove(elem).(*policyItem)
+		delete(p.items, item.key)
+		keys = append(keys, item.key)
+		freed += item.size
+	}
+	return keys
+}
+
+func (p *listPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.items[key]; ok {
+		p.list.Remove(elem)
+		delete(p.items, key)
+	}
+}
+
+// NewLFUPolicy returns an EvictionPolicy that evicts the least
+// frequently used items first (counting both stores and retrievals).
+// Among items used equally often, the least recently used is evicted
+// first.
+//
+// Because new items have been used only once, they are often the
+// first to be evicted, so the LFU policy favors items that remain
+// popular over time.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{items: map[string]*lfuItem{}}
+}
+
+// lfuPolicy is the EvictionPolicy returned by NewLFUPolicy.
+type lfuPolicy struct {
+	mu    sync.Mutex
+	items map[string]*lfuItem
+	heap  lfuHeap
+	clock uint64 // incremented on each use, to order uses
+}
+
+type lfuItem struct {
+	policyItem
+	uses    uint64 // number of uses
+	lastUse uint64 // value of lfuPolicy.clock at the last use
+	index   int    // index in lfuHeap
+}
+
+func (p *lfuPolicy) use(item *lfuItem) {
+	p.clock++
+	item.uses++
+	item.lastUse = p.clock
+}
+
+func (p *lfuPolicy) RecordAccess(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if item, ok := p.items[key]; ok {
+		p.use(item)
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *lfuPolicy) RecordStore(key string, size uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if item, ok := p.items[key]; ok {
+		item.size = size
+		p.use(item)
+		heap.Fix(&p.heap, item.index)
+		return
+	}
+	item := &lfuItem{policyItem: policyItem{key: key, size: size}}
+	p.use(item)
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy) Evict(need uint64) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var keys []string
+	var freed uint64
+	for (freed < need || len(keys) == 0) && len(p.heap) > 0 {
+		item := heap.Pop(&p.heap).(*lfuItem)
+		delete(p.items, item.key)
+		keys = append(keys, item.key)
+		freed += item.size
+	}
+	return keys
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+}
+
+// lfuHeap is a heap.Interface of the items tracked by an lfuPolicy,
+// with the item to evict first at the root.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].uses != h[j].uses {
+		return h[i].uses < h[j].uses
+	}
+	return h[i].lastUse < h[j].lastUse
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
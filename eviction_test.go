@@ -0,0 +1,106 @@
+package grpccache_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// evictAll returns the keys that p evicts, one Evict call at a time,
+// until it has none left.
+func evictAll(p grpccache.EvictionPolicy) []string {
+	var all []string
+	for {
+		keys := p.Evict(0)
+		if len(keys) == 0 {
+			return all
+		}
+		all = append(all, keys...)
+	}
+}
+
+func TestEvictionPolicy_order(t *testing.T) {
+	tests := map[string]struct {
+		policy grpccache.EvictionPolicy
+		want   []string
+	}{
+		"LRU":  {policy: grpccache.NewLRUPolicy(), want: []string{"c", "a", "b"}},
+		"LFU":  {policy: grpccache.NewLFUPolicy(), want: []string{"c", "b", "a"}},
+		"FIFO": {policy: grpccache.NewFIFOPolicy(), want: []string{"a", "b", "c"}},
+	}
+	for label, test := range tests {
+		p := test.policy
+		p.RecordStore("a", 1)
+		p.RecordStore("b", 1)
+		p.RecordStore("c", 1)
+		p.RecordAccess("a")
+		p.RecordAccess("a")
+		p.RecordAccess("b")
+		if keys := evictAll(p); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("%s: got eviction order %v, want %v", label, keys, test.want)
+		}
+	}
+}
+
+func TestEvictionPolicy_need(t *testing.T) {
+	for label, p := range map[string]grpccache.EvictionPolicy{
+		"LRU":  grpccache.NewLRUPolicy(),
+		"LFU":  grpccache.NewLFUPolicy(),
+		"FIFO": grpccache.NewFIFOPolicy(),
+	} {
+		p.RecordStore("a", 10)
+		p.RecordStore("b", 10)
+		p.RecordStore("c", 10)
+		p.Remove("b")
+		if keys, want := p.Evict(15), []string{"a", "c"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s: got Evict(15) == %v, want %v", label, keys, want)
+		}
+		if keys := p.Evict(0); len(keys) != 0 {
+			t.Errorf("%s: got Evict(0) == %v after evicting all items, want none", label, keys)
+		}
+	}
+}
+
+func TestCache_EvictionPolicy(t *testing.T) {
+	ctx := context.Background()
+	tests := map[string]struct {
+		policy  grpccache.EvictionPolicy
+		want    []int32 // items cached at the end
+		evicted int32
+	}{
+		"LRU":  {policy: grpccache.NewLRUPolicy(), want: []int32{1, 3}, evicted: 2},
+		"LFU":  {policy: grpccache.NewLFUPolicy(), want: []int32{1, 3}, evicted: 2},
+		"FIFO": {policy: grpccache.NewFIFOPolicy(), want: []int32{2, 3}, evicted: 1},
+	}
+	for label, test := range tests {
+		c := &grpccache.Cache{MaxEntries: 2, EvictionPolicy: test.policy, Shards: 4}
+		for _, a := range []int32{1, 2} {
+			if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		isCached(t, c, 1)
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 3}, &testpb.TestResult{X: 3}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := c.Len(); n != 2 {
+			t.Errorf("%s: got %d entries, want 2", label, n)
+		}
+		if isCached(t, c, test.evicted) {
+			t.Errorf("%s: %d cached, want it to have been evicted", label, test.evicted)
+		}
+		for _, a := range test.want {
+			if !isCached(t, c, a) {
+				t.Errorf("%s: %d not cached, want it cached", label, a)
+			}
+		}
+		if n := c.Stats().Evictions; n != 1 {
+			t.Errorf("%s: got %d evictions, want 1", label, n)
+		}
+	}
+}
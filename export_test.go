@@ -0,0 +1,16 @@
+package grpccache
+
+import "time"
+
+// SetNow sets the func that c uses to get the current time. It is
+// exported for tests.
+func SetNow(c *Cache, now func() time.Time) {
+	c.now = now
+}
+
+// CacheControlMetadata and CacheControlFromMetadata are exported for
+// tests.
+var (
+	CacheControlMetadata     = cacheControlMetadata
+	CacheControlFromMetadata = cacheControlFromMetadata
+)
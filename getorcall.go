@@ -0,0 +1,143 @@
+package grpccache
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// GetOrCall writes the cached result of a call to method with arg to
+// result, if there is one. Otherwise it makes the call (using call)
+// and stores and returns its result. It performs the same steps as
+// the CachedXyzClient auto-generated wrapper methods (including
+// revalidating stale results, SingleFlight, and falling back to
+// expired results per MaxStale), so that hand-written wrappers need
+// not replicate them.
+//
+// call must make the gRPC call with ctx and opts (which capture the
+// response header and trailer, which hold the cache control info) and
+// return its result, which must be of the same type as result. It is
+// called in the background, after GetOrCall returns, to revalidate a
+// stale result, so it must not write to result. For example:
+//
+//	var result pb.Result
+//	err := c.GetOrCall(ctx, "Xyz.Method", in, &result, func(ctx context.Context, opts ...grpc.CallOption) (interface{}, error) {
+//		return client.Method(ctx, in, opts...)
+//	})
+//
+// GetOrCall may be called on a nil *Cache, in which case it just
+// makes the call.
+func (c *Cache) GetOrCall(ctx context.Context, method string, arg proto.Message, result proto.Message, call func(ctx context.Context, opts ...grpc.CallOption) (interface{}, error)) error {
+	if c == nil {
+		v, err := call(ctx)
+		if err != nil {
+			return err
+		}
+		setResult(result, v)
+		return nil
+	}
+
+	callAndStore := func(ctx context.Context) (interface{}, error) {
+		var header, trailer metadata.MD
+		v, err := call(ctx, grpc.Header(&header), grpc.Trailer(&trailer))
+		md := Internal_CacheControlMetadata(header, trailer)
+		if err != nil {
+			if err := c.StoreError(ctx, method, arg, err, md); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+		m, _ := v.(proto.Message)
+		if err := c.Store(ctx, method, arg, m, md); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	return c.getOrFetch(ctx, method, arg, result, callAndStore, true)
+}
+
+// GetOrLoad writes the cached result of a call to method with arg to
+// result, if there is one. Otherwise it calls loader, stores the
+// result that loader returns per the returned cache control info (as
+// Set does), and writes it to result. It performs the same steps as
+// GetOrCall (including revalidating stale results, SingleFlight,
+// which coalesces concurrent loads, and falling back to expired
+// results per MaxStale), but it is not specific to gRPC, so it can be
+// used to cache the results of any func whose args and results are
+// messages. Errors returned by loader are not cached.
+//
+// Like GetOrCall's call, loader is called in the background to
+// revalidate a stale result, so it must not write to result. For
+// example:
+//
+//	var result pb.Result
+//	err := c.GetOrLoad(ctx, "Xyz.Method", in, &result, func(ctx context.Context) (proto.Message, grpccache.CacheControl, error) {
+//		r, err := computeResult(ctx, in)
+//		return r, grpccache.CacheControl{MaxAge: time.Minute}, err
+//	})
+//
+// GetOrLoad may be called on a nil *Cache, in which case it just
+// calls loader.
+func (c *Cache) GetOrLoad(ctx context.Context, method string, arg proto.Message, result proto.Message, loader func(ctx context.Context) (proto.Message, CacheControl, error)) error {
+	if c == nil {
+		v, _, err := loader(ctx)
+		if err != nil {
+			return err
+		}
+		setResult(result, v)
+		return nil
+	}
+
+	return c.getOrFetch(ctx, method, arg, result, func(ctx context.Context) (interface{}, error) {
+		v, cc, err := loader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Set(ctx, method, arg, v, cc); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}, false)
+}
+
+// getOrFetch implements GetOrCall and GetOrLoad. fetch gets (and
+// stores) the result when it isn't cached. If conditional is true
+// (for gRPC calls), the ETag of a result that is stored but not
+// served is sent with the call (see Internal_WithCachedETag).
+func (c *Cache) getOrFetch(ctx context.Context, method string, arg proto.Message, result proto.Message, fetch func(ctx context.Context) (interface{}, error), conditional bool) error {
+	cached, revalidate, err := c.GetStale(ctx, method, arg, result)
+	if revalidate {
+		c.Revalidate(ctx, method, arg, fetch)
+	}
+	if err != nil {
+		return err
+	}
+	if cached {
+		return nil
+	}
+
+	if conditional {
+		ctx = Internal_WithCachedETag(ctx, c, method, arg)
+	}
+	v, err := c.Do(ctx, method, arg, func() (interface{}, error) { return fetch(ctx) })
+	if err != nil {
+		if cached, cacheErr := c.GetIfError(ctx, method, arg, result, err); cached {
+			return cacheErr
+		}
+		return err
+	}
+	setResult(result, v)
+	return nil
+}
+
+// setResult overwrites dst with a copy of v (a result returned by a
+// call), or resets dst if v is nil.
+func setResult(dst proto.Message, v interface{}) {
+	if m, ok := v.(proto.Message); ok && !isNilMessage(m) {
+		copyMessage(dst, m)
+		return
+	}
+	dst.Reset()
+}
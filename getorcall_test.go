@@ -0,0 +1,112 @@
+package grpccache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_GetOrCall(t *testing.T) {
+	ts := testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	client := testpb.NewTestClient(cc)
+	ctx := context.Background()
+
+	getOrCall := func(c *grpccache.Cache, a int32) *testpb.TestResult {
+		in := &testpb.TestOp{A: a}
+		var result testpb.TestResult
+		err := c.GetOrCall(ctx, "Test.TestMethod", in, &result, func(ctx context.Context, opts ...grpc.CallOption) (interface{}, error) {
+			return client.TestMethod(ctx, in, opts...)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+
+	c := &grpccache.Cache{}
+	for i, test := range []struct {
+		a         int32
+		wantCalls int
+	}{
+		{1, 1},
+		{1, 1},
+		{2, 2},
+		{1, 2},
+	} {
+		if r := getOrCall(c, test.a); r.X != test.a {
+			t.Errorf("%d: got result %d, want %d", i, r.X, test.a)
+		}
+		if len(ts.calls) != test.wantCalls {
+			t.Errorf("%d: got %d server calls, want %d", i, len(ts.calls), test.wantCalls)
+		}
+	}
+	if !isCached(t, c, 2) {
+		t.Error("2 not cached")
+	}
+
+	// A nil cache just makes the call.
+	if r := getOrCall(nil, 3); r.X != 3 {
+		t.Errorf("nil cache: got result %d, want 3", r.X)
+	}
+	if got, want := len(ts.calls), 3; got != want {
+		t.Errorf("nil cache: got %d server calls, want %d", got, want)
+	}
+}
+
+func TestCache_GetOrLoad(t *testing.T) {
+	c := &grpccache.Cache{SingleFlight: true}
+	in := &testpb.TestOp{A: 1}
+
+	var mu sync.Mutex
+	var loads int
+	loader := func(ctx context.Context) (proto.Message, grpccache.CacheControl, error) {
+		mu.Lock()
+		loads++
+		mu.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+		return &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour}, nil
+	}
+
+	// Concurrent misses share a single load.
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result testpb.TestResult
+			if err := c.GetOrLoad(context.Background(), "Test.TestMethod", in, &result, loader); err != nil {
+				t.Error(err)
+				return
+			}
+			if result.X != 1 {
+				t.Errorf("got result %d, want 1", result.X)
+			}
+		}()
+	}
+	wg.Wait()
+	if want := 1; loads != want {
+		t.Errorf("got %d loads, want %d", loads, want)
+	}
+
+	// The loaded result is cached.
+	if !isCached(t, c, 1) {
+		t.Error("1 not cached")
+	}
+	var result testpb.TestResult
+	if err := c.GetOrLoad(context.Background(), "Test.TestMethod", in, &result, loader); err != nil {
+		t.Fatal(err)
+	}
+	if want := 1; loads != want {
+		t.Errorf("got %d loads after the result was cached, want %d", loads, want)
+	}
+}
@@ -2,79 +2,181 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/format"
 	"go/parser"
 	"go/printer"
 	"go/token"
+	"go/types"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 )
 
 var (
-	filesStr = flag.String("files", "", "pkg@filename entries (space-separated) of pkgs/filenames that define generated server/client types")
+	filesStr = flag.String("files", "", "pkg@path entries (space-separated) of pkgs and the files or dirs that define generated server/client types (if @path is omitted, the pkg's dir is used)")
 	outPkg   = flag.String("pkg", "trace", "output package name")
 	outFile  = flag.String("o", "", "output file (default: stdout)")
+	check    = flag.Bool("check", false, "don't write anything; instead, exit with a non-zero status (and report the differences) if the existing output files (-o, or the -split files) differ from what would be generated")
+	split    = flag.Bool("split", false, "write a separate file for each -files pkg, in the pkg's dir, instead of one combined file (the files are named by -o's base name, default cache.pb.go)")
+
+	// Skipped methods get no wrapper methods, so the Cached* wrapper
+	// types just pass calls through to the embedded client or server
+	// (via the promoted methods), without caching.
+	skipStr = flag.String("skip", "", "Service.Method entries (comma-separated) of methods whose results must never be cached")
+
+	// The client learns the cache-control from the header before the
+	// result arrives. If a server method implementation sends the
+	// header itself (e.g., via grpccache.SetCacheControlHeader), the
+	// wrapper sends the cache-control in the trailer instead. (The
+	// wrappers of server-streaming methods always use the header; see
+	// -stream.)
+	headerStr = flag.String("header", "", "Service.Method entries (comma-separated) of unary methods whose server wrappers send the cache-control in the response header instead of the trailer")
+
+	// Server-streaming methods are passed through by default, because
+	// caching a stream requires receiving all of it before the client
+	// wrapper returns (which never happens for an endless stream). The
+	// cache-control is sent in the stream's header, before the first
+	// result (or in its trailer, if the method sets it later).
+	streamStr = flag.String("stream", "", "Service.Method entries (comma-separated) of server-streaming methods whose (finite) result streams are cached")
+
+	recvName   = flag.String("recv", "s", "receiver name of the generated methods")
+	cacheField = flag.String("cache-field", "Cache", "name of the *grpccache.Cache field of the generated Cached*Client types")
+
+	// The metrics calls do nothing unless the cache's Metrics sink is
+	// set, so they are cheap when metrics are not wanted.
+	metrics = flag.Bool("metrics", false, "report each cache lookup and store of the unary client wrapper methods (labeled by method) to the cache's Metrics sink (grpccache.Cache.Metrics)")
+
+	protobufStr = flag.String("protobuf", "", `protobuf runtime of the -files: "v1" (github.com/golang/protobuf or github.com/gogo/protobuf), "v2" (google.golang.org/protobuf), or empty to detect it from the files' imports`)
 
 	fset = token.NewFileSet()
 )
 
-// genFile is a generated gRPC file and associated metadata. It is
-// parsed using parseFilesStr.
+// genFile is a generated gRPC file (or a dir of them) and associated
+// metadata. It is parsed using parseFilesStr.
 type genFile struct {
 	ImportPath string // Go pkg import path
-	PBGoFile   string // .pb.go filename
+	PBGoFile   string // .pb.go filename, or dir containing .pb.go files
 }
 
-func parseFilesStr(filesStr string) []genFile {
-	if filesStr == "" {
-		log.Fatal("Must specify some -files")
+// parseFilesStr parses the -files flag value, a space-separated list
+// of "importpath@file" entries. If an entry has no "@file", the
+// package's directory is used. It returns an error naming the first
+// malformed entry or nonexistent file.
+func parseFilesStr(filesStr string) ([]genFile, error) {
+	entries := strings.Fields(filesStr)
+	if len(entries) == 0 {
+		return nil, errors.New("must specify some -files")
 	}
 	var files []genFile
-	entries := strings.Fields(filesStr)
 	for _, e := range entries {
 		parts := strings.Split(e, "@")
+		switch {
+		case len(parts) == 1:
+			pkg, err := build.Import(parts[0], ".", build.FindOnly)
+			if err != nil {
+				return nil, fmt.Errorf("-files entry %q: %s", e, err)
+			}
+			parts = append(parts, pkg.Dir)
+		case len(parts) != 2 || parts[0] == "" || parts[1] == "":
+			return nil, fmt.Errorf("-files entry %q is malformed (want importpath@file)", e)
+		}
+		if _, err := os.Stat(parts[1]); err != nil {
+			return nil, fmt.Errorf("-files entry %q: %s", e, err)
+		}
 		files = append(files, genFile{ImportPath: parts[0], PBGoFile: parts[1]})
 	}
-	return files
+	return files, nil
 }
 
 func main() {
 	flag.Parse()
 	log.SetFlags(0)
 
-	genFiles := parseFilesStr(*filesStr)
+	genFiles, err := parseFilesStr(*filesStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *protobufStr != "" && *protobufStr != "v1" && *protobufStr != "v2" {
+		log.Fatalf("invalid -protobuf %q (want v1 or v2)", *protobufStr)
+	}
 
 	var genTypes []genType
 	for _, f := range genFiles {
-		astFile, err := parser.ParseFile(fset, f.PBGoFile, nil, parser.AllErrors)
+		genTypes2, err := loadGenTypes(f)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		genTypes2 := Types(astFile, func(tspec *ast.TypeSpec) bool {
-			_, ok := tspec.Type.(*ast.InterfaceType)
-			return ok && strings.HasSuffix(tspec.Name.Name, "Client")
-		})
 		if len(genTypes2) == 0 {
-			log.Printf("warning: file %s has no matching types", f.PBGoFile)
+			log.Printf("warning: %s has no matching types", f.PBGoFile)
+		}
+		if *protobufStr != "" {
+			for i := range genTypes2 {
+				genTypes2[i].v2 = *protobufStr == "v2"
+			}
 		}
+		genTypes = append(genTypes, genTypes2...)
+	}
+
+	opt := writeOptions{
+		skip:       parseSkipStr(*skipStr),
+		header:     parseSkipStr(*headerStr),
+		stream:     parseSkipStr(*streamStr),
+		recv:       *recvName,
+		cacheField: *cacheField,
+		metrics:    *metrics,
+	}
 
-		for _, t := range genTypes2 {
-			genTypes = append(genTypes, genType{t, astFile.Name.Name, f.ImportPath})
+	if *split {
+		name := "cache.pb.go"
+		if *outFile != "" {
+			name = filepath.Base(*outFile)
+		}
+		srcs, err := writeSplit(genFiles, genTypes, name, opt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *check {
+			checkAndExit(srcs)
 		}
+		for file, src := range srcs {
+			if err := ioutil.WriteFile(file, src, 0666); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
 	}
 
-	src, err := write(genTypes, *outPkg)
+	outDir := "."
+	if *outFile != "" {
+		outDir = filepath.Dir(*outFile)
+	}
+	outImportPath, err := outputImportPath(genFiles, outDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	opt.outPkg, opt.outImportPath = *outPkg, outImportPath
+	src, err := write(genTypes, opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *check {
+		if *outFile == "" {
+			log.Fatal("-check requires -o or -split")
+		}
+		checkAndExit(map[string][]byte{*outFile: src})
+	}
+
 	var w io.Writer
 	if *outFile == "" {
 		w = os.Stdout
@@ -91,6 +193,281 @@ func main() {
 	}
 }
 
+// checkAndExit compares srcs (generated file sources, keyed by
+// filename) to the existing files and exits: with status 1 (after
+// reporting the differences) if any differ, or 0 otherwise.
+func checkAndExit(srcs map[string][]byte) {
+	diffs, err := checkFiles(srcs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, diff := range diffs {
+		log.Print(diff)
+	}
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// checkFiles compares srcs (generated file sources, keyed by
+// filename) to the existing files. It returns a description of each
+// file that is missing or differs, sorted by filename.
+func checkFiles(srcs map[string][]byte) ([]string, error) {
+	files := make([]string, 0, len(srcs))
+	for file := range srcs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var diffs []string
+	for _, file := range files {
+		old, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			diffs = append(diffs, fmt.Sprintf("%s: does not exist", file))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if line, differ := firstDiffLine(old, srcs[file]); differ {
+			diffs = append(diffs, fmt.Sprintf("%s: out of date (first difference at line %d; %d lines, want %d)", file, line, bytes.Count(old, []byte("\n")), bytes.Count(srcs[file], []byte("\n"))))
+		}
+	}
+	return diffs, nil
+}
+
+// firstDiffLine returns the (1-based) number of the first line that
+// differs between a and b, and whether they differ at all.
+func firstDiffLine(a, b []byte) (line int, differ bool) {
+	if bytes.Equal(a, b) {
+		return 0, false
+	}
+	al, bl := bytes.Split(a, []byte("\n")), bytes.Split(b, []byte("\n"))
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		if !bytes.Equal(al[i], bl[i]) {
+			return i + 1, true
+		}
+	}
+	if len(al) < len(bl) {
+		return len(al), true
+	}
+	return len(bl), true
+}
+
+// generatorArgs returns args (the generator's command-line args)
+// without the -check flag, so that the generated code is the same
+// whether or not it is being checked.
+func generatorArgs(args []string) []string {
+	var out []string
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if i := strings.Index(name, "="); i != -1 {
+			name = name[:i]
+		}
+		if strings.HasPrefix(arg, "-") && name == "check" {
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// outputImportPath returns the import path of the package in outDir
+// (where the generated code is written), if it is one of the genFiles'
+// packages. Otherwise it returns "".
+func outputImportPath(genFiles []genFile, outDir string) (string, error) {
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range genFiles {
+		dir, err := f.dir()
+		if err != nil {
+			return "", err
+		}
+		if dir == outDir {
+			return f.ImportPath, nil
+		}
+	}
+	return "", nil
+}
+
+// dir returns the absolute path of the dir of f's package.
+func (f genFile) dir() (string, error) {
+	dir := f.PBGoFile
+	if fi, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// writeSplit generates the Cached* types for genTypes into a separate
+// file for each package (named name, in the package's dir), as if
+// write were called for each package's genTypes. It returns the
+// generated source of each file, keyed by filename. Packages with no
+// genTypes get no file.
+//
+// The outPkg and outImportPath of opt are ignored (each file is in the
+// package whose types it wraps).
+func writeSplit(genFiles []genFile, genTypes []genType, name string, opt writeOptions) (map[string][]byte, error) {
+	byPkg := map[string][]genType{}
+	for _, t := range genTypes {
+		byPkg[t.importPath] = append(byPkg[t.importPath], t)
+	}
+
+	srcs := map[string][]byte{}
+	for _, f := range genFiles {
+		pkgGenTypes := byPkg[f.ImportPath]
+		if len(pkgGenTypes) == 0 {
+			continue
+		}
+		delete(byPkg, f.ImportPath) // only write each package once
+
+		dir, err := f.dir()
+		if err != nil {
+			return nil, err
+		}
+		opt.outPkg, opt.outImportPath = pkgGenTypes[0].pkgName, f.ImportPath
+		src, err := write(pkgGenTypes, opt)
+		if err != nil {
+			return nil, err
+		}
+		srcs[filepath.Join(dir, name)] = src
+	}
+	return srcs, nil
+}
+
+// loadGenTypes parses f (a file or a dir of files) and returns the
+// gRPC client interfaces it defines.
+func loadGenTypes(f genFile) ([]genType, error) {
+	fi, err := os.Stat(f.PBGoFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var node ast.Node
+	var pkgName string
+	var files []*ast.File
+	if fi.IsDir() {
+		notTest := func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }
+		pkgs, err := parser.ParseDir(fset, f.PBGoFile, notTest, parser.AllErrors)
+		if err != nil {
+			return nil, err
+		}
+		if len(pkgs) != 1 {
+			return nil, fmt.Errorf("dir %s contains %d packages, want 1", f.PBGoFile, len(pkgs))
+		}
+		for name, pkg := range pkgs {
+			node, pkgName = pkg, name
+			for _, file := range pkg.Files {
+				files = append(files, file)
+			}
+		}
+	} else {
+		astFile, err := parser.ParseFile(fset, f.PBGoFile, nil, parser.AllErrors)
+		if err != nil {
+			return nil, err
+		}
+		node, pkgName = astFile, astFile.Name.Name
+		files = []*ast.File{astFile}
+	}
+
+	types := Types(node, func(tspec *ast.TypeSpec) bool {
+		ifc, ok := tspec.Type.(*ast.InterfaceType)
+		return ok && strings.HasSuffix(tspec.Name.Name, "Client") && !isStreamInterface(ifc)
+	})
+	v2 := isProtobufV2(files)
+	nonStructs := nonStructTypes(node)
+	streams := streamResultTypes(node)
+	genTypes := make([]genType, len(types))
+	for i, t := range types {
+		genTypes[i] = genType{t, pkgName, f.ImportPath, v2, nonStructs, streams}
+	}
+	return genTypes, nil
+}
+
+// streamResultTypes returns the result types received by the
+// server-streaming client stream interfaces declared in fileOrPkg
+// (e.g., {"Xyz_MethodClient": "*T"} for an interface whose Recv
+// method returns (*T, error)). Bidirectional stream interfaces (which
+// also have a Send method) are not included.
+func streamResultTypes(fileOrPkg ast.Node) map[string]string {
+	streams := map[string]string{}
+	for _, tspec := range Types(fileOrPkg, func(tspec *ast.TypeSpec) bool {
+		ifc, ok := tspec.Type.(*ast.InterfaceType)
+		return ok && strings.HasSuffix(tspec.Name.Name, "Client") && isStreamInterface(ifc)
+	}) {
+		var recvType string
+		var hasSend bool
+		for _, f := range tspec.Type.(*ast.InterfaceType).Methods.List {
+			ft, ok := f.Type.(*ast.FuncType)
+			if !ok || len(f.Names) == 0 {
+				continue
+			}
+			switch f.Names[0].Name {
+			case "Send":
+				hasSend = true
+			case "Recv":
+				if numFields(ft.Params) == 0 && numFields(ft.Results) == 2 {
+					if _, ok := ft.Results.List[0].Type.(*ast.StarExpr); ok {
+						recvType = astString(ft.Results.List[0].Type)
+					}
+				}
+			}
+		}
+		if recvType != "" && !hasSend {
+			streams[tspec.Name.Name] = recvType
+		}
+	}
+	return streams
+}
+
+// nonStructTypes returns the names of the top-level types declared in
+// fileOrPkg that are definitely not structs (e.g., slices or maps).
+// Types defined in terms of other named types are not included,
+// because their underlying type can't be determined from the AST
+// alone.
+func nonStructTypes(fileOrPkg ast.Node) map[string]bool {
+	names := map[string]bool{}
+	for _, tspec := range Types(fileOrPkg, func(tspec *ast.TypeSpec) bool { return !tspec.Assign.IsValid() }) {
+		switch t := tspec.Type.(type) {
+		case *ast.StructType, *ast.SelectorExpr, *ast.ParenExpr:
+		case *ast.Ident:
+			if isPredeclaredType(t.Name) {
+				names[tspec.Name.Name] = true
+			}
+		default:
+			names[tspec.Name.Name] = true
+		}
+	}
+	return names
+}
+
+// isPredeclaredType reports whether name is a predeclared Go type
+// (e.g., "string" or "int").
+func isPredeclaredType(name string) bool {
+	_, ok := types.Universe.Lookup(name).(*types.TypeName)
+	return ok
+}
+
+// isProtobufV2 reports whether files were generated for the
+// google.golang.org/protobuf runtime (by its protoc-gen-go and by
+// protoc-gen-go-grpc). Those generators import the standard library's
+// "context" package, not golang.org/x/net/context.
+func isProtobufV2(files []*ast.File) bool {
+	for _, file := range files {
+		for _, imp := range file.Imports {
+			path := strings.Trim(imp.Path.Value, `"`)
+			if path == "context" || strings.HasPrefix(path, "google.golang.org/protobuf/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Types returns all top-level type declarations in fileOrPkg (an
 // *ast.File or *ast.Package) for which the filter func returns true.
 func Types(fileOrPkg ast.Node, filter func(*ast.TypeSpec) bool) []*ast.TypeSpec {
@@ -128,6 +505,9 @@ type genType struct {
 	*ast.TypeSpec
 	pkgName    string
 	importPath string
+	v2         bool              // generated for google.golang.org/protobuf (see isProtobufV2)
+	nonStructs map[string]bool   // types in the package that are not structs (see nonStructTypes)
+	streams    map[string]string // result types of the package's server-streaming client stream interfaces (see streamResultTypes)
 }
 
 func (x genType) typeName() string {
@@ -146,10 +526,31 @@ func (x genType) serverName() string {
 	return x.name() + "Server"
 }
 
+// local reports whether x is defined in the package that the
+// generated code is written to (whose import path is outImportPath).
+func (x genType) local(outImportPath string) bool {
+	return x.importPath == outImportPath
+}
+
+// qualify returns name (a type in x's package) as referred to from
+// the package whose import path is outImportPath.
+func (x genType) qualify(name, outImportPath string) string {
+	if x.local(outImportPath) {
+		return name
+	}
+	return x.pkgName + "." + name
+}
+
 func (x genType) clientImplName() string {
 	return "Cached" + x.Name.Name
 }
 
+// clientCtorName is the name of the generated constructor of the
+// client implementation type.
+func (x genType) clientCtorName() string {
+	return "New" + x.clientImplName()
+}
+
 func (x genType) serverImplName() string {
 	return "Cached" + x.serverName()
 }
@@ -160,10 +561,18 @@ func (v genTypeList) Len() int           { return len(v) }
 func (v genTypeList) Less(i, j int) bool { return v[i].typeName() < v[j].typeName() }
 func (v genTypeList) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
 
-func (v genTypeList) imports() []string {
+// imports returns the import paths that the generated code (in the
+// package whose import path is outImportPath) uses, grouped as
+// goimports groups them: first the standard library packages, then
+// all others. Each group is sorted, and empty groups are omitted.
+func (v genTypeList) imports(outImportPath string) [][]string {
 	impsMap := map[string]struct{}{}
+	v2 := len(v) > 0
 	for _, ifc := range v {
-		impsMap[ifc.importPath] = struct{}{}
+		if !ifc.local(outImportPath) {
+			impsMap[ifc.importPath] = struct{}{}
+		}
+		v2 = v2 && ifc.v2
 	}
 	imps := make([]string, 0, len(impsMap))
 	for imp := range impsMap {
@@ -172,14 +581,123 @@ func (v genTypeList) imports() []string {
 
 	imps = append(imps, "google.golang.org/grpc")
 	imps = append(imps, "google.golang.org/grpc/metadata")
-	imps = append(imps, "golang.org/x/net/context")
+	if v2 {
+		imps = append(imps, "context")
+	} else {
+		imps = append(imps, "golang.org/x/net/context")
+	}
 	imps = append(imps, "sourcegraph.com/sqs/grpccache")
 
-	sort.Strings(imps)
-	return imps
+	var std, other []string
+	for _, imp := range imps {
+		if isStdlibImport(imp) {
+			std = append(std, imp)
+		} else {
+			other = append(other, imp)
+		}
+	}
+	var groups [][]string
+	for _, group := range [][]string{std, other} {
+		if len(group) > 0 {
+			sort.Strings(group)
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// isStdlibImport reports whether importPath is (probably) a standard
+// library package. Like goimports, it assumes that all other packages'
+// import paths begin with a domain name (containing a ".").
+func isStdlibImport(importPath string) bool {
+	first := importPath
+	if i := strings.Index(importPath, "/"); i != -1 {
+		first = importPath[:i]
+	}
+	return !strings.Contains(first, ".")
+}
+
+// parseSkipStr parses the -skip (or -header) flag value into a set of
+// "Service.Method" names.
+func parseSkipStr(skipStr string) map[string]bool {
+	skip := map[string]bool{}
+	for _, e := range strings.Split(skipStr, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			skip[e] = true
+		}
+	}
+	return skip
+}
+
+// writeOptions configures write.
+type writeOptions struct {
+	outPkg        string          // output package name
+	outImportPath string          // output package import path, or "" if it is not one of the genTypes' packages
+	skip          map[string]bool // "Service.Method" names of methods to skip (see parseSkipStr)
+	header        map[string]bool // "Service.Method" names of methods whose cache-control is sent in the header (see cacheControlSender)
+	stream        map[string]bool // "Service.Method" names of server-streaming methods to cache (see writeStream)
+	recv          string          // receiver name of the generated methods (default "s")
+	cacheField    string          // name of the Cached*Client types' *grpccache.Cache field (default "Cache")
+	metrics       bool            // whether the client wrapper methods report to the cache's Metrics sink
+}
+
+// generatedIdents are the names used by the generated method bodies,
+// which the receiver name must not shadow.
+var generatedIdents = []string{"ctx", "in", "cc", "result", "err", "call", "header", "trailer", "md", "cached", "revalidate", "cachedResult", "staleResult", "grpc", "grpccache", "metadata", "context", "opts", "append", "len", "stream", "m", "cache"}
+
+func (o *writeOptions) setDefaults() error {
+	if o.recv == "" {
+		o.recv = "s"
+	}
+	if o.cacheField == "" {
+		o.cacheField = "Cache"
+	}
+	if !isIdent(o.recv) {
+		return fmt.Errorf("invalid receiver name %q", o.recv)
+	}
+	for _, name := range generatedIdents {
+		if o.recv == name {
+			return fmt.Errorf("receiver name %q conflicts with a name in the generated code", o.recv)
+		}
+	}
+	if !isIdent(o.cacheField) || !ast.IsExported(o.cacheField) {
+		return fmt.Errorf("invalid cache field name %q (must be an exported identifier)", o.cacheField)
+	}
+	return nil
+}
+
+// cacheControlSender returns the name of the grpccache func that the
+// server wrapper for the named "Service.Method" calls to send the
+// cache-control set by the method implementation to the client, and
+// where it is sent (for the wrapper's doc comment). It is sent in the
+// response header for the methods in o.header (so that the client
+// learns it before the result arrives), or in the trailer otherwise.
+func (o *writeOptions) cacheControlSender(method string) (sender, where string) {
+	if o.header[method] {
+		return "Internal_SetCacheControlHeaderOrTrailer", "response header"
+	}
+	return "Internal_SetCacheControlTrailer", "response trailer"
+}
+
+// isIdent reports whether name is a valid Go identifier (other than
+// the blank identifier).
+func isIdent(name string) bool {
+	expr, err := parser.ParseExpr(name)
+	if err != nil {
+		return false
+	}
+	_, ok := expr.(*ast.Ident)
+	return ok && name != "_"
 }
 
-func write(genTypes []genType, outPkg string) ([]byte, error) {
+// write generates the Cached* types for genTypes.
+func write(genTypes []genType, opt writeOptions) ([]byte, error) {
+	if err := opt.setDefaults(); err != nil {
+		return nil, err
+	}
+	outPkg, outImportPath, skip := opt.outPkg, opt.outImportPath, opt.skip
+	recv, cache := opt.recv, "cache" // cache is the client methods' var holding the call's cache
+
 	// Sort for determinism.
 	sort.Sort(genTypeList(genTypes))
 
@@ -189,7 +707,7 @@ func write(genTypes []genType, outPkg string) ([]byte, error) {
 	fmt.Fprintln(&w, "//")
 	fmt.Fprintln(&w, "// Generated by:")
 	fmt.Fprintln(&w, "//")
-	fmt.Fprintf(&w, "//   go run gen_trace.go %s\n", strings.Join(os.Args[1:], " "))
+	fmt.Fprintf(&w, "//   go run gen_trace.go %s\n", strings.Join(generatorArgs(os.Args[1:]), " "))
 	fmt.Fprintln(&w, "//")
 	fmt.Fprintln(&w, "// Called via:")
 	fmt.Fprintln(&w, "//")
@@ -199,12 +717,13 @@ func write(genTypes []genType, outPkg string) ([]byte, error) {
 	fmt.Fprint(&w, "package ", outPkg, "\n")
 	fmt.Fprintln(&w)
 	fmt.Fprintln(&w, "import (")
-	for _, imp := range genTypeList(genTypes).imports() {
-		if imp == "sourcegraph.com/sqs/grpccache/testpb" {
-			// HACK(sqs): skip self; hardcoded currently
-			continue
+	for i, group := range genTypeList(genTypes).imports(outImportPath) {
+		if i > 0 {
+			fmt.Fprintln(&w)
+		}
+		for _, imp := range group {
+			fmt.Fprint(&w, "\t", `"`+imp+`"`, "\n")
 		}
-		fmt.Fprint(&w, "\t", `"`+imp+`"`, "\n")
 	}
 	fmt.Fprintln(&w, ")")
 	fmt.Fprintln(&w)
@@ -216,40 +735,78 @@ func write(genTypes []genType, outPkg string) ([]byte, error) {
 			// Server
 			fmt.Fprintf(&w, "type %s struct { %s }\n", genType.serverImplName(), genType.serverName())
 			fmt.Fprintln(&w)
+			fmt.Fprintf(&w, "var _ %s = (*%s)(nil)\n", genType.qualify(genType.serverName(), outImportPath), genType.serverImplName())
+			fmt.Fprintln(&w)
 
 			// Methods
 			for _, methField := range genType.Type.(*ast.InterfaceType).Methods.List {
 				if meth, ok := methField.Type.(*ast.FuncType); ok {
+					if skip[genType.name()+"."+methField.Names[0].Name] {
+						log.Printf("skipping method %s.%s (-skip)", genType.name(), methField.Names[0].Name)
+						continue
+					}
+					if key := genType.name() + "." + methField.Names[0].Name; opt.stream[key] {
+						sm, err := genType.streamMethod(methField.Names[0].Name, meth, outImportPath)
+						if err != nil {
+							log.Printf("warning: skipping method %s (-stream): %s", key, err)
+							continue
+						}
+						writeStreamServer(&w, genType, sm, opt)
+						continue
+					}
+					if err := checkUnary(meth); err != nil {
+						log.Printf("warning: skipping method %s.%s (only unary methods are cached): %s", genType.name(), methField.Names[0].Name, err)
+						continue
+					}
+					if err := genType.checkRequestType(meth); err != nil {
+						log.Printf("warning: skipping method %s.%s (only methods whose request is a message are cached): %s", genType.name(), methField.Names[0].Name, err)
+						continue
+					}
 					synthesizeFieldNamesIfMissing(meth.Params)
-					if genType.pkgName != outPkg {
-						// TODO(sqs): check for import paths or dirs unequal, not pkg name
+					if !genType.local(outImportPath) {
 						qualifyPkgRefs(meth, genType.pkgName)
 					}
+					resType, err := resultType(meth)
+					if err != nil {
+						return nil, err
+					}
 
-					// remove client-only "opts
-					// ... grpc.CallOption". Copy it to avoid
+					// Remove the client-only "opts
+					// ...grpc.CallOption". Copy it to avoid
 					// conflicting with the client codegen below.
 					tmp := *meth
 					meth = &tmp
-					tmp2 := *meth.Params
-					meth.Params = &tmp2
-					meth.Params.List = meth.Params.List[:2]
+					meth.Params = withoutCallOptions(meth.Params)
 
+					var args []string
+					for _, arg := range fieldListToIdentList(meth.Params) {
+						args = append(args, astString(arg))
+					}
+
+					sender, where := opt.cacheControlSender(genType.name() + "." + methField.Names[0].Name)
 					body := astParse(`
 ctx, cc := grpccache.Internal_WithCacheControl(ctx)
-result, err := s.` + genType.serverName() + `.` + methField.Names[0].Name + `(ctx, in)
+result, err := ` + recv + `.` + genType.serverName() + `.` + methField.Names[0].Name + `(` + strings.Join(args, ", ") + `)
+if err == grpccache.ErrNotModified {
+	grpccache.Internal_SetNotModified(cc)
+	result, err = new(` + resType + `), nil
+}
 if !cc.IsZero() {
-	if err := grpccache.Internal_SetCacheControlTrailer(ctx, *cc); err != nil {
+	if err := grpccache.` + sender + `(ctx, *cc); err != nil {
 		return nil, err
 	}
 }
 return result, err
 `)
 
+					name := methField.Names[0].Name
 					decl := &ast.FuncDecl{
+						Doc: docComment(
+							fmt.Sprintf("%s wraps %s.%s, sending the cache-control set by the method (via grpccache.SetCacheControl) to the client in the %s.", name, genType.serverName(), name, where),
+						),
 						Recv: &ast.FieldList{List: []*ast.Field{
 							{
-								Names: []*ast.Ident{ast.NewIdent("s")},
+								Names: []*ast.Ident{ast.NewIdent(recv)},
 								Type:  &ast.StarExpr{X: ast.NewIdent(genType.serverImplName())},
 							},
 						}},
@@ -265,49 +822,128 @@ return result, err
 
 		{
 			// Client
-			fmt.Fprintf(&w, "type %s struct { %s; Cache *grpccache.Cache }\n", genType.clientImplName(), genType.Name.Name)
+			doc := docComment(
+				fmt.Sprintf("%s wraps %s with client-side caching via grpccache. Calls use %s, or the cache set by grpccache.WithCache in the call's context (if any). If the cache is nil, calls are passed through to %s unchanged (with no caching overhead), so a %s with a nil %s behaves exactly like the underlying client.", genType.clientImplName(), genType.Name.Name, opt.cacheField, genType.Name.Name, genType.clientImplName(), opt.cacheField),
+			)
+			for _, c := range doc.List {
+				fmt.Fprintln(&w, c.Text)
+			}
+			fmt.Fprintf(&w, "type %s struct { %s; %s *grpccache.Cache }\n", genType.clientImplName(), genType.Name.Name, opt.cacheField)
+			fmt.Fprintln(&w)
+			fmt.Fprintf(&w, "var _ %s = (*%s)(nil)\n", genType.qualify(genType.clientName(), outImportPath), genType.clientImplName())
+			fmt.Fprintln(&w)
+
+			// Constructor
+			ctorType, err := parser.ParseExprFrom(fset, "ctor.go", "func(cc *grpc.ClientConn, cache *grpccache.Cache) *"+genType.clientImplName(), 0)
+			if err != nil {
+				return nil, err
+			}
+			ctorType.(*ast.FuncType).Func = token.NoPos // so the doc comment precedes "func"
+			ctor := &ast.FuncDecl{
+				Doc: docComment(
+					fmt.Sprintf("%s returns a %s that makes calls on cc and caches their results in cache.", genType.clientCtorName(), genType.clientImplName()),
+				),
+				Name: ast.NewIdent(genType.clientCtorName()),
+				Type: ctorType.(*ast.FuncType),
+				Body: &ast.BlockStmt{List: astParse(`
+return &` + genType.clientImplName() + `{` + genType.Name.Name + `: ` + genType.qualify("New"+genType.clientName(), outImportPath) + `(cc), ` + opt.cacheField + `: cache}
+`)},
+			}
+			fmt.Fprintln(&w, astString(ctor))
 			fmt.Fprintln(&w)
 
 			// Methods
 			for _, methField := range genType.Type.(*ast.InterfaceType).Methods.List {
 				if meth, ok := methField.Type.(*ast.FuncType); ok {
+					if key := genType.name() + "." + methField.Names[0].Name; opt.stream[key] && !skip[key] {
+						if sm, err := genType.streamMethod(methField.Names[0].Name, meth, outImportPath); err == nil {
+							writeStreamClient(&w, genType, sm, opt)
+						}
+						continue // errors already logged above
+					}
+					if skip[genType.name()+"."+methField.Names[0].Name] || checkUnary(meth) != nil || genType.checkRequestType(meth) != nil {
+						continue // already logged above
+					}
+					if len(meth.Params.List) != 3 || !isCallOptions(meth.Params.List[2]) {
+						log.Printf("warning: not caching client method %s.%s: want params (ctx, in, opts ...grpc.CallOption)", genType.name(), methField.Names[0].Name)
+						continue
+					}
 					synthesizeFieldNamesIfMissing(meth.Params)
-					if genType.pkgName != outPkg {
-						// TODO(sqs): check for import paths or dirs unequal, not pkg name
+					if !genType.local(outImportPath) {
 						qualifyPkgRefs(meth, genType.pkgName)
 					}
+					resType, err := resultType(meth)
+					if err != nil {
+						return nil, err
+					}
 
 					key := genType.name() + "." + methField.Names[0].Name
+					opts := meth.Params.List[2].Names[0].Name // the caller's call options, passed through to the call
+					var observeGet, observeStore string
+					if opt.metrics {
+						observeGet = `grpccache.Internal_ObserveGet(` + cache + `, "` + key + `", cached)` + "\n"
+						observeStore = `grpccache.Internal_ObserveStore(` + cache + `, "` + key + `")` + "\n"
+					}
 					body := astParse(`
-if s.Cache != nil {
-	var cachedResult ` + resultType(meth) + `
-	cached, err := s.Cache.Get(ctx, "` + key + `", in, &cachedResult)
+` + cache + ` := grpccache.Internal_CacheFromContext(ctx, ` + recv + `.` + opt.cacheField + `)
+if ` + cache + ` == nil {
+	return ` + recv + `.` + genType.Name.Name + `.` + methField.Names[0].Name + `(ctx, in, ` + opts + `...)
+}
+
+call := func(ctx context.Context) (interface{}, error) {
+	var header, trailer metadata.MD
+
+	result, err := ` + recv + `.` + genType.Name.Name + `.` + methField.Names[0].Name + `(ctx, in, append(` + opts + `[:len(` + opts + `):len(` + opts + `)], grpc.Header(&header), grpc.Trailer(&trailer))...)
+	md := grpccache.Internal_CacheControlMetadata(header, trailer)
 	if err != nil {
-		return nil, err
-	}
-	if cached {
-		return &cachedResult, nil
+		if err := ` + cache + `.StoreError(ctx, "` + key + `", in, err, md); err != nil {
+			return nil, err
+		}
+		` + observeStore + `return nil, err
 	}
+	if result != nil {
+		if err := ` + cache + `.Store(ctx, "` + key + `", in, result, md); err != nil {
+			return nil, err
+		}
+	` + observeStore + `}
+	return result, nil
 }
 
-var trailer metadata.MD
-
-result, err := s.` + genType.Name.Name + `.` + methField.Names[0].Name + `(ctx, in, grpc.Trailer(&trailer))
+var cachedResult ` + resType + `
+cached, revalidate, err := ` + cache + `.GetStale(ctx, "` + key + `", in, &cachedResult)
+` + observeGet + `if revalidate {
+	` + cache + `.Revalidate(ctx, "` + key + `", in, call)
+}
 if err != nil {
 	return nil, err
 }
-if s.Cache != nil {
-	if err := s.Cache.Store(ctx, "` + key + `", in, result, trailer); err != nil {
-		return nil, err
+if cached {
+	return &cachedResult, nil
+}
+
+ctx = grpccache.Internal_WithCachedETag(ctx, ` + cache + `, "` + key + `", in)
+result, err := ` + cache + `.Do(ctx, "` + key + `", in, func() (interface{}, error) { return call(ctx) })
+if err != nil {
+	var staleResult ` + resType + `
+	if cached, err := ` + cache + `.GetIfError(ctx, "` + key + `", in, &staleResult, err); cached {
+		if err != nil {
+			return nil, err
+		}
+		return &staleResult, nil
 	}
+	return nil, err
 }
-return result, nil
+return result.(*` + resType + `), nil
 `)
 
+					name := methField.Names[0].Name
 					decl := &ast.FuncDecl{
+						Doc: docComment(
+							fmt.Sprintf("%s wraps %s.%s with client-side caching via grpccache.", name, genType.Name.Name, name),
+						),
 						Recv: &ast.FieldList{List: []*ast.Field{
 							{
-								Names: []*ast.Ident{ast.NewIdent("s")},
+								Names: []*ast.Ident{ast.NewIdent(recv)},
 								Type:  &ast.StarExpr{X: ast.NewIdent(genType.clientImplName())},
 							},
 						}},
@@ -324,6 +960,174 @@ return result, nil
 	return format.Source(w.Bytes())
 }
 
+// streamMethod is a server-streaming method whose result stream is
+// cached (see the -stream flag). Its types are qualified as referred
+// to from the output package.
+type streamMethod struct {
+	name         string // method name
+	inType       string // request type (e.g., "*T")
+	clientStream string // client stream interface (e.g., "Xyz_MethodClient")
+	serverStream string // server stream interface (e.g., "Xyz_MethodServer")
+	recvType     string // result type received from the stream (e.g., "*T")
+}
+
+// streamMethod returns the named server-streaming method of x (whose
+// client method is ft). It returns an error if ft is not a
+// server-streaming method (e.g., if it is unary or bidirectional).
+func (x genType) streamMethod(name string, ft *ast.FuncType, outImportPath string) (*streamMethod, error) {
+	if len(ft.Params.List) != 3 || !isCallOptions(ft.Params.List[2]) {
+		return nil, errors.New("want params (ctx, in, opts ...grpc.CallOption)")
+	}
+	if _, ok := ft.Params.List[1].Type.(*ast.StarExpr); !ok {
+		return nil, fmt.Errorf("request parameter type %s is not a pointer type", astString(ft.Params.List[1].Type))
+	}
+	if n := numFields(ft.Results); n != 2 || astString(ft.Results.List[len(ft.Results.List)-1].Type) != "error" {
+		return nil, fmt.Errorf("returns %d values, want (stream, error)", n)
+	}
+	var streamName string
+	switch t := ft.Results.List[0].Type.(type) {
+	case *ast.Ident:
+		streamName = t.Name
+	case *ast.SelectorExpr:
+		// Refs to x's package are qualified if the output is another
+		// package (see qualifyPkgRefs).
+		if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == x.pkgName {
+			streamName = t.Sel.Name
+		}
+	}
+	recvType, ok := x.streams[streamName]
+	if !ok {
+		return nil, fmt.Errorf("result type %s is not a server-streaming client stream interface", astString(ft.Results.List[0].Type))
+	}
+
+	// Qualify copies of the types (so ft is not modified).
+	typesFunc, err := parser.ParseExpr("func(" + astString(ft.Params.List[1].Type) + ") (" + recvType + ")")
+	if err != nil {
+		return nil, err
+	}
+	types := typesFunc.(*ast.FuncType)
+	if !x.local(outImportPath) {
+		qualifyPkgRefs(types, x.pkgName)
+	}
+	return &streamMethod{
+		name:         name,
+		inType:       astString(types.Params.List[0].Type),
+		clientStream: x.qualify(streamName, outImportPath),
+		serverStream: x.qualify(strings.TrimSuffix(streamName, "Client")+"Server", outImportPath),
+		recvType:     astString(types.Results.List[0].Type),
+	}, nil
+}
+
+// streamWrapperName returns the name of the generated type that wraps
+// the stream interface whose (possibly qualified) name is stream.
+func streamWrapperName(stream string) string {
+	if i := strings.LastIndex(stream, "."); i != -1 {
+		stream = stream[i+1:]
+	}
+	return "cached" + stream
+}
+
+// writeStreamServer writes the CachedXyzServer wrapper method for the
+// server-streaming method sm, which sends the cache-control set by
+// the method implementation in the stream's header, before the first
+// result (so that the client knows how to cache the stream as soon as
+// it starts).
+func writeStreamServer(w io.Writer, x genType, sm *streamMethod, opt writeOptions) {
+	recv, wrapper := opt.recv, streamWrapperName(sm.serverStream)
+	embedded := sm.serverStream[strings.LastIndex(sm.serverStream, ".")+1:]
+	for _, c := range docComment(fmt.Sprintf("%s wraps %s.%s, sending the cache-control set by the method (via grpccache.SetCacheControl before it sends its first result) to the client in the stream's header.", sm.name, x.serverName(), sm.name)).List {
+		fmt.Fprintln(w, c.Text)
+	}
+	fmt.Fprintf(w, `func (%s *%s) %s(in %s, stream %s) error {
+	ctx, cc := grpccache.Internal_WithCacheControl(stream.Context())
+	m := &%s{%s: stream, ctx: ctx, cc: cc}
+	err := %s.%s.%s(in, m)
+	if err := m.sendCacheControl(); err != nil {
+		return err
+	}
+	return err
+}
+
+`, recv, x.serverImplName(), sm.name, sm.inType, sm.serverStream, wrapper, embedded, recv, x.serverName(), sm.name)
+	for _, c := range docComment(fmt.Sprintf("%s is a %s whose context holds the cache-control set by the method, which it sends before the first result.", wrapper, sm.serverStream)).List {
+		fmt.Fprintln(w, c.Text)
+	}
+	fmt.Fprintf(w, `type %s struct {
+	%s
+	ctx  context.Context
+	cc   *grpccache.CacheControl
+	sent bool // whether the cache-control was sent
+}
+
+func (%s *%s) Context() context.Context { return %s.ctx }
+
+func (%s *%s) Send(m %s) error {
+	if err := %s.sendCacheControl(); err != nil {
+		return err
+	}
+	return %s.%s.Send(m)
+}
+
+`, wrapper, sm.serverStream, recv, wrapper, recv, recv, wrapper, sm.recvType, recv, recv, embedded)
+	for _, c := range docComment("sendCacheControl sends the cache-control set by the method (if any, and if it was not already sent) in the stream's header, or in its trailer if the header was already sent (e.g., because the method set the cache-control after sending a result).").List {
+		fmt.Fprintln(w, c.Text)
+	}
+	fmt.Fprintf(w, `func (%s *%s) sendCacheControl() error {
+	if %s.sent || %s.cc.IsZero() {
+		return nil
+	}
+	%s.sent = true
+	return grpccache.Internal_SetCacheControlHeaderOrTrailer(%s.ctx, *%s.cc)
+}
+
+`, recv, wrapper, recv, recv, recv, recv, recv)
+}
+
+// writeStreamClient writes the CachedXyzClient wrapper method for the
+// server-streaming method sm, which caches all of the stream's results
+// (see grpccache.Cache.GetOrCallStream).
+func writeStreamClient(w io.Writer, x genType, sm *streamMethod, opt writeOptions) {
+	recv, wrapper := opt.recv, streamWrapperName(sm.clientStream)
+	key := x.name() + "." + sm.name
+	for _, c := range docComment(fmt.Sprintf("%s wraps %s.%s with client-side caching via grpccache. All of the stream's results are received (and cached) before %s returns.", sm.name, x.Name.Name, sm.name, sm.name)).List {
+		fmt.Fprintln(w, c.Text)
+	}
+	fmt.Fprintf(w, `func (%s *%s) %s(ctx context.Context, in %s, opts ...grpc.CallOption) (%s, error) {
+	cache := grpccache.Internal_CacheFromContext(ctx, %s.%s)
+	if cache == nil {
+		return %s.%s.%s(ctx, in, opts...)
+	}
+	stream, err := cache.GetOrCallStream(ctx, %q, in, new(%s), func(ctx context.Context) (grpc.ClientStream, error) {
+		return %s.%s.%s(ctx, in, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return %s{stream}, nil
+}
+
+`, recv, x.clientImplName(), sm.name, sm.inType, sm.clientStream,
+		recv, opt.cacheField,
+		recv, x.Name.Name, sm.name,
+		key, strings.TrimPrefix(sm.recvType, "*"),
+		recv, x.Name.Name, sm.name,
+		wrapper)
+	for _, c := range docComment(fmt.Sprintf("%s is a %s that receives the results replayed by grpccache.Cache.GetOrCallStream.", wrapper, sm.clientStream)).List {
+		fmt.Fprintln(w, c.Text)
+	}
+	fmt.Fprintf(w, `type %s struct{ grpc.ClientStream }
+
+func (%s %s) Recv() (%s, error) {
+	m := new(%s)
+	if err := %s.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+`, wrapper, recv, wrapper, sm.recvType, strings.TrimPrefix(sm.recvType, "*"), recv)
+}
+
 // qualifyPkgRefs qualifies all refs to non-package-qualified non-builtin types in f so that they refer to definitions in pkg. E.g., 'func(x MyType) -> func (x pkg.MyType)'.
 func qualifyPkgRefs(f *ast.FuncType, pkg string) {
 	var qualify func(x ast.Expr) ast.Expr
@@ -380,8 +1184,114 @@ func fieldListToIdentList(fl *ast.FieldList) []ast.Expr {
 	return fs
 }
 
-func resultType(ft *ast.FuncType) string {
-	return astString(ft.Results.List[0].Type.(*ast.StarExpr).X)
+// checkUnary returns an error if ft, a method of a generated gRPC
+// client interface, is not a unary method that returns (*Msg, error).
+// Streaming methods return a stream interface (not a *Msg), and
+// client-streaming methods take no request message. Methods with
+// other results (e.g., extra return values) can't be wrapped, because
+// only the *Msg result is cached.
+func checkUnary(ft *ast.FuncType) error {
+	if len(ft.Params.List) < 2 {
+		return errors.New("no request message parameter (client-streaming method?)")
+	}
+	if _, ok := ft.Params.List[1].Type.(*ast.StarExpr); !ok {
+		return fmt.Errorf("request parameter type %s is not a pointer type", astString(ft.Params.List[1].Type))
+	}
+	if n := numFields(ft.Results); n != 2 || astString(ft.Results.List[len(ft.Results.List)-1].Type) != "error" {
+		return fmt.Errorf("returns %d values, want (result, error)", n)
+	}
+	_, err := resultType(ft)
+	return err
+}
+
+// numFields returns the number of values (params or results) in fl,
+// counting each name of a field like "a, b T" separately.
+func numFields(fl *ast.FieldList) int {
+	if fl == nil {
+		return 0
+	}
+	var n int
+	for _, f := range fl.List {
+		if len(f.Names) == 0 {
+			n++
+		} else {
+			n += len(f.Names)
+		}
+	}
+	return n
+}
+
+// checkRequestType returns an error if the request parameter type of
+// ft (a unary method of x, per checkUnary) is not a pointer to a
+// struct type. The request is marshaled as a proto.Message to compute
+// the cache key, so it must be a message (which is a struct). This is
+// a best-effort check: a pointer to a named type that isn't known to
+// be a non-struct is accepted.
+func (x genType) checkRequestType(ft *ast.FuncType) error {
+	typ := ft.Params.List[1].Type.(*ast.StarExpr).X
+	var name string
+	switch t := typ.(type) {
+	case *ast.Ident:
+		if isPredeclaredType(t.Name) {
+			return fmt.Errorf("request parameter type *%s is not a pointer to a struct type", t.Name)
+		}
+		name = t.Name
+	case *ast.SelectorExpr:
+		// Refs to x's package are qualified if the output is another
+		// package (see qualifyPkgRefs).
+		if pkg, ok := t.X.(*ast.Ident); ok && pkg.Name == x.pkgName {
+			name = t.Sel.Name
+		}
+	default:
+		return fmt.Errorf("request parameter type *%s is not a pointer to a named type", astString(typ))
+	}
+	if x.nonStructs[name] {
+		return fmt.Errorf("request parameter type *%s is not a pointer to a struct type", astString(typ))
+	}
+	return nil
+}
+
+// isCallOptions reports whether f is a variadic ...grpc.CallOption
+// param (which client methods have but server methods do not).
+func isCallOptions(f *ast.Field) bool {
+	ell, ok := f.Type.(*ast.Ellipsis)
+	return ok && astString(ell.Elt) == "grpc.CallOption"
+}
+
+// withoutCallOptions returns a copy of fl (a client method's params)
+// without its trailing ...grpc.CallOption param, if any.
+func withoutCallOptions(fl *ast.FieldList) *ast.FieldList {
+	tmp := *fl
+	if n := len(tmp.List); n > 0 && isCallOptions(tmp.List[n-1]) {
+		tmp.List = tmp.List[:n-1]
+	}
+	return &tmp
+}
+
+// isStreamInterface reports whether ifc is a generated gRPC client
+// stream interface (e.g., Xyz_MethodClient), which embeds
+// grpc.ClientStream.
+func isStreamInterface(ifc *ast.InterfaceType) bool {
+	for _, f := range ifc.Methods.List {
+		if len(f.Names) == 0 && astString(f.Type) == "grpc.ClientStream" {
+			return true
+		}
+	}
+	return false
+}
+
+// resultType returns the result message type of ft (e.g., "T" if ft
+// returns (*T, error)). It returns an error if the first result is not
+// a pointer type (e.g., if it is a stream interface).
+func resultType(ft *ast.FuncType) (string, error) {
+	if ft.Results == nil || len(ft.Results.List) == 0 {
+		return "", errors.New("no results")
+	}
+	star, ok := ft.Results.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return "", fmt.Errorf("result type %s is not a pointer type (streaming method?)", astString(ft.Results.List[0].Type))
+	}
+	return astString(star.X), nil
 }
 
 func hasEllipsis(fl *ast.FieldList) bool {
@@ -399,6 +1309,27 @@ func ellipsisIfNeeded(fl *ast.FieldList) token.Pos {
 	return 0
 }
 
+// docComment returns a doc comment consisting of text, wrapped at
+// about 70 columns.
+func docComment(text string) *ast.CommentGroup {
+	var cg ast.CommentGroup
+	var line string
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > 70 {
+			cg.List = append(cg.List, &ast.Comment{Text: "// " + line})
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		cg.List = append(cg.List, &ast.Comment{Text: "// " + line})
+	}
+	return &cg
+}
+
 func astString(x ast.Node) string {
 	var buf bytes.Buffer
 	if err := printer.Fprint(&buf, fset, x); err != nil {
@@ -0,0 +1,889 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testSrc = `package foopb
+
+type FooClient interface {
+	Unary(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	Stream(ctx context.Context, in *Op, opts ...grpc.CallOption) (Foo_StreamClient, error)
+	Value(ctx context.Context, in *Op, opts ...grpc.CallOption) (Result, error)
+}
+
+type Foo_StreamClient interface {
+	Recv() (*Result, error)
+	grpc.ClientStream
+}
+`
+
+func TestWrite_nonPointerResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpccache-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "foo.pb.go")
+	if err := ioutil.WriteFile(file, []byte(testSrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	genTypes, err := loadGenTypes(genFile{ImportPath: "example.com/foopb", PBGoFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(genTypes) != 1 {
+		t.Fatalf("got %d types, want 1 (FooClient)", len(genTypes))
+	}
+
+	src, err := write(genTypes, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(src)
+	if !strings.Contains(out, "func (s *CachedFooClient) Unary(") {
+		t.Errorf("output has no Unary wrapper:\n%s", out)
+	}
+	for _, meth := range []string{"Stream", "Value"} {
+		if strings.Contains(out, ") "+meth+"(") {
+			t.Errorf("output has a %s wrapper, want it to be skipped:\n%s", meth, out)
+		}
+	}
+}
+
+func TestResultType(t *testing.T) {
+	tests := map[string]struct {
+		want    string
+		wantErr bool
+	}{
+		"func() (*T, error)":            {want: "T"},
+		"func() (*pkg.T, error)":        {want: "pkg.T"},
+		"func() (Foo_BarClient, error)": {wantErr: true},
+		"func()":                        {wantErr: true},
+	}
+	for src, test := range tests {
+		x, err := parser.ParseExpr(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := resultType(x.(*ast.FuncType))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", src, err, test.wantErr)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", src, got, test.want)
+		}
+	}
+}
+
+func TestWrite_serverParams(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	NoOpts(ctx context.Context, in *Op) (*Result, error)
+	Extra(ctx context.Context, in *Op, n int, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"func (s *CachedFooServer) NoOpts(ctx context.Context, in *Op) (*Result, error) {",
+		"result, err := s.FooServer.NoOpts(ctx, in)",
+		"func (s *CachedFooServer) Extra(ctx context.Context, in *Op, n int) (*Result, error) {",
+		"result, err := s.FooServer.Extra(ctx, in, n)",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	// Client methods that don't have exactly (ctx, in, opts) are not
+	// cached.
+	if strings.Contains(string(out), "func (s *CachedFooClient)") {
+		t.Errorf("output has client method wrappers, want none:\n%s", out)
+	}
+}
+
+func TestLoadGenTypes_dir(t *testing.T) {
+	genTypes, err := loadGenTypes(genFile{ImportPath: "example.com/multipb", PBGoFile: "testdata/multi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, t := range genTypes {
+		names = append(names, t.pkgName+"."+t.Name.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"multipb.BarClient", "multipb.FooClient"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got types %v, want %v", names, want)
+	}
+}
+
+func TestParseFilesStr(t *testing.T) {
+	files, err := parseFilesStr("example.com/multipb@testdata/multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []genFile{{ImportPath: "example.com/multipb", PBGoFile: "testdata/multi"}}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %+v, want %+v", files, want)
+	}
+
+	if _, err := parseFilesStr(" "); err == nil {
+		t.Error("got no error for empty -files, want an error")
+	}
+
+	tests := map[string]string{
+		"example.com/nonexistentpb":            `"example.com/nonexistentpb"`,
+		"example.com/foopb@":                   `"example.com/foopb@" is malformed`,
+		"@testdata/multi":                      `"@testdata/multi" is malformed`,
+		"example.com/foopb@a@b":                `"example.com/foopb@a@b" is malformed`,
+		"example.com/foopb@testdata/nofile.go": `"example.com/foopb@testdata/nofile.go"`,
+	}
+	for entry, wantErr := range tests {
+		// Include a valid entry to check that the bad entry is named.
+		_, err := parseFilesStr("example.com/multipb@testdata/multi " + entry)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%q: got error %v, want it to contain %q", entry, err, wantErr)
+		}
+	}
+}
+
+func TestWrite_skip(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	Delete(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb", skip: parseSkipStr("Foo.Delete, Bar.Other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []string{"CachedFooServer", "CachedFooClient"} {
+		if want := "func (s *" + typ + ") Get("; !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+		if notWant := "func (s *" + typ + ") Delete("; strings.Contains(string(out), notWant) {
+			t.Errorf("output contains %q, want the method to be skipped:\n%s", notWant, out)
+		}
+	}
+}
+
+func TestWrite_multipleResults(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	GetMeta(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, *Meta, error)
+	GetNamed(ctx context.Context, in *Op, opts ...grpc.CallOption) (result, meta *Result, err error)
+	GetNoError(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, *Meta)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []string{"CachedFooServer", "CachedFooClient"} {
+		if want := "func (s *" + typ + ") Get("; !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+		for _, meth := range []string{"GetMeta", "GetNamed", "GetNoError"} {
+			if notWant := "func (s *" + typ + ") " + meth + "("; strings.Contains(string(out), notWant) {
+				t.Errorf("output contains %q, want the method to be skipped:\n%s", notWant, out)
+			}
+		}
+	}
+}
+
+func TestWrite_nonMessageRequest(t *testing.T) {
+	const src = `package foopb
+
+type Op struct{ A int32 }
+
+type OpList []*Op
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	GetString(ctx context.Context, in *string, opts ...grpc.CallOption) (*Result, error)
+	GetList(ctx context.Context, in *OpList, opts ...grpc.CallOption) (*Result, error)
+	GetMap(ctx context.Context, in *map[string]int32, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(tspec *ast.TypeSpec) bool { return tspec.Name.Name == "FooClient" })[0]
+	nonStructs := nonStructTypes(astFile)
+
+	for _, opt := range []writeOptions{
+		{outPkg: "foopb", outImportPath: "example.com/foopb"},
+		{outPkg: "otherpb"}, // request types are qualified
+	} {
+		out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nonStructs, nil}}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, typ := range []string{"CachedFooServer", "CachedFooClient"} {
+			if want := "func (s *" + typ + ") Get("; !strings.Contains(string(out), want) {
+				t.Errorf("%s: output does not contain %q:\n%s", opt.outPkg, want, out)
+			}
+			for _, meth := range []string{"GetString", "GetList", "GetMap"} {
+				if notWant := "func (s *" + typ + ") " + meth + "("; strings.Contains(string(out), notWant) {
+					t.Errorf("%s: output contains %q, want the method to be skipped:\n%s", opt.outPkg, notWant, out)
+				}
+			}
+		}
+	}
+}
+
+func TestWrite_interfaceAssertions(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+
+	tests := map[string][]string{
+		"example.com/foopb": {
+			"var _ FooServer = (*CachedFooServer)(nil)",
+			"var _ FooClient = (*CachedFooClient)(nil)",
+		},
+		"example.com/otherpb": {
+			"var _ foopb.FooServer = (*CachedFooServer)(nil)",
+			"var _ foopb.FooClient = (*CachedFooClient)(nil)",
+		},
+	}
+	for outImportPath, wants := range tests {
+		out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: path.Base(outImportPath), outImportPath: outImportPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range wants {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("%s: output does not contain %q:\n%s", outImportPath, want, out)
+			}
+		}
+	}
+}
+
+func TestWrite_protobufV2(t *testing.T) {
+	genTypes, err := loadGenTypes(genFile{ImportPath: "sourcegraph.com/sqs/grpccache/testpb/v2pb", PBGoFile: "../testpb/v2pb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(genTypes) != 1 || !genTypes[0].v2 {
+		t.Fatalf("got genTypes %+v, want 1 detected as protobuf v2", genTypes)
+	}
+
+	tests := map[bool]string{
+		true:  `"context"`,
+		false: `"golang.org/x/net/context"`,
+	}
+	for v2, wantImport := range tests {
+		genTypes[0].v2 = v2
+		out, err := write(genTypes, writeOptions{outPkg: "v2pb", outImportPath: "sourcegraph.com/sqs/grpccache/testpb/v2pb"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), wantImport) {
+			t.Errorf("v2=%v: output does not import %s:\n%s", v2, wantImport, out)
+		}
+		if strings.Contains(string(out), `"sourcegraph.com/sqs/grpccache/testpb/v2pb"`) {
+			t.Errorf("v2=%v: output imports its own package:\n%s", v2, out)
+		}
+	}
+}
+
+func TestWrite_samePackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpccache-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "foo.pb.go")
+	if err := ioutil.WriteFile(file, []byte(testSrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	genFiles := []genFile{{ImportPath: "example.com/foopb", PBGoFile: file}}
+	outImportPath, err := outputImportPath(genFiles, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com/foopb"; outImportPath != want {
+		t.Fatalf("got output import path %q, want %q", outImportPath, want)
+	}
+	genTypes, err := loadGenTypes(genFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := write(genTypes, writeOptions{outPkg: "foopb", outImportPath: outImportPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(src)
+	if strings.Contains(out, `"example.com/foopb"`) {
+		t.Errorf("output imports its own package:\n%s", out)
+	}
+	if want := "func (s *CachedFooClient) Unary(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)"; !strings.Contains(out, want) {
+		t.Errorf("output does not contain %q:\n%s", want, out)
+	}
+
+	// Generating into another package imports the source package.
+	src, err = write(genTypes, writeOptions{outPkg: "otherpb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := string(src); !strings.Contains(out, `"example.com/foopb"`) || !strings.Contains(out, "in *foopb.Op") {
+		t.Errorf("output does not import and refer to foopb:\n%s", out)
+	}
+}
+
+func TestWrite_names(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb", recv: "w", cacheField: "ResultCache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"ResultCache *grpccache.Cache",
+		"func (w *CachedFooServer) Get(",
+		"w.FooServer.Get(ctx, in)",
+		"func (w *CachedFooClient) Get(",
+		"w.FooClient.Get(ctx, in, ",
+		"cache := grpccache.Internal_CacheFromContext(ctx, w.ResultCache)",
+		"cache.GetStale(",
+		"cache.Store(",
+		"cache.Do(",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	for _, notWant := range []string{"(s *", "Cache *grpccache.Cache }", ".Cache."} {
+		if strings.Contains(string(out), notWant) {
+			t.Errorf("output contains %q, want only the custom names:\n%s", notWant, out)
+		}
+	}
+	if regexp.MustCompile(`\bs\.`).Match(out) {
+		t.Errorf("output refers to receiver s, want only the custom names:\n%s", out)
+	}
+
+	for _, opt := range []writeOptions{{recv: "ctx"}, {recv: "a b"}, {cacheField: "cache"}} {
+		if _, err := write(nil, opt); err == nil {
+			t.Errorf("%+v: got nil error, want invalid name error", opt)
+		}
+	}
+}
+
+func TestWrite_docComments(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"// Get wraps FooServer.Get, sending the cache-control set by the method\n// (via grpccache.SetCacheControl) to the client in the response trailer.\nfunc (s *CachedFooServer) Get(",
+		"// Get wraps FooClient.Get with client-side caching via grpccache.\nfunc (s *CachedFooClient) Get(",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWrite_clientConstructor(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+
+	tests := map[string]struct {
+		opt  writeOptions
+		want string
+	}{
+		"same package": {
+			opt:  writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"},
+			want: "func NewCachedFooClient(cc *grpc.ClientConn, cache *grpccache.Cache) *CachedFooClient {\n\treturn &CachedFooClient{FooClient: NewFooClient(cc), Cache: cache}\n}",
+		},
+		"other package": {
+			opt:  writeOptions{outPkg: "otherpb"},
+			want: "return &CachedFooClient{FooClient: foopb.NewFooClient(cc), Cache: cache}",
+		},
+		"custom cache field": {
+			opt:  writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb", cacheField: "ResultCache"},
+			want: "ResultCache: cache}",
+		},
+	}
+	for label, test := range tests {
+		out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, test.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), test.want) {
+			t.Errorf("%s: output does not contain %q:\n%s", label, test.want, out)
+		}
+		if want := "// NewCachedFooClient returns a CachedFooClient that makes calls on cc\n// and caches their results in cache.\n"; !strings.Contains(string(out), want) {
+			t.Errorf("%s: output does not contain %q:\n%s", label, want, out)
+		}
+	}
+}
+
+func TestWrite_importGroups(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	genTypes := []genType{{tspec, "foopb", "example.com/foopb", true, nil, nil}}
+	opt := writeOptions{outPkg: "otherpb"}
+
+	out, err := write(genTypes, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `import (
+	"context"
+
+	"example.com/foopb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+)
+`
+	if !strings.Contains(string(out), want) {
+		t.Errorf("output does not contain the import block %q:\n%s", want, out)
+	}
+
+	if formatted, err := format.Source(out); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(formatted, out) {
+		t.Errorf("output is not gofmt-clean:\n%s", out)
+	}
+	out2, err := write(genTypes, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out2, out) {
+		t.Errorf("regenerated output differs:\n%s\n\nfirst output:\n%s", out2, out)
+	}
+}
+
+func TestWriteSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpccache-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srcs := map[string]string{
+		"foopb": "package foopb\n\ntype FooClient interface {\n\tGet(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)\n}\n",
+		"barpb": "package barpb\n\ntype BarClient interface {\n\tGet(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)\n}\n",
+	}
+	var genFiles []genFile
+	var genTypes []genType
+	for pkg, src := range srcs {
+		if err := os.Mkdir(filepath.Join(dir, pkg), 0700); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, pkg, pkg+".pb.go")
+		if err := ioutil.WriteFile(file, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f := genFile{ImportPath: "example.com/" + pkg, PBGoFile: file}
+		genTypes2, err := loadGenTypes(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genFiles = append(genFiles, f)
+		genTypes = append(genTypes, genTypes2...)
+	}
+
+	out, err := writeSplit(genFiles, genTypes, "cache.pb.go", writeOptions{outPkg: "ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("got %d output files, want 2", len(out))
+	}
+	for pkg, ifc := range map[string]string{"foopb": "Foo", "barpb": "Bar"} {
+		src, ok := out[filepath.Join(dir, pkg, "cache.pb.go")]
+		if !ok {
+			t.Errorf("no output file for %s", pkg)
+			continue
+		}
+		s := string(src)
+		if !strings.Contains(s, "package "+pkg+"\n") {
+			t.Errorf("%s: output is not in package %s:\n%s", pkg, pkg, s)
+		}
+		if !strings.Contains(s, "type Cached"+ifc+"Client struct") {
+			t.Errorf("%s: output has no Cached%sClient:\n%s", pkg, ifc, s)
+		}
+		if strings.Contains(s, `"example.com/`) {
+			t.Errorf("%s: output imports an input package:\n%s", pkg, s)
+		}
+		for other := range srcs {
+			if other != pkg && strings.Contains(s, other) {
+				t.Errorf("%s: output refers to %s:\n%s", pkg, other, s)
+			}
+		}
+	}
+}
+
+func TestWrite_forwardCallOptions(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	Put(ctx context.Context, in *Op, callOpts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"result, err := s.FooClient.Get(ctx, in, append(opts[:len(opts):len(opts)], grpc.Header(&header), grpc.Trailer(&trailer))...)",
+		"result, err := s.FooClient.Put(ctx, in, append(callOpts[:len(callOpts):len(callOpts)], grpc.Header(&header), grpc.Trailer(&trailer))...)",
+
+		// With a nil Cache, calls pass through unchanged.
+		"if cache == nil {\n\t\treturn s.FooClient.Get(ctx, in, opts...)\n\t}",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWrite_header(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+	List(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb", header: parseSkipStr("Foo.List")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for meth, want := range map[string]struct{ sender, where string }{
+		"Get":  {"Internal_SetCacheControlTrailer", "response trailer"},
+		"List": {"Internal_SetCacheControlHeaderOrTrailer", "response header"},
+	} {
+		i := strings.Index(string(out), "func (s *CachedFooServer) "+meth+"(")
+		if i == -1 {
+			t.Fatalf("output has no %s server wrapper:\n%s", meth, out)
+		}
+		body := string(out[i:])
+		body = body[:strings.Index(body, "\n}\n")]
+		if !strings.Contains(body, "grpccache."+want.sender+"(ctx, *cc)") {
+			t.Errorf("%s server wrapper does not call %s:\n%s", meth, want.sender, body)
+		}
+		doc := string(out[:i])
+		doc = doc[strings.LastIndex(doc, "\n\n"):]
+		if wantDoc := "to the client in the " + want.where + "."; !strings.Contains(strings.Join(strings.Fields(strings.Replace(doc, "//", "", -1)), " "), wantDoc) {
+			t.Errorf("%s server wrapper doc does not contain %q:\n%s", meth, wantDoc, doc)
+		}
+	}
+}
+
+func TestWrite_metrics(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	Get(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tspec := Types(astFile, func(*ast.TypeSpec) bool { return true })[0]
+	metricsCalls := []string{
+		`grpccache.Internal_ObserveGet(cache, "Foo.Get", cached)`,
+		`grpccache.Internal_ObserveStore(cache, "Foo.Get")`,
+	}
+	for _, metrics := range []bool{false, true} {
+		out, err := write([]genType{{tspec, "foopb", "example.com/foopb", false, nil, nil}}, writeOptions{outPkg: "foopb", outImportPath: "example.com/foopb", metrics: metrics})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metrics {
+			if got, want := strings.Count(string(out), metricsCalls[1]), 2; got != want { // after Store and StoreError
+				t.Errorf("-metrics: got %d ObserveStore calls, want %d:\n%s", got, want, out)
+			}
+		}
+		for _, call := range metricsCalls {
+			if strings.Contains(string(out), call) != metrics {
+				t.Errorf("metrics=%v: output contains %q = %v, want %v:\n%s", metrics, call, !metrics, metrics, out)
+			}
+		}
+	}
+}
+
+func TestWrite_stream(t *testing.T) {
+	const src = `package foopb
+
+type FooClient interface {
+	List(ctx context.Context, in *Op, opts ...grpc.CallOption) (Foo_ListClient, error)
+	Chat(ctx context.Context, opts ...grpc.CallOption) (Foo_ChatClient, error)
+}
+
+type Foo_ListClient interface {
+	Recv() (*Result, error)
+	grpc.ClientStream
+}
+
+type Foo_ChatClient interface {
+	Send(*Op) error
+	Recv() (*Result, error)
+	grpc.ClientStream
+}
+`
+	astFile, err := parser.ParseFile(fset, "foo.pb.go", src, parser.AllErrors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams, want := streamResultTypes(astFile), map[string]string{"Foo_ListClient": "*Result"}; !reflect.DeepEqual(streams, want) {
+		t.Errorf("got stream result types %v, want %v", streams, want)
+	}
+
+	tspec := Types(astFile, func(tspec *ast.TypeSpec) bool { return tspec.Name.Name == "FooClient" })[0]
+	genTypes := []genType{{tspec, "foopb", "example.com/foopb", false, nil, streamResultTypes(astFile)}}
+	out, err := write(genTypes, writeOptions{outPkg: "foocache", outImportPath: "example.com/foocache", stream: parseSkipStr("Foo.List, Foo.Chat")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"func (s *CachedFooServer) List(in *foopb.Op, stream foopb.Foo_ListServer) error {",
+		"m := &cachedFoo_ListServer{Foo_ListServer: stream, ctx: ctx, cc: cc}",
+		"s.FooServer.List(in, m)",
+		"func (s *cachedFoo_ListServer) Send(m *foopb.Result) error {",
+		"grpccache.Internal_SetCacheControlHeaderOrTrailer(s.ctx, *s.cc)",
+		"in the stream's header",
+		"func (s *CachedFooClient) List(ctx context.Context, in *foopb.Op, opts ...grpc.CallOption) (foopb.Foo_ListClient, error) {",
+		`cache.GetOrCallStream(ctx, "Foo.List", in, new(foopb.Result), `,
+		"func (s cachedFoo_ListClient) Recv() (*foopb.Result, error) {",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "Chat(") {
+		t.Errorf("output has a wrapper for the bidirectional streaming method Chat:\n%s", out)
+	}
+}
+
+// TestGenerated checks that the generated code in the testpb packages
+// (which the grpccache tests build and use) is up to date, so that
+// changes to the generator or to the grpccache funcs that generated
+// code calls (such as grpccache.Internal_WithCacheControl) are caught.
+func TestGenerated(t *testing.T) {
+	tests := []struct {
+		pkg  string
+		file genFile
+		opt  writeOptions // the flags in the package's go:generate directive
+	}{
+		{"testpb", genFile{ImportPath: "sourcegraph.com/sqs/grpccache/testpb", PBGoFile: "../testpb/test.pb.go"}, writeOptions{stream: parseSkipStr("StreamTest.TestStream")}},
+		{"v2pb", genFile{ImportPath: "sourcegraph.com/sqs/grpccache/testpb/v2pb", PBGoFile: "../testpb/v2pb"}, writeOptions{}},
+	}
+	for _, test := range tests {
+		genTypes, err := loadGenTypes(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.opt.outPkg, test.opt.outImportPath = test.pkg, test.file.ImportPath
+		src, err := write(genTypes, test.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := test.file.dir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(filepath.Join(dir, "cache.pb.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ignore the command line (which is the test's, not the
+		// generator's).
+		cmdLine := regexp.MustCompile(`(?m)^//   go run .*$`)
+		if !bytes.Equal(cmdLine.ReplaceAll(src, nil), cmdLine.ReplaceAll(want, nil)) {
+			t.Errorf("%s: cache.pb.go is out of date; run go generate in its dir", test.pkg)
+		}
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grpccache-gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pbFile := filepath.Join(dir, "foo.pb.go")
+	if err := ioutil.WriteFile(pbFile, []byte(testSrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	genTypes, err := loadGenTypes(genFile{ImportPath: "example.com/foopb", PBGoFile: pbFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := write(genTypes, writeOptions{outPkg: "otherpb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upToDate, stale, missing := filepath.Join(dir, "a.pb.go"), filepath.Join(dir, "b.pb.go"), filepath.Join(dir, "c.pb.go")
+	if err := ioutil.WriteFile(upToDate, src, 0600); err != nil {
+		t.Fatal(err)
+	}
+	staleSrc := bytes.Replace(src, []byte("CachedFooClient"), []byte("CachedBarClient"), -1)
+	if err := ioutil.WriteFile(stale, staleSrc, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := checkFiles(map[string][]byte{upToDate: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("up to date: got diffs %q, want none", diffs)
+	}
+
+	diffs, err = checkFiles(map[string][]byte{upToDate: src, stale: src, missing: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := firstDiffLine(staleSrc, src)
+	want := []string{
+		fmt.Sprintf("%s: out of date (first difference at line %d; %d lines, want %d)", stale, line, bytes.Count(staleSrc, []byte("\n")), bytes.Count(src, []byte("\n"))),
+		missing + ": does not exist",
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("got diffs %q, want %q", diffs, want)
+	}
+
+	// checkFiles writes nothing.
+	if got, err := ioutil.ReadFile(stale); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, staleSrc) {
+		t.Error("stale file was modified")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("missing file: got Stat error %v, want it to not exist", err)
+	}
+}
+
+func TestFirstDiffLine(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		line   int
+		differ bool
+	}{
+		{"a\nb\n", "a\nb\n", 0, false},
+		{"a\nb\n", "a\nc\n", 2, true},
+		{"a\n", "a\nb\n", 2, true},
+		{"a", "a\n", 1, true},
+	}
+	for _, test := range tests {
+		line, differ := firstDiffLine([]byte(test.a), []byte(test.b))
+		if line != test.line || differ != test.differ {
+			t.Errorf("%q vs %q: got (%d, %v), want (%d, %v)", test.a, test.b, line, differ, test.line, test.differ)
+		}
+	}
+}
+
+func TestGeneratorArgs(t *testing.T) {
+	args := []string{"-check", "-o", "cache.pb.go", "--check=true", "-pkg", "check", "-files", "a@b"}
+	want := []string{"-o", "cache.pb.go", "-pkg", "check", "-files", "a@b"}
+	if got := generatorArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,5 @@
+package multipb
+
+type BarClient interface {
+	Bar(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
@@ -0,0 +1,5 @@
+package multipb
+
+type FooClient interface {
+	Foo(ctx context.Context, in *Op, opts ...grpc.CallOption) (*Result, error)
+}
@@ -5,165 +5,983 @@ import (
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	protov2 "google.golang.org/protobuf/proto"
 )
 
-type cacheEntry struct {
-	protoBytes []byte
-	cc         CacheControl
-	expiry     time.Time
-}
-
 // A Cache holds and allows retrieval of gRPC method call results that
 // a client has previously seen.
 type Cache struct {
-	mu      sync.Mutex
-	results map[string]cacheEntry // method "-" sha256 of arg proto -> cache entry
+	stats cacheStats // first for 64-bit alignment of atomically accessed fields
 
 	// MaxSize is the maximum size, in bytes, that this cache will
-	// store. An item is not stored if storing it would cause the
-	// cache size to exceed MaxSize.
-	MaxSize uint64
-	size    uint64 // current size
+	// store. If storing an item would cause the cache size to exceed
+	// MaxSize, the least recently used items are evicted until it
+	// fits. An item that is larger than MaxSize is not stored. It
+	// only applies to the default in-memory storage.
+	//
+	// Each item counts its key and data plus EntryOverhead toward
+	// the cache size.
+	//
+	// To change MaxSize while the cache is in use, call Resize.
+	MaxSize uint64 // accessed atomically (after stats, for 64-bit alignment)
+
+	// Storage holds the cached results. If nil, results are held in
+	// memory, subject to MaxSize and MaxEntries.
+	Storage Storage
+
+	mu      sync.Mutex // protects janitorStop
+	memOnce sync.Once
+	mem     *memoryStorage // default Storage (created lazily)
+
+	// MaxEntries, if non-zero, is the maximum number of items that
+	// this cache will store. If storing an item would cause the
+	// number of items to exceed MaxEntries, the least recently used
+	// items are evicted. MaxEntries and MaxSize are enforced
+	// simultaneously: items are evicted until both limits are
+	// satisfied. It only applies to the default in-memory storage.
+	MaxEntries int
+
+	// EvictionPolicy, if non-nil, chooses the items that the default
+	// in-memory storage evicts when the cache exceeds MaxSize or
+	// MaxEntries (see NewLRUPolicy, NewLFUPolicy, and NewFIFOPolicy).
+	// If nil, the least recently used items are evicted (but never
+	// the item that was just stored). A policy must not be shared by
+	// multiple caches, and it must be set before the cache is first
+	// used.
+	EvictionPolicy EvictionPolicy
+
+	// Shards, if greater than 1, is the number of partitions (each
+	// with its own lock) that the default in-memory storage divides
+	// items among, to reduce lock contention under heavy concurrent
+	// use. Items are evicted least recently used within each shard
+	// (MaxSize and MaxEntries still limit the whole cache). It must
+	// be set before the cache is first used.
+	Shards int
+
+	// MaxResultSize, if non-nil, maps a method name (as passed to
+	// Store) to the maximum size, in bytes, of a marshaled result for
+	// that method that will be cached. Larger results are not stored.
+	// A method with no entry (or a zero entry) has no per-method
+	// limit. Unlike MaxSize, it applies to all storages.
+	MaxResultSize map[string]uint64
+
+	// CacheableFunc, if non-nil, is called with each result that the
+	// server allows to be cached, and the result is only stored if it
+	// returns true. It lets the client refuse to cache results that
+	// it knows are unsuitable (e.g., partial results), regardless of
+	// the server's cache control. It is not called for errors.
+	CacheableFunc func(method string, result proto.Message) bool
+
+	// TTLFunc, if non-nil, is called by Store with each result whose
+	// response does not forbid caching (with NoStore or an error),
+	// including responses with no cache control info. If it returns
+	// ok, the result's MaxAge (and SharedMaxAge) is ttl, overriding
+	// the server's MaxAge, ExpiresAt, Immutable, and DefaultMaxAge; a
+	// ttl <= 0 means the result is not cached. It lets the client
+	// derive a result's freshness from the result itself (e.g., from
+	// the timestamp of the newest item in a feed). MaxAgeCap and
+	// ExpiryJitter still apply to ttl, and the server's
+	// StaleWhileRevalidate is kept.
+	TTLFunc func(method string, result proto.Message) (ttl time.Duration, ok bool)
+
+	// Namespace, if set, is prepended (followed by "/") to every
+	// cache key, including those returned by KeyFunc. Caches that
+	// share a backing Storage (e.g., separate services using the same
+	// Redis server) should have different namespaces, so that their
+	// keys don't collide. Changing the namespace (e.g., to the app's
+	// version on each deploy) makes all items stored under the old
+	// namespace unreachable, which is a cheap way to invalidate
+	// everything.
+	Namespace string
 
 	// KeyPart, if non-nil, returns a string that is appended to the
 	// key. It can be used to ensure that items from separate users,
 	// for example, are not comingled.
 	KeyPart func(ctx context.Context) string
 
+	// KeyMetadata, if non-empty, lists request metadata keys whose
+	// values (in the outgoing request metadata in the ctx passed to
+	// Get, Store, etc.) are included in the key of every result. It
+	// can be used when results depend on metadata that the client
+	// sets (e.g., an auth scope), so that calls with different values
+	// don't share cached results, even if the server doesn't list the
+	// keys in the response's Vary (see CacheControl.Vary). Unlike
+	// KeyPart, it is also applied to keys returned by KeyFunc.
+	KeyMetadata []string
+
+	// Hash, if non-nil, is used to hash the marshaled arg when
+	// computing the cache key. The default is the base64-encoded
+	// SHA-256 hash. A faster non-cryptographic hash may be used if
+	// collision resistance is not a concern.
+	Hash func(data []byte) string
+
+	// KeyFunc, if non-nil, returns the cache key for a call to method
+	// with arg, replacing the default key derivation (which hashes
+	// the marshaled arg and appends KeyPart). It can be used to make
+	// semantically equivalent args (e.g., that differ only in a
+	// request ID field) share a cache key. Values of request metadata
+	// listed in the response's Vary (see CacheControl.Vary) are still
+	// appended to the key it returns.
+	//
+	// If KeyFunc (or the marshaling of the arg, for the default key)
+	// returns an error, the call is not cached: Get reports a miss and
+	// Store does nothing, so the call proceeds as if uncached.
+	//
+	// InvalidateMethod only finds keys that begin with method + "|".
+	KeyFunc func(ctx context.Context, method string, arg proto.Message) (string, error)
+
+	// Compress causes all results to be gzipped before they are
+	// stored, which reduces the memory they occupy at the cost of
+	// CPU time. If false, only results of at least MinByteGzip bytes
+	// are gzipped. Each stored item records whether it is gzipped,
+	// so Compress may be changed at any time.
+	Compress bool
+
+	// Marshaler marshals method call arguments (to compute cache
+	// keys) and results (to store them). If nil, the
+	// github.com/gogo/protobuf/proto package is used (or the
+	// google.golang.org/protobuf/proto package, for messages
+	// generated by its protoc-gen-go).
+	//
+	// When the default Marshaler computes the cache key of an arg
+	// generated by google.golang.org/protobuf, it first re-encodes the
+	// payloads of any google.protobuf.Any messages it contains
+	// deterministically, because their encoding is otherwise opaque
+	// (and may differ for equal payloads). Other Any payloads are used
+	// as is; use KeyFunc to canonicalize such args if necessary.
+	Marshaler Marshaler
+
+	// SingleFlight causes concurrent cache misses for the same item
+	// to result in only one call to the server. See Cache.Do.
+	SingleFlight bool
+
+	// Shared indicates that this cache is shared by many clients (as
+	// opposed to being private to a single client). A shared cache
+	// uses CacheControl.SharedMaxAge instead of MaxAge, if it is set.
+	Shared bool
+
+	// DefaultMaxAge, if non-zero, is the MaxAge that Store uses for
+	// results whose responses carry no cache control info at all
+	// (because the server method did not call SetCacheControl). It
+	// does not apply to responses with explicit cache control info
+	// (even if it forbids caching, as NoStore does), nor to errors.
+	DefaultMaxAge time.Duration
+
+	// MaxAgeCap, if non-zero, is the maximum time that a result is
+	// considered fresh, regardless of the MaxAge (or SharedMaxAge)
+	// that the server set (or TTLFunc returned). It protects against
+	// servers that set overly long MaxAges. It also limits the
+	// lifetime of Immutable results, which otherwise never expire.
+	// (It does not limit StaleWhileRevalidate.)
+	MaxAgeCap time.Duration
+
+	// ExpiryJitter, if non-zero, is the maximum random offset (in
+	// either direction) that is added to each stored result's MaxAge
+	// (after MaxAgeCap is applied). It spreads out the expiry of
+	// results that are stored at the same time with the same MaxAge,
+	// so that they don't all expire (and cause cache misses) at once.
+	// A result is never kept for longer than its MaxAge plus
+	// ExpiryJitter (plus any StaleWhileRevalidate).
+	ExpiryJitter time.Duration
+
+	// MaxStale, if non-zero, is how long results are kept after they
+	// expire, so that they can be returned if a later call for the
+	// same result fails because the server is unavailable (see
+	// GetIfError). Expired results are never returned otherwise. It
+	// only applies to storages that keep expired items (as the
+	// default in-memory storage does).
+	MaxStale time.Duration
+
+	// PreserveTrailers lists response trailer keys whose values are
+	// stored with each result, so that callers can read them (see
+	// WithTrailer) even when the result is served from the cache
+	// (e.g., a rate limit or a server version). Other trailer values
+	// are only available from calls that reach the server.
+	PreserveTrailers []string
+
+	// Tracer, if non-nil, traces Get and Store calls (e.g., so that
+	// cache hits, which make no RPC, appear in distributed traces).
+	Tracer Tracer
+
+	// OnTiming, if non-nil, is called with the duration of each
+	// marshal, hash, and unmarshal operation (one of the Timing*
+	// operations) done by Get and Store, so that the overhead of
+	// caching a method can be compared to the latency of the call
+	// itself. The durations are measured with the wall clock.
+	OnTiming func(op string, d time.Duration)
+
+	// Metrics, if non-nil, receives per-method metrics from the
+	// CachedXyzClient wrappers generated with grpccache-gen's
+	// -metrics flag. If nil, the generated metrics calls do nothing.
+	Metrics MetricsSink
+
+	// OnEvict, if non-nil, is called with the key of each item that is
+	// removed from the cache because it expired, was evicted to
+	// satisfy MaxSize or MaxEntries, or was invalidated (by
+	// Invalidate, InvalidateMethod, or Clear). It is called without
+	// any locks held, so it may call methods on the cache. Evictions,
+	// InvalidateMethod, Clear, and expirations found by the janitor
+	// are only reported for the default in-memory storage.
+	OnEvict func(key string, reason EvictReason)
+
+	// Logger, if set, receives a line for each cache operation (hits,
+	// misses, stores, evictions, etc.). If nil, nothing is logged
+	// (unless Log is set).
+	Logger Logger
+
+	// Log, if set and Logger is nil, logs each cache operation with
+	// the standard library's log package. It is retained for
+	// backward compatibility; new code should set Logger.
 	Log bool
+
+	janitorStop chan struct{} // closed to stop the janitor goroutine
+
+	now func() time.Time // if non-nil, used instead of time.Now (for tests)
+
+	varyMu sync.RWMutex
+	vary   map[string][]string // method -> Vary of its most recent response
+
+	invalidationsMu sync.RWMutex
+	invalidations   map[string][]string // write method -> methods it invalidates (see RegisterInvalidation)
+
+	methodStatsMu sync.RWMutex
+	methodStats   map[string]*methodCounters // method -> its counters (see MethodStats)
+
+	flight singleflight.Group // in-flight calls (if SingleFlight)
+
+	revalidatingMu sync.Mutex
+	revalidating   map[string]struct{} // cache keys being revalidated (see Revalidate)
+}
+
+// timeNow returns the current time, according to c.now if set.
+func (c *Cache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
 }
 
+// storage returns the Storage that holds c's results.
+func (c *Cache) storage() Storage {
+	if c.Storage != nil {
+		return c.Storage
+	}
+	return c.memoryStorage()
+}
+
+// MemoryStorage returns c's default in-memory storage (which is
+// subject to MaxSize and MaxEntries), even if c.Storage is set. It can
+// be used as the L1 storage of a TieredStorage.
+func (c *Cache) MemoryStorage() Storage {
+	return c.memoryStorage()
+}
+
+// memoryStorage returns c's default in-memory storage, creating it if
+// needed.
+func (c *Cache) memoryStorage() *memoryStorage {
+	c.memOnce.Do(func() { c.mem = newMemoryStorage(c) })
+	return c.mem
+}
+
+// A Marshaler marshals and unmarshals the arguments and results of
+// gRPC method calls.
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+func (c *Cache) marshaler() Marshaler {
+	if c.Marshaler != nil {
+		return c.Marshaler
+	}
+	return protoCodec{}
+}
+
+func (c *Cache) codec() gzipProtoCodec {
+	return gzipProtoCodec{m: c.marshaler(), compress: c.Compress}
+}
+
+// sha256Base64 is the default Cache.Hash func.
+func sha256Base64(data []byte) string {
+	sha := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
+
+// methodSep separates the method from the rest of the cache key. It
+// must not appear in method names (which, in gRPC, consist only of
+// identifiers, '.' and '/'), so that all keys for a method can be
+// found by prefix.
+const methodSep = "|"
+
+// cacheKey returns the key of the cached result of a call to method
+// with arg. Unless KeyFunc is set, the key begins with the method, so
+// calls to different methods never share a key.
+//
+// A nil arg (or nil pointer) is treated as an empty message: its
+// encoding is empty, so it has the same key as an empty arg (e.g., a
+// *emptypb.Empty) of the same method.
 func (c *Cache) cacheKey(ctx context.Context, method string, arg proto.Message) (string, error) {
-	data, err := proto.Marshal(arg)
+	var s string
+	if c.KeyFunc != nil {
+		var err error
+		s, err = c.KeyFunc(ctx, method, arg)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		start := c.startTiming()
+		data, err := c.marshalArg(arg)
+		if err != nil {
+			return "", err
+		}
+		c.endTiming(TimingMarshalKey, start)
+		hash := c.Hash
+		if hash == nil {
+			hash = sha256Base64
+		}
+		start = c.startTiming()
+		s = method + methodSep + hash(data)
+		c.endTiming(TimingHash, start)
+
+		if c.KeyPart != nil {
+			s += "-" + c.KeyPart(ctx)
+		}
+	}
+
+	if len(c.KeyMetadata) > 0 {
+		s += metadataKeyPart(ctx, c.KeyMetadata)
+	}
+	return c.namespacePrefix() + s + c.varyKeyPart(ctx, method), nil
+}
+
+// cacheKeyOrSkip is like cacheKey, but if the key can't be computed
+// (e.g., because arg can't be marshaled), it logs the error and
+// returns ok == false, and the caller treats the call as uncacheable.
+// The cache is only an optimization, so a call that would otherwise
+// succeed must not fail because of it.
+func (c *Cache) cacheKeyOrSkip(ctx context.Context, method string, arg proto.Message) (key string, ok bool) {
+	key, err := c.cacheKey(ctx, method, arg)
 	if err != nil {
-		return "", err
+		if c.logging() {
+			c.logf("Cache: NOKEY   %s %s: %s", method, truncate(arg), err)
+		}
+		return "", false
 	}
-	sha := sha256.Sum256(data)
-	s := method + "-" + base64.StdEncoding.EncodeToString(sha[:])
+	return key, true
+}
 
-	if c.KeyPart != nil {
-		s += "-" + c.KeyPart(ctx)
+// marshalArg returns the encoding of arg that its cache key is
+// derived from (see cacheKey).
+func (c *Cache) marshalArg(arg proto.Message) ([]byte, error) {
+	if isNilMessage(arg) {
+		return nil, nil
+	}
+	var v interface{} = arg
+	if m, ok := arg.(protov2.Message); ok && c.Marshaler == nil {
+		var err error
+		if v, err = canonicalizeAny(m); err != nil {
+			return nil, err
+		}
 	}
+	return c.marshaler().Marshal(v)
+}
 
-	return s, nil
+// namespacePrefix returns the prefix of all of c's cache keys (see
+// Namespace).
+func (c *Cache) namespacePrefix() string {
+	if c.Namespace == "" {
+		return ""
+	}
+	return c.Namespace + "/"
 }
 
 // Get retrieves a cached result for a gRPC method call (on the
-// client), if it exists in the cache. It is called from
-// CachedXyzClient auto-generated wrapper methods.
+// client), if it exists in the cache. Stale results (see GetStale)
+// are treated as absent.
 //
 // The `method` and `arg` parameters are for the call that's in
 // progress. If a cached result is found (that has not expired), it is
-// written to the `result` parameter and (true, nil) is returned. If
-// there's no cached result (or it has expired), then (false, nil) is
-// returned. Otherwise a non-nil error is returned.
+// written to the `result` parameter and (true, nil) is returned. If a
+// cached error is found (see SetCacheControlError), then (true, err)
+// is returned, where err is the cached error. If there's no cached
+// result (or it has expired), then (false, nil) is returned. Errors
+// from the Storage (and cached data that can't be unmarshaled) are
+// logged and treated as misses, so that calls are still made while
+// the Storage is unavailable.
 func (c *Cache) Get(ctx context.Context, method string, arg proto.Message, result proto.Message) (cached bool, err error) {
-	if getNoCache(ctx) {
+	outcome, _, _, err := c.get(ctx, method, arg, result, freshOnly)
+	return outcome.Hit(), err
+}
+
+// GetWithControl is like Get, but if a cached result (or error) is
+// found, it also returns its cache control info and its remaining
+// freshness (the time until it becomes stale). Callers that serve the
+// result to their own clients (e.g., an HTTP gateway) can use these
+// to set their own caching headers.
+func (c *Cache) GetWithControl(ctx context.Context, method string, arg proto.Message, result proto.Message) (cached bool, cc CacheControl, remaining time.Duration, err error) {
+	outcome, cc, expiry, err := c.get(ctx, method, arg, result, freshOnly)
+	if !outcome.Hit() {
+		return false, CacheControl{}, 0, err
+	}
+	// The stored expiry includes the StaleWhileRevalidate window.
+	remaining = expiry.Add(-cc.StaleWhileRevalidate).Sub(c.timeNow())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return true, cc, remaining, err
+}
+
+// GetStale is like Get, but it also returns a cached result that is
+// stale (older than its MaxAge) but within its StaleWhileRevalidate
+// window. In that case, revalidate is true, and the caller should
+// refresh the result (see Revalidate). It is called from
+// CachedXyzClient auto-generated wrapper methods.
+func (c *Cache) GetStale(ctx context.Context, method string, arg proto.Message, result proto.Message) (cached, revalidate bool, err error) {
+	outcome, _, _, err := c.get(ctx, method, arg, result, allowStale)
+	return outcome.Hit(), outcome == StaleHit, err
+}
+
+// GetWithOutcome is like GetStale, but it reports the outcome of the
+// lookup in more detail, distinguishing a cold miss from a miss due
+// to an expired result. A StaleHit result should be refreshed (see
+// Revalidate), and callers that serve it to their own clients should
+// indicate that it is stale (e.g., with an HTTP "Warning: 110"
+// header).
+func (c *Cache) GetWithOutcome(ctx context.Context, method string, arg proto.Message, result proto.Message) (GetOutcome, error) {
+	outcome, _, _, err := c.get(ctx, method, arg, result, allowStale)
+	return outcome, err
+}
+
+// GetIfError is called after a call to method with arg failed with
+// callErr. If callErr indicates that the server failed or was
+// unavailable (see isServerFailure), and a cached result (or error)
+// that expired less than MaxStale ago is present, it is returned as
+// with Get. Otherwise (false, nil) is returned. It is called from
+// CachedXyzClient auto-generated wrapper methods.
+func (c *Cache) GetIfError(ctx context.Context, method string, arg proto.Message, result proto.Message, callErr error) (cached bool, err error) {
+	if c.MaxStale == 0 || !isServerFailure(callErr) {
 		return false, nil
 	}
+	outcome, _, _, err := c.get(ctx, method, arg, result, allowExpired)
+	return outcome.Hit(), err
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// isServerFailure reports whether err (returned by a gRPC call)
+// indicates that the server failed or could not be reached, as
+// opposed to the server returning an error result.
+func isServerFailure(err error) bool {
+	switch grpc.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal:
+		return true
+	}
+	return false
+}
 
-	cacheKey, err := c.cacheKey(ctx, method, arg)
-	if err != nil {
-		return false, err
+// GetOutcome is the outcome of looking up a cached result (see
+// GetWithOutcome).
+type GetOutcome int
+
+const (
+	// ColdMiss means that no cached result was found (or the cache
+	// was bypassed, e.g., by WithNoCache).
+	ColdMiss GetOutcome = iota
+
+	// ExpiredMiss means that a cached result was found, but it was
+	// too old to be returned.
+	ExpiredMiss
+
+	// FreshHit means that a fresh cached result was returned.
+	FreshHit
+
+	// StaleHit means that a stale cached result was returned (one
+	// older than its MaxAge, within its StaleWhileRevalidate window,
+	// or, for GetIfError, within MaxStale of its expiry).
+	StaleHit
+)
+
+// Hit reports whether a cached result (or error) was returned.
+func (o GetOutcome) Hit() bool { return o == FreshHit || o == StaleHit }
+
+func (o GetOutcome) String() string {
+	switch o {
+	case ColdMiss:
+		return "cold miss"
+	case ExpiredMiss:
+		return "expired miss"
+	case FreshHit:
+		return "fresh hit"
+	case StaleHit:
+		return "stale hit"
 	}
+	return "unknown"
+}
+
+// staleMode specifies which cached results get returns.
+type staleMode int
+
+const (
+	freshOnly    staleMode = iota // only fresh results (Get)
+	allowStale                    // also stale results within their StaleWhileRevalidate window (GetStale)
+	allowExpired                  // also expired results within MaxStale (GetIfError)
+)
 
-	if entry, present := c.results[cacheKey]; present {
-		if time.Now().After(entry.expiry) {
+func (c *Cache) get(ctx context.Context, method string, arg proto.Message, result proto.Message, mode staleMode) (outcome GetOutcome, cc CacheControl, expiry time.Time, err error) {
+	if getNoCache(ctx) || getConsistency(ctx) == Strong {
+		return ColdMiss, CacheControl{}, time.Time{}, nil
+	}
+	forceRefresh := getForceRefresh(ctx)
+
+	traceOutcome := TraceMiss
+	finish := c.trace(ctx, TraceGet, method)
+	defer func() { finish(traceOutcome, err) }()
+
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
+		return ColdMiss, CacheControl{}, time.Time{}, nil
+	}
+
+	storage := c.storage()
+	data, cc, expiry, present, err := storage.Get(cacheKey)
+	if err != nil {
+		c.logStorageError("Get", cacheKey, err)
+		c.countMiss(method)
+		return ColdMiss, CacheControl{}, time.Time{}, nil
+	}
+	if forceRefresh && (!present || !cc.Immutable) {
+		// Skip the cached result, unless it is immutable (and so
+		// could not be refreshed).
+		return ColdMiss, CacheControl{}, time.Time{}, nil
+	}
+	if present {
+		now := c.timeNow()
+		if now.After(expiry) && !now.After(c.removeAfter(expiry)) && mode != allowExpired {
+			// Keep the entry for GetIfError (see MaxStale).
+			c.countMiss(method)
+			traceOutcome = TraceExpired
+			if c.logging() {
+				c.logf("Cache: EXPIRED %s %s (kept for MaxStale)", cacheKey, truncate(arg))
+			}
+			return ExpiredMiss, CacheControl{}, time.Time{}, nil
+		}
+		if now.After(c.removeAfter(expiry)) {
 			// Clear cache entry.
-			delete(c.results, cacheKey)
-			c.size -= uint64(len(entry.protoBytes))
+			if err := storage.Delete(cacheKey); err != nil {
+				c.logStorageError("Delete", cacheKey, err)
+			}
+			atomic.AddUint64(&c.stats.expirations, 1)
+			c.countMiss(method)
+			traceOutcome = TraceExpired
 
-			if c.Log {
-				log.Printf("Cache: EXPIRED %s %s (size %d)", cacheKey, truncate(arg), c.size)
+			if c.logging() {
+				c.logf("Cache: EXPIRED %s %s", cacheKey, truncate(arg))
 			}
-			return false, nil
+			c.onEvict(cacheKey, EvictExpired)
+			return ExpiredMiss, CacheControl{}, time.Time{}, nil
 		}
-		if err := codec.Unmarshal(entry.protoBytes, result); err != nil {
-			return false, err
+		if cc.NoCache && mode != allowExpired {
+			// It must be revalidated before it is served (see
+			// Internal_WithCachedETag).
+			c.countMiss(method)
+			traceOutcome = TraceStale
+			if c.logging() {
+				c.logf("Cache: NOCACHE %s %s", cacheKey, truncate(arg))
+			}
+			return ExpiredMiss, CacheControl{}, time.Time{}, nil
 		}
-		if c.Log {
-			log.Printf("Cache: HIT     %s %s: result %s", cacheKey, truncate(arg), truncate(result))
+		// The stored expiry includes the StaleWhileRevalidate window.
+		freshUntil := expiry.Add(-cc.StaleWhileRevalidate)
+		stale := now.After(freshUntil)
+		if minFresh := getMinFresh(ctx); minFresh != 0 && freshUntil.Sub(now) < minFresh && mode != allowExpired {
+			// Not fresh enough for the caller, who wouldn't accept
+			// a stale result either.
+			stale, mode = true, freshOnly
 		}
-		return true, nil
+		if budget, ok := getFreshnessBudget(ctx); ok && !cc.Immutable && (cc.StoredAt.IsZero() || now.Sub(cc.StoredAt) > budget) && mode != allowExpired {
+			// Older than the caller allows, regardless of MaxAge.
+			stale, mode = true, freshOnly
+		}
+		if stale && mode == freshOnly {
+			c.countMiss(method)
+			traceOutcome = TraceStale
+			if c.logging() {
+				c.logf("Cache: STALE   %s %s", cacheKey, truncate(arg))
+			}
+			return ExpiredMiss, CacheControl{}, time.Time{}, nil
+		}
+		outcome = FreshHit
+		if stale {
+			outcome = StaleHit
+		}
+		if cc.ErrorCode != codes.OK {
+			c.countHit(method)
+			traceOutcome = TraceHit
+			if c.logging() {
+				c.logf("Cache: HIT     %s %s: error code %d (stale %v)", cacheKey, truncate(arg), cc.ErrorCode, stale)
+			}
+			setTrailer(ctx, cc.Trailer)
+			return outcome, cc, expiry, grpc.Errorf(cc.ErrorCode, "%s", data)
+		}
+		if err := c.unmarshal(data, result); err != nil {
+			result.Reset()
+			c.countMiss(method)
+			if c.logging() {
+				c.logf("Cache: BADDATA %s %s: %s", cacheKey, truncate(arg), err)
+			}
+			return ColdMiss, CacheControl{}, time.Time{}, nil
+		}
+		c.countHit(method)
+		traceOutcome = TraceHit
+		if c.logging() {
+			c.logf("Cache: HIT     %s %s: result %s (stale %v)", cacheKey, truncate(arg), truncate(result), stale)
+		}
+		setTrailer(ctx, cc.Trailer)
+		return outcome, cc, expiry, nil
 	}
-	if c.Log {
-		log.Printf("Cache: MISS    %s %s", cacheKey, truncate(arg))
+	c.countMiss(method)
+	if c.logging() {
+		c.logf("Cache: MISS    %s %s", cacheKey, truncate(arg))
 	}
-	return false, nil
+	return ColdMiss, CacheControl{}, time.Time{}, nil
+}
+
+// removeAfter returns the time after which an item that expires at
+// expiry is removed (which is later than expiry if MaxStale is set).
+func (c *Cache) removeAfter(expiry time.Time) time.Time {
+	return expiry.Add(c.MaxStale)
+}
+
+// expiry returns the time at which an item with the given cache
+// control info, stored now, expires (including its
+// StaleWhileRevalidate window). The MaxAge (or the time until
+// ExpiresAt) is limited to MaxAgeCap. ExpiryJitter is not added to an
+// ExpiresAt (which is exact). Immutable items never expire, unless
+// MaxAgeCap is set (in which case they expire after MaxAgeCap).
+// NoCache items that are not fresh at all are kept for
+// noCacheRetention.
+func (c *Cache) expiry(cc *CacheControl) time.Time {
+	if cc.Immutable && c.MaxAgeCap == 0 {
+		return immutableExpiry
+	}
+	now := c.timeNow()
+	maxAge := cc.freshFor(c.Shared, now)
+	if cc.NoCache && maxAge <= 0 {
+		maxAge = noCacheRetention
+	}
+	if c.MaxAgeCap != 0 && (maxAge > c.MaxAgeCap || cc.Immutable) {
+		maxAge = c.MaxAgeCap
+	}
+	if c.ExpiryJitter > 0 && cc.ExpiresAt.IsZero() {
+		maxAge += time.Duration(rand.Int63n(2*int64(c.ExpiryJitter)+1)) - c.ExpiryJitter
+		if maxAge < 0 {
+			maxAge = 0
+		}
+	}
+	return now.Add(maxAge + cc.StaleWhileRevalidate)
 }
 
 // Store records the result from a gRPC method call. It is called by
 // the CachedXyzClient auto-generated wrapper methods.
-func (c *Cache) Store(ctx context.Context, method string, arg proto.Message, result proto.Message, trailer metadata.MD) error {
+//
+// If the cache control info in trailer is malformed, the result is
+// not cached, but no error is returned (because the response itself
+// is fine). Likewise, a nil result is not cached, and errors from the
+// Storage are logged instead of returned.
+func (c *Cache) Store(ctx context.Context, method string, arg proto.Message, result proto.Message, trailer metadata.MD) (err error) {
+	setTrailer(ctx, trailer)
+	c.invalidateAfter(method)
 	if getNoCache(ctx) {
 		return nil
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	var stored bool
+	finish := c.trace(ctx, TraceStore, method)
+	defer func() { finish(storeOutcome(stored), err) }()
+
+	cc, err := cacheControlFromMetadata(trailer)
+	if err != nil {
+		// The response itself is fine, so don't fail the call; just
+		// don't cache it.
+		if c.logging() {
+			c.logf("Cache: BADCC   %s %+v: %s", method, arg, err)
+		}
+		return nil
+	}
+	if cc == nil && c.DefaultMaxAge != 0 {
+		cc = &CacheControl{MaxAge: c.DefaultMaxAge}
+	}
+	cc = c.applyTTLFunc(method, result, cc)
+	if cc != nil {
+		cc.Trailer = c.preservedTrailer(trailer)
+	}
+	stored, err = c.store(ctx, method, arg, result, cc)
+	return err
+}
+
+// applyTTLFunc returns cc (the cache control of the response with
+// result), with its MaxAge set by c.TTLFunc (if any).
+func (c *Cache) applyTTLFunc(method string, result proto.Message, cc *CacheControl) *CacheControl {
+	if c.TTLFunc == nil || isNilMessage(result) {
+		return cc
+	}
+	if cc != nil && (cc.NoStore || cc.ErrorCode != codes.OK || cc.notModified) {
+		return cc
+	}
+	ttl, ok := c.TTLFunc(method, result)
+	if !ok {
+		return cc
+	}
+	if cc == nil {
+		cc = &CacheControl{}
+	}
+	cc.MaxAge, cc.SharedMaxAge, cc.ExpiresAt, cc.Immutable = ttl, 0, time.Time{}, false
+	return cc
+}
+
+// Set stores result as the result of a call to method with arg, with
+// the given cache control info, as if it had been returned by the
+// server (and passed to Store). It can be used to populate the cache
+// with results that are known without making the call (e.g., from a
+// batch job). Like Store, it does nothing if cc does not allow the
+// result to be cached (e.g., if its MaxAge is zero).
+func (c *Cache) Set(ctx context.Context, method string, arg proto.Message, result proto.Message, cc CacheControl) (err error) {
+	if getNoCache(ctx) {
+		return nil
+	}
+
+	var stored bool
+	finish := c.trace(ctx, TraceStore, method)
+	defer func() { finish(storeOutcome(stored), err) }()
+
+	stored, err = c.store(ctx, method, arg, result, &cc)
+	return err
+}
+
+// store implements Store and Set. It reports whether it stored result.
+func (c *Cache) store(ctx context.Context, method string, arg proto.Message, result proto.Message, cc *CacheControl) (stored bool, err error) {
+	if isNilMessage(result) {
+		// There's nothing to cache, and a nil result can't be
+		// distinguished from an empty one once marshaled.
+		if c.logging() {
+			c.logf("Cache: NILRESULT %s %+v", method, arg)
+		}
+		return false, nil
+	}
+
+	if cc != nil {
+		c.setVary(method, cc.Vary)
+	}
 
-	if c.results == nil {
-		c.results = map[string]cacheEntry{}
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
+		return false, nil
 	}
 
-	data, err := codec.Marshal(result)
+	if cc != nil && cc.notModified {
+		if err := c.storeNotModified(ctx, cacheKey, arg, result, *cc); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if cc == nil || !cc.cacheable(c.Shared, c.timeNow()) || cc.ErrorCode != codes.OK {
+		return false, nil
+	}
+
+	if c.CacheableFunc != nil && !c.CacheableFunc(method, result) {
+		if c.logging() {
+			c.logf("Cache: UNCACHEABLE %s %+v: result %s", cacheKey, arg, truncate(result))
+		}
+		// Delete any existing result because it's probably stale
+		// anyway.
+		c.delete(cacheKey)
+		return false, nil
+	}
+
+	// Compute the expiry before marshaling, so that a slow marshal
+	// doesn't extend the result's lifetime. Marshal before calling
+	// Set (which holds the storage's lock), so that a slow marshal
+	// doesn't block other cache operations.
+	cc.StoredAt = c.timeNow()
+	expiry := c.expiry(cc)
+	start := c.startTiming()
+	data, err := c.codec().Marshal(result)
 	if err != nil {
-		return err
+		return false, err
 	}
+	c.endTiming(TimingMarshal, start)
 
-	cacheKey, err := c.cacheKey(ctx, method, arg)
+	if max := c.MaxResultSize[method]; max != 0 && uint64(len(data)) > max {
+		if c.logging() {
+			c.logf("Cache: TOOBIG  %s %+v: %d bytes (max %d)", cacheKey, arg, len(data), max)
+		}
+		// Delete any existing result because it's probably stale
+		// anyway.
+		c.delete(cacheKey)
+		return false, nil
+	}
+
+	if err := c.storage().Set(cacheKey, data, *cc, expiry); err != nil {
+		c.logStorageError("Set", cacheKey, err)
+		return false, nil
+	}
+	atomic.AddUint64(&c.stats.stores, 1)
+
+	if c.logging() {
+		c.logf("Cache: STORE   %s %+v: result %s", cacheKey, arg, truncate(result))
+	}
+	return true, nil
+}
+
+// WouldStore reports whether Store would store result as the result
+// of a call to method with arg, judging by the result itself, without
+// modifying the cache. It also returns the size of the marshaled
+// result (the quantity limited by MaxResultSize). Callers can use it
+// to skip expensive processing of a result that would not be cached.
+//
+// A result would not be stored if it is nil, if CacheableFunc rejects
+// it, if it exceeds the method's MaxResultSize, if arg can't be
+// marshaled into a cache key, or if (with the default in-memory
+// storage) it is larger than MaxSize. Other items
+// are evicted to make room for a result that fits within MaxSize, so
+// the current size of the cache doesn't matter. Because the cache
+// control is only known once the server responds, WouldStore assumes
+// that the result is cacheable.
+func (c *Cache) WouldStore(ctx context.Context, method string, arg proto.Message, result proto.Message) (size uint64, wouldStore bool, err error) {
+	if getNoCache(ctx) || isNilMessage(result) {
+		return 0, false, nil
+	}
+
+	data, err := c.codec().Marshal(result)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
+	size = uint64(len(data))
+
+	if c.CacheableFunc != nil && !c.CacheableFunc(method, result) {
+		return size, false, nil
+	}
+	if max := c.MaxResultSize[method]; max != 0 && size > max {
+		return size, false, nil
+	}
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
+		return size, false, nil
+	}
+	if maxSize := c.maxSize(); c.Storage == nil && maxSize != 0 && entrySize(cacheKey, data) > maxSize {
+		return size, false, nil
+	}
+	return size, true, nil
+}
+
+// preservedTrailer returns the values in trailer of the keys in
+// c.PreserveTrailers (or nil if there are none).
+func (c *Cache) preservedTrailer(trailer metadata.MD) metadata.MD {
+	var md metadata.MD
+	for _, key := range c.PreserveTrailers {
+		if v, ok := trailer[key]; ok {
+			if md == nil {
+				md = metadata.MD{}
+			}
+			md[key] = v
+		}
+	}
+	return md
+}
+
+// isNilMessage reports whether m is nil or a nil pointer.
+func isNilMessage(m proto.Message) bool {
+	if m == nil {
+		return true
+	}
+	v := reflect.ValueOf(m)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// StoreError records an error returned by a gRPC method call. It is
+// called by the CachedXyzClient auto-generated wrapper methods. The
+// error is only cached if the server allowed it by calling
+// SetCacheControlError with callErr's gRPC status code.
+func (c *Cache) StoreError(ctx context.Context, method string, arg proto.Message, callErr error, trailer metadata.MD) (err error) {
+	setTrailer(ctx, trailer)
+	if getNoCache(ctx) {
+		return nil
+	}
+
+	var stored bool
+	finish := c.trace(ctx, TraceStore, method)
+	defer func() { finish(storeOutcome(stored), err) }()
 
 	cc, err := cacheControlFromMetadata(trailer)
 	if err != nil {
-		return err
+		// The response itself is fine, so don't fail the call; just
+		// don't cache it.
+		if c.logging() {
+			c.logf("Cache: BADCC   %s %+v: %s", method, arg, err)
+		}
+		return nil
+	}
+	if cc != nil {
+		c.setVary(method, cc.Vary)
 	}
 
-	if cc == nil || !cc.cacheable() {
+	if cc == nil || !cc.cacheable(c.Shared, c.timeNow()) || cc.ErrorCode == codes.OK || grpc.Code(callErr) != cc.ErrorCode {
 		return nil
 	}
+	cc.Trailer = c.preservedTrailer(trailer)
+	cc.StoredAt = c.timeNow()
 
-	afterSize := c.size
-	if prev, ok := c.results[cacheKey]; ok {
-		afterSize -= uint64(len(prev.protoBytes))
-	}
-	afterSize += uint64(len(data))
-	if c.MaxSize != 0 && afterSize > c.MaxSize {
-		if _, ok := c.results[cacheKey]; ok {
-			// Delete it because it's probably stale anyway.
-			delete(c.results, cacheKey)
-			c.size -= uint64(len(c.results[cacheKey].protoBytes))
-		}
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
 		return nil
 	}
 
-	c.results[cacheKey] = cacheEntry{
-		protoBytes: data,
-		cc:         *cc,
-		expiry:     time.Now().Add(cc.MaxAge),
+	if err := c.storage().Set(cacheKey, []byte(grpc.ErrorDesc(callErr)), *cc, c.expiry(cc)); err != nil {
+		c.logStorageError("Set", cacheKey, err)
+		return nil
 	}
-	c.size = afterSize
+	atomic.AddUint64(&c.stats.stores, 1)
+	stored = true
 
-	if c.Log {
-		log.Printf("Cache: STORE   %s %+v: result %s (size %d)", cacheKey, arg, truncate(result), c.size)
+	if c.logging() {
+		c.logf("Cache: STORE   %s %+v: error %s", cacheKey, arg, callErr)
 	}
 	return nil
 }
 
+// delete removes the item stored under cacheKey, if any. Errors are
+// logged (see logStorageError).
+func (c *Cache) delete(cacheKey string) {
+	if err := c.storage().Delete(cacheKey); err != nil {
+		c.logStorageError("Delete", cacheKey, err)
+	}
+}
+
+// logStorageError logs an error returned by the Storage's op method.
+// Storage errors are not returned from the cache's lookups and
+// stores, so that an unavailable Storage degrades to uncached calls
+// instead of failing them.
+func (c *Cache) logStorageError(op, cacheKey string, err error) {
+	if c.logging() {
+		c.logf("Cache: STORAGE %s %s: %s", op, cacheKey, err)
+	}
+}
+
 func truncate(v proto.Message) string {
 	s := fmt.Sprint(v)
 	if len(s) > 35 {
@@ -172,48 +990,353 @@ func truncate(v proto.Message) string {
 	return s
 }
 
-// Clear removes all items from the cache.
+// Clear removes all items from the cache. For the default in-memory
+// storage, it is equivalent to ClearFunc(func(string) bool { return
+// false }).
 func (c *Cache) Clear() {
-	c.mu.Lock()
-	c.results = map[string]cacheEntry{}
-	c.size = 0
-	c.mu.Unlock()
+	if err := c.storage().Clear(); err != nil && c.logging() {
+		c.logf("Cache: CLEAR failed: %s", err)
+	}
+}
+
+// ClearFunc removes all items from the cache except those whose keys
+// keep returns true for (e.g., results that are known to still be
+// valid). It returns the number of items removed. It only supports
+// the default in-memory storage; if c uses a custom Storage, it does
+// nothing and returns 0.
+func (c *Cache) ClearFunc(keep func(key string) bool) int {
+	if c.Storage != nil {
+		return 0
+	}
+	n := c.memoryStorage().removeFunc(func(key string) bool {
+		return !keep(key)
+	}, EvictInvalidated)
+	if c.logging() {
+		c.logf("Cache: CLEAR   %d results", n)
+	}
+	return n
+}
+
+// Resize sets MaxSize to maxSize (0 means no limit). It may be called
+// while the cache is in use (e.g., to shrink the cache under memory
+// pressure). With the default in-memory storage, it immediately
+// evicts items (as Store would) until the cache fits within the new
+// limit.
+func (c *Cache) Resize(maxSize uint64) {
+	atomic.StoreUint64(&c.MaxSize, maxSize)
+	if c.logging() {
+		c.logf("Cache: RESIZE  %d bytes", maxSize)
+	}
+	if c.Storage == nil {
+		c.memoryStorage().shrink()
+	}
+}
+
+// maxSize returns c.MaxSize.
+func (c *Cache) maxSize() uint64 {
+	return atomic.LoadUint64(&c.MaxSize)
+}
+
+// Invalidate removes the cached result (if any) for a gRPC method
+// call with the given method and arg. It is useful when the client
+// knows that a cached result is stale (e.g., after a mutation). It
+// returns whether a cached result was removed.
+func (c *Cache) Invalidate(ctx context.Context, method string, arg proto.Message) (removed bool, err error) {
+	cacheKey, err := c.cacheKey(ctx, method, arg)
+	if err != nil {
+		return false, err
+	}
+
+	storage := c.storage()
+	if _, _, _, present, err := storage.Get(cacheKey); err != nil || !present {
+		return false, err
+	}
+	if err := storage.Delete(cacheKey); err != nil {
+		return false, err
+	}
+	if c.logging() {
+		c.logf("Cache: INVALIDATE %s %s", cacheKey, truncate(arg))
+	}
+	c.onEvict(cacheKey, EvictInvalidated)
+	return true, nil
+}
+
+// Touch extends the lifetime of the cached result (or error) for a
+// call to method with arg by extend, without calling the server. It
+// is useful when the caller knows by other means that the result is
+// still valid (e.g., in a background refresher). The new expiry is
+// capped by MaxAgeCap (measured from now). Touch returns whether a
+// cached result was found.
+func (c *Cache) Touch(ctx context.Context, method string, arg proto.Message, extend time.Duration) (touched bool, err error) {
+	cacheKey, err := c.cacheKey(ctx, method, arg)
+	if err != nil {
+		return false, err
+	}
+
+	storage := c.storage()
+	data, cc, expiry, present, err := storage.Get(cacheKey)
+	if err != nil || !present {
+		return false, err
+	}
+	if cc.Immutable && c.MaxAgeCap == 0 {
+		return true, nil // it never expires anyway
+	}
+	expiry = expiry.Add(extend)
+	if c.MaxAgeCap != 0 {
+		// The stored expiry includes the StaleWhileRevalidate window.
+		if max := c.timeNow().Add(c.MaxAgeCap + cc.StaleWhileRevalidate); expiry.After(max) {
+			expiry = max
+		}
+	}
+	if err := storage.Set(cacheKey, data, cc, expiry); err != nil {
+		return false, err
+	}
+	if c.logging() {
+		c.logf("Cache: TOUCH   %s %s (expires %s)", cacheKey, truncate(arg), expiry)
+	}
+	return true, nil
+}
+
+// InvalidateMethod removes all cached results for calls to method,
+// regardless of their arguments. It returns the number of results
+// removed. It only supports the default in-memory storage; if c uses
+// a custom Storage, it does nothing and returns 0.
+func (c *Cache) InvalidateMethod(method string) int {
+	if c.Storage != nil {
+		return 0
+	}
+	prefix := c.namespacePrefix() + method + methodSep
+	n := c.memoryStorage().removeFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}, EvictInvalidated)
+	if c.logging() {
+		c.logf("Cache: INVALIDATE %s (%d results)", method, n)
+	}
+	return n
+}
+
+// Len returns the number of items in the cache. It may include items
+// that have expired but have not yet been removed (by Get or the
+// janitor). If c uses a custom Storage, Len returns 0.
+func (c *Cache) Len() int {
+	if c.Storage != nil {
+		return 0
+	}
+	return c.memoryStorage().len()
 }
 
-// NoCache causes all calls made with the returned ctx to bypass the
-// cache. The result will not be retrieved from nor stored in the
+// SizeBytes returns the current size of the cache, in bytes (the
+// quantity that is limited by MaxSize). It includes each item's key
+// and EntryOverhead as well as its data. If c uses a custom Storage,
+// SizeBytes returns 0.
+func (c *Cache) SizeBytes() uint64 {
+	if c.Storage != nil {
+		return 0
+	}
+	return c.memoryStorage().sizeBytes()
+}
+
+// ForEach calls fn for each item in the cache, in order from most to
+// least recently used, until fn returns false. It is intended for
+// debugging. The size passed to fn is the number of bytes the item
+// counts toward SizeBytes. The items are those in a snapshot taken
+// when ForEach is called, so fn may safely call other methods on c.
+// Expired items that have not yet been removed are included. If c
+// uses a custom Storage, ForEach does nothing.
+func (c *Cache) ForEach(fn func(key string, size int, cc CacheControl, expiry time.Time) bool) {
+	if c.Storage != nil {
+		return
+	}
+	for _, e := range c.memoryStorage().snapshot() {
+		if !fn(e.key, int(e.size()), e.cc, e.expiry) {
+			break
+		}
+	}
+}
+
+// WithNoCache causes all calls made with the returned ctx to bypass
+// the cache. The result will not be retrieved from nor stored in the
 // cache.
 //
 // TODO(sqs): propagate NoCache to the server for aggregate
 // operations.
-func NoCache(ctx context.Context) context.Context {
+func WithNoCache(ctx context.Context) context.Context {
 	return context.WithValue(ctx, noCacheKey, struct{}{})
 }
 
+// NoCache is the same as WithNoCache.
+func NoCache(ctx context.Context) context.Context {
+	return WithNoCache(ctx)
+}
+
 func getNoCache(ctx context.Context) bool {
 	_, ok := ctx.Value(noCacheKey).(struct{})
 	return ok
 }
 
+// WithCache causes all calls made with the returned ctx via a
+// CachedXyzClient wrapper (or UnaryClientInterceptor) to use c instead
+// of the wrapper's own cache. It lets one client serve callers that
+// need separate caches (e.g., one per tenant). If c is nil, the calls
+// are not cached.
+func WithCache(ctx context.Context, c *Cache) context.Context {
+	return context.WithValue(ctx, cacheOverrideKey, c)
+}
+
+// Internal_CacheFromContext is an internal func called by the
+// code-genned CachedXyzClient wrapper methods. It should not be
+// called by user code. It returns the cache set in ctx by WithCache,
+// if any, or else c (the wrapper's cache).
+func Internal_CacheFromContext(ctx context.Context, c *Cache) *Cache {
+	if override, ok := ctx.Value(cacheOverrideKey).(*Cache); ok {
+		return override
+	}
+	return c
+}
+
+// WithForceRefresh causes all calls made with the returned ctx to skip
+// any cached result and make the call, but (unlike WithNoCache) still
+// store the fresh result in the cache, replacing the cached result.
+// Results whose CacheControl is Immutable are not skipped.
+func WithForceRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceRefreshKey, struct{}{})
+}
+
+func getForceRefresh(ctx context.Context) bool {
+	_, ok := ctx.Value(forceRefreshKey).(struct{})
+	return ok
+}
+
+// Consistency is the consistency required of the results of calls
+// (see WithConsistency).
+type Consistency int
+
+const (
+	// Eventual consistency allows cached results (which may not
+	// reflect recent writes). It is the default.
+	Eventual Consistency = iota
+
+	// Strong consistency requires results that reflect all writes
+	// made before the call, so cached results are not used.
+	Strong
+)
+
+// WithConsistency causes all calls made with the returned ctx to
+// return results with the given consistency. With Strong consistency,
+// calls skip any cached result and any in-flight call for the same
+// result (see SingleFlight), which may have begun before a write that
+// the caller needs to see. The fresh result is still stored in the
+// cache (as with WithForceRefresh), for later calls with Eventual
+// consistency.
+//
+// For example, to read your own writes, make the reads that must see
+// them with Strong consistency, and other reads with Eventual
+// consistency. (Alternatively, Invalidate the affected results after
+// a write.)
+func WithConsistency(ctx context.Context, consistency Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey, consistency)
+}
+
+func getConsistency(ctx context.Context) Consistency {
+	consistency, _ := ctx.Value(consistencyKey).(Consistency)
+	return consistency
+}
+
+// WithTrailer causes calls made with the returned ctx to set *md to
+// the response trailer. If the result is served from the cache, *md
+// is set to the trailer values that were preserved with it (see
+// Cache.PreserveTrailers). It is an alternative to the grpc.Trailer
+// call option, which has no effect when the call is not made.
+//
+// If the call is shared with a concurrent caller (see SingleFlight),
+// *md is only set for the caller that made the call.
+func WithTrailer(ctx context.Context, md *metadata.MD) context.Context {
+	return context.WithValue(ctx, trailerKey, md)
+}
+
+// setTrailer sets the trailer requested by WithTrailer (if any) to
+// md.
+func setTrailer(ctx context.Context, md metadata.MD) {
+	if p, _ := ctx.Value(trailerKey).(*metadata.MD); p != nil {
+		*p = md
+	}
+}
+
+// WithMinFresh causes calls made with the returned ctx to only use
+// cached results that will remain fresh for at least d (like the HTTP
+// Cache-Control min-fresh directive). Other cached results are
+// treated as misses. The duration is also sent to the server as a
+// hint (see CacheControlFromContext).
+func WithMinFresh(ctx context.Context, d time.Duration) context.Context {
+	ctx = withRequestMetadata(ctx, "min-fresh", d.String())
+	return context.WithValue(ctx, minFreshKey, d)
+}
+
+func getMinFresh(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(minFreshKey).(time.Duration)
+	return d
+}
+
+// WithFreshnessBudget causes calls made with the returned ctx to only
+// use cached results that were stored at most budget ago, even if
+// they are still fresh according to their MaxAge. Other cached results
+// are treated as misses (and the calls are made and their results
+// stored as usual). It is useful for a freshness-sensitive request
+// that fans out into many cached calls. The budget is also sent to
+// the server as a hint (see CacheControlFromContext).
+//
+// It has no effect on GetIfError, which returns expired results
+// regardless.
+func WithFreshnessBudget(ctx context.Context, budget time.Duration) context.Context {
+	ctx = withRequestMetadata(ctx, "max-age", budget.String())
+	return context.WithValue(ctx, freshnessBudgetKey, budget)
+}
+
+func getFreshnessBudget(ctx context.Context) (budget time.Duration, ok bool) {
+	budget, ok = ctx.Value(freshnessBudgetKey).(time.Duration)
+	return budget, ok
+}
+
 type contextKey int
 
 const (
 	noCacheKey contextKey = iota
 	cacheControlKey
+	minFreshKey
+	forceRefreshKey
+	consistencyKey
+	trailerKey
+	freshnessBudgetKey
+	cacheOverrideKey
+	revalidatedKey
 )
 
-var codec gzipProtoCodec
-
-type gzipProtoCodec struct{}
+// gzipProtoCodec marshals values using m and gzips the result if it
+// is at least MinByteGzip bytes (or always, if compress is true). A
+// trailing byte records whether the data is gzipped, so Unmarshal
+// works regardless of how the data was marshaled.
+type gzipProtoCodec struct {
+	m        Marshaler
+	compress bool
+}
 
+// MinByteGzip is the minimum size, in bytes, of a marshaled result
+// that is gzipped before it is stored (unless Cache.Compress is set,
+// in which case all results are gzipped).
 var MinByteGzip = 1000
 
-func (gzipProtoCodec) Marshal(v proto.Message) ([]byte, error) {
-	data, err := proto.Marshal(v.(proto.Message))
+func (cd gzipProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	var err error
+	if r, ok := v.(*StreamResults); ok {
+		data, err = marshalStreamResults(cd.m, r)
+	} else {
+		data, err = cd.m.Marshal(v)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if len(data) < MinByteGzip {
+	if !cd.compress && len(data) < MinByteGzip {
 		return append(data, '0'), nil
 	}
 	var buf bytes.Buffer
@@ -227,7 +1350,10 @@ func (gzipProtoCodec) Marshal(v proto.Message) ([]byte, error) {
 	return append(buf.Bytes(), '1'), nil
 }
 
-func (gzipProtoCodec) Unmarshal(data []byte, v interface{}) error {
+func (cd gzipProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return errors.New("grpccache: empty cached data")
+	}
 	data, isGzipped := data[:len(data)-1], data[len(data)-1]
 	if isGzipped == '1' {
 		r, err := gzip.NewReader(bytes.NewReader(data))
@@ -239,15 +1365,37 @@ func (gzipProtoCodec) Unmarshal(data []byte, v interface{}) error {
 			return err
 		}
 	}
-	return proto.Unmarshal(data, v.(proto.Message))
+	if r, ok := v.(*StreamResults); ok {
+		return unmarshalStreamResults(cd.m, data, r)
+	}
+	return cd.m.Unmarshal(data, v)
 }
 
+// protoCodec is the default Marshaler. It uses the
+// github.com/gogo/protobuf/proto package, except for messages
+// generated by google.golang.org/protobuf's protoc-gen-go (which
+// gogo/protobuf can't marshal), for which it uses the
+// google.golang.org/protobuf/proto package.
+//
+// Marshaling is deterministic (map fields are sorted by key) so that
+// equal args always produce the same cache key.
 type protoCodec struct{}
 
-func (protoCodec) Marshal(v proto.Message) ([]byte, error) {
-	return proto.Marshal(v.(proto.Message))
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(protov2.Message); ok {
+		return protov2.MarshalOptions{Deterministic: true}.Marshal(m)
+	}
+	var buf proto.Buffer
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(v.(proto.Message)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(protov2.Message); ok {
+		return protov2.Unmarshal(data, m)
+	}
 	return proto.Unmarshal(data, v.(proto.Message))
 }
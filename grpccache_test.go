@@ -1,18 +1,27 @@
 package grpccache_test
 
 import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
 	"net"
 	"reflect"
 	"testing"
 	"time"
 
 	"strconv"
+	"strings"
+	"sync"
 
 	"sourcegraph.com/sqs/grpccache"
 	"sourcegraph.com/sqs/grpccache/testpb"
 
+	"github.com/gogo/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 func TestGRPCCache(t *testing.T) {
@@ -35,8 +44,10 @@ func TestGRPCCache(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	clock := &fakeClock{t: time.Now()}
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{})
 	c.Cache.Log = true
+	grpccache.SetNow(c.Cache, clock.Now)
 
 	ctx := context.Background()
 
@@ -94,12 +105,12 @@ func TestGRPCCache(t *testing.T) {
 	testNotCached(&testpb.TestOp{A: 3}, nil)
 
 	// Test cache expiration
-	ts.maxAge = time.Millisecond * 250
+	ts.maxAge = time.Minute
 	testNotCached(&testpb.TestOp{A: 100}, nil)
 	testCached(&testpb.TestOp{A: 100}, nil)
 	testCached(&testpb.TestOp{A: 100}, nil)
 	testNotCached(&testpb.TestOp{A: 111}, nil)
-	time.Sleep(ts.maxAge)
+	clock.Advance(ts.maxAge + time.Nanosecond)
 	testNotCached(&testpb.TestOp{A: 100}, nil)
 	testNotCached(&testpb.TestOp{A: 111}, nil)
 	testCached(&testpb.TestOp{A: 100}, nil)
@@ -107,14 +118,16 @@ func TestGRPCCache(t *testing.T) {
 
 	c.Cache.Clear()
 
-	// Test cache max size
-	c.Cache.MaxSize = 8
+	// Test cache max size (least recently used entries are evicted)
+	c.Cache.MaxSize = 2 * entrySize("Test.TestMethod", 4)
 	testNotCached(&testpb.TestOp{A: 200}, nil)
 	testCached(&testpb.TestOp{A: 200}, nil)
 	testNotCached(&testpb.TestOp{A: 201}, nil)
 	testCached(&testpb.TestOp{A: 201}, nil)
-	testNotCached(&testpb.TestOp{A: 202}, nil) // exceeds max size
-	testNotCached(&testpb.TestOp{A: 202}, nil)
+	testNotCached(&testpb.TestOp{A: 202}, nil) // exceeds max size, evicts 200
+	testCached(&testpb.TestOp{A: 202}, nil)
+	testCached(&testpb.TestOp{A: 201}, nil)
+	testNotCached(&testpb.TestOp{A: 200}, nil) // evicts 202
 	c.Cache.MaxSize = 0
 	testNotCached(&testpb.TestOp{A: 202}, nil)
 	testCached(&testpb.TestOp{A: 202}, nil)
@@ -141,30 +154,1695 @@ func TestGRPCCache(t *testing.T) {
 	// Test NoCache
 	testNotCached(&testpb.TestOp{A: 500}, grpccache.NoCache)
 	testNotCached(&testpb.TestOp{A: 500}, grpccache.NoCache)
+
+	// Test WithNoCache (skips Get and Store)
+	testNotCached(&testpb.TestOp{A: 600}, grpccache.WithNoCache)
+	testNotCached(&testpb.TestOp{A: 600}, nil)
+	testCached(&testpb.TestOp{A: 600}, nil)
+	testNotCached(&testpb.TestOp{A: 600}, grpccache.WithNoCache)
+	testCached(&testpb.TestOp{A: 600}, nil)
+
+	// Test WithForceRefresh (skips Get but replaces the cached
+	// result, so it expires later)
+	testNotCached(&testpb.TestOp{A: 700}, nil)
+	testCached(&testpb.TestOp{A: 700}, nil)
+	clock.Advance(ts.maxAge / 2)
+	testNotCached(&testpb.TestOp{A: 700}, grpccache.WithForceRefresh)
+	testNotCached(&testpb.TestOp{A: 700}, grpccache.WithForceRefresh)
+	clock.Advance(ts.maxAge/2 + time.Second)
+	testCached(&testpb.TestOp{A: 700}, nil)
 }
 
-type testServer struct {
-	calls []*testpb.TestOp
+// fakeClock is a clock that only advances when told to.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
 
-	maxAge time.Duration
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
 }
 
-func (s *testServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
-	s.calls = append(s.calls, op)
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
 
-	{
-		// Only the last call to SetCacheControl should take effect. Make
-		// a call here that will be overridden by the following call, to
-		// ensure that that indeed is the case.
-		otherMaxAge := time.Duration(0)
-		if s.maxAge == 0 {
-			otherMaxAge = 5 * time.Second
+// newTestClient starts a gRPC server for srv and returns a client
+// connection to it (dialed with opts). The caller must call the
+// returned func to stop the server.
+func newTestClient(t *testing.T, srv testpb.TestServer, opts ...grpc.DialOption) (*grpc.ClientConn, func()) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	testpb.RegisterTestServer(gs, &testpb.CachedTestServer{TestServer: srv})
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			t.Log("warning: Serve:", err)
 		}
-		grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: otherMaxAge})
+	}()
+	cc, err := grpc.Dial(l.Addr().String(), opts...)
+	if err != nil {
+		gs.Stop()
+		t.Fatal(err)
 	}
+	return cc, func() {
+		cc.Close()
+		gs.Stop()
+	}
+}
 
-	// Set cache control.
-	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: s.maxAge})
+// notFoundServer is a testpb.TestServer that returns a cacheable
+// NotFound error for all calls.
+type notFoundServer struct {
+	calls int
+}
 
-	return &testpb.TestResult{X: op.A}, nil
+func (s *notFoundServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls++
+	grpccache.SetCacheControlError(ctx, grpccache.CacheControl{MaxAge: time.Hour}, codes.NotFound)
+	return nil, grpc.Errorf(codes.NotFound, "no such op %d", op.A)
+}
+
+func TestGRPCCache_Error(t *testing.T) {
+	var ts notFoundServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1})
+		if grpc.Code(err) != codes.NotFound {
+			t.Errorf("call %d: got error %v, want NotFound", i, err)
+		}
+		if want := "no such op 1"; grpc.ErrorDesc(err) != want {
+			t.Errorf("call %d: got error desc %q, want %q", i, grpc.ErrorDesc(err), want)
+		}
+	}
+	if want := 1; ts.calls != want {
+		t.Errorf("got %d server calls, want %d (the error should have been cached)", ts.calls, want)
+	}
+
+	// Errors with other codes are not cached.
+	if err := c.Cache.StoreError(context.Background(), "Test.TestMethod", &testpb.TestOp{A: 2}, grpc.Errorf(codes.Internal, "x"), metadata.MD{
+		"grpccache-max-age":    time.Hour.String(),
+		"grpccache-error-code": "5", // NotFound
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Cache.Len(), 1; got != want {
+		t.Errorf("got %d entries, want %d (an error with a code other than the allowed one was cached)", got, want)
+	}
+}
+
+func TestCache_Set(t *testing.T) {
+	c := &grpccache.Cache{MaxEntries: 1}
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if !isCached(t, c, 1) {
+		t.Error("A=1 not cached after Set")
+	}
+
+	// Set respects MaxEntries.
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(t, c, 1) {
+		t.Error("A=1 still cached, want it evicted")
+	}
+	if !isCached(t, c, 2) {
+		t.Error("A=2 not cached after Set")
+	}
+
+	// Uncacheable results are not stored.
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 3}, &testpb.TestResult{X: 3}, grpccache.CacheControl{}); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(t, c, 3) {
+		t.Error("A=3 cached, want zero MaxAge result not stored")
+	}
+}
+
+func TestCache_WithConsistency(t *testing.T) {
+	var ts versionServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{SingleFlight: true})
+
+	read := func(consistency grpccache.Consistency, wantX int32, wantCalls int) {
+		r, err := c.TestMethod(grpccache.WithConsistency(context.Background(), consistency), &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		if r.X != wantX {
+			t.Errorf("consistency %d: got version %d, want %d", consistency, r.X, wantX)
+		}
+		if ts.calls != wantCalls {
+			t.Errorf("consistency %d: got %d server calls, want %d", consistency, ts.calls, wantCalls)
+		}
+	}
+
+	read(grpccache.Eventual, 0, 1)
+	read(grpccache.Eventual, 0, 1)
+
+	// Write.
+	ts.mu.Lock()
+	ts.version = 1
+	ts.mu.Unlock()
+
+	read(grpccache.Eventual, 0, 1) // stale cached result
+	read(grpccache.Strong, 1, 2)   // bypasses the cache
+	read(grpccache.Eventual, 1, 2) // result of the Strong read was cached
+}
+
+func TestCache_Store_nilResult(t *testing.T) {
+	c := &grpccache.Cache{}
+	ctx := context.Background()
+
+	for _, result := range []proto.Message{nil, (*testpb.TestResult)(nil)} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, result, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, result, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if isCached(t, c, 1) {
+			t.Errorf("%#v result cached, want it not stored", result)
+		}
+	}
+}
+
+func TestCachedClient_nilResult(t *testing.T) {
+	var tc nilResultClient
+	c := &testpb.CachedTestClient{TestClient: &tc, Cache: &grpccache.Cache{DefaultMaxAge: time.Hour}}
+	ctx := context.Background()
+
+	for i := 1; i <= 2; i++ {
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != nil {
+			t.Errorf("got result %#v, want nil", r)
+		}
+		if tc.calls != i {
+			t.Errorf("got %d calls, want %d (nil result was cached)", tc.calls, i)
+		}
+	}
+	if got := c.Cache.Len(); got != 0 {
+		t.Errorf("got %d entries, want 0", got)
+	}
+}
+
+func TestCachedClient_nilCache(t *testing.T) {
+	ts := rateLimitServer{remaining: 100}
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := testpb.NewCachedTestClient(cc, nil)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		var trailer metadata.MD
+		if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}, grpc.Trailer(&trailer)); err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(99 - i); trailer["ratelimit-remaining"] != want {
+			t.Errorf("call %d: got trailer %v, want ratelimit-remaining %s (call made, with the caller's options)", i, trailer, want)
+		}
+	}
+
+	// The caller's options are passed through unchanged.
+	var oc optsClient
+	c2 := &testpb.CachedTestClient{TestClient: &oc}
+	if _, err := c2.TestMethod(ctx, &testpb.TestOp{A: 1}, grpc.Trailer(new(metadata.MD))); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1}; !reflect.DeepEqual(oc.numOpts, want) {
+		t.Errorf("got numbers of call options %v, want %v", oc.numOpts, want)
+	}
+}
+
+func TestCache_GetWithControl(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	var result testpb.TestResult
+	if cached, _, _, err := c.GetWithControl(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result); err != nil {
+		t.Fatal(err)
+	} else if cached {
+		t.Fatal("got cached before Store")
+	}
+
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour, StaleWhileRevalidate: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	for _, elapsed := range []time.Duration{0, 20 * time.Minute, 40 * time.Minute} {
+		cached, cc, remaining, err := c.GetWithControl(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached {
+			t.Fatalf("after %s: not cached", elapsed)
+		}
+		if cc.MaxAge != time.Hour {
+			t.Errorf("after %s: got MaxAge %s, want %s", elapsed, cc.MaxAge, time.Hour)
+		}
+		if want := time.Hour - elapsed; remaining != want {
+			t.Errorf("after %s: got remaining %s, want %s", elapsed, remaining, want)
+		}
+		clock.Advance(20 * time.Minute)
+	}
+}
+
+func TestCache_DefaultMaxAge(t *testing.T) {
+	tests := map[string]struct {
+		trailer    metadata.MD
+		wantCached bool
+		wantExpiry time.Duration
+	}{
+		"no cache control": {
+			trailer:    nil,
+			wantCached: true,
+			wantExpiry: time.Minute,
+		},
+		"explicit MaxAge": {
+			trailer:    maxAgeTrailer(time.Hour),
+			wantCached: true,
+			wantExpiry: time.Hour,
+		},
+		"explicit NoStore": {
+			trailer:    grpccache.CacheControlMetadata(grpccache.CacheControl{NoStore: true}),
+			wantCached: false,
+		},
+	}
+	for label, test := range tests {
+		clock := &fakeClock{t: time.Now()}
+		c := &grpccache.Cache{DefaultMaxAge: time.Minute}
+		grpccache.SetNow(c, clock.Now)
+		ctx := context.Background()
+
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, test.trailer); err != nil {
+			t.Fatal(err)
+		}
+		if cached := isCached(t, c, 1); cached != test.wantCached {
+			t.Errorf("%s: got cached %v, want %v", label, cached, test.wantCached)
+			continue
+		}
+		if test.wantCached {
+			c.ForEach(func(_ string, _ int, _ grpccache.CacheControl, expiry time.Time) bool {
+				if want := clock.Now().Add(test.wantExpiry); !expiry.Equal(want) {
+					t.Errorf("%s: got expiry %s, want %s", label, expiry, want)
+				}
+				return true
+			})
+		}
+	}
+}
+
+func TestCache_MaxAgeCap(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{MaxAgeCap: time.Hour}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	for a, maxAge := range map[int32]time.Duration{1: 999 * time.Hour, 2: time.Minute} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(maxAge)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Advance(59 * time.Minute)
+	if !isCached(t, c, 1) {
+		t.Error("A=1 not cached before the cap")
+	}
+	if isCached(t, c, 2) {
+		t.Error("A=2 cached after its (uncapped) MaxAge")
+	}
+	clock.Advance(2 * time.Minute)
+	if isCached(t, c, 1) {
+		t.Error("A=1 cached after the cap, want its 999h MaxAge capped")
+	}
+}
+
+func TestCache_ExpiryJitter(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	const (
+		maxAge = time.Hour
+		jitter = 10 * time.Minute
+		n      = 100
+	)
+	c := &grpccache.Cache{ExpiryJitter: jitter}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	for a := int32(0); a < n; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(maxAge)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := clock.Now()
+	expiries := map[time.Time]struct{}{}
+	c.ForEach(func(key string, size int, cc grpccache.CacheControl, expiry time.Time) bool {
+		if ttl := expiry.Sub(start); ttl < maxAge-jitter || ttl > maxAge+jitter {
+			t.Errorf("got TTL %s, want it within %s of %s", ttl, jitter, maxAge)
+		}
+		expiries[expiry] = struct{}{}
+		return true
+	})
+	if len(expiries) < n/2 {
+		t.Errorf("got only %d distinct expiries for %d items, want them to be spread out", len(expiries), n)
+	}
+
+	clock.Advance(maxAge - jitter - time.Second)
+	for a := int32(0); a < n; a++ {
+		if !isCached(t, c, a) {
+			t.Errorf("%d not cached before its earliest possible expiry", a)
+		}
+	}
+	clock.Advance(2*jitter + 2*time.Second)
+	for a := int32(0); a < n; a++ {
+		if isCached(t, c, a) {
+			t.Errorf("%d cached after its latest possible expiry", a)
+		}
+	}
+}
+
+func TestCache_WithMinFresh(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour, StaleWhileRevalidate: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(50 * time.Minute) // 10m of freshness remains
+
+	tests := map[time.Duration]bool{
+		9 * time.Minute:                  true,
+		10 * time.Minute:                 true,
+		10*time.Minute + time.Nanosecond: false,
+	}
+	for minFresh, wantCached := range tests {
+		ctx := grpccache.WithMinFresh(ctx, minFresh)
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != wantCached {
+			t.Errorf("min fresh %s: got Get cached %v, want %v", minFresh, cached, wantCached)
+		}
+
+		// A result that is not fresh enough is not returned even if
+		// stale results are allowed.
+		cached, revalidate, err := c.GetStale(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != wantCached || revalidate {
+			t.Errorf("min fresh %s: got GetStale (cached %v, revalidate %v), want (%v, false)", minFresh, cached, revalidate, wantCached)
+		}
+	}
+}
+
+func TestCache_GetWithOutcome(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	check := func(label string, want grpccache.GetOutcome) {
+		var result testpb.TestResult
+		outcome, err := c.GetWithOutcome(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome != want {
+			t.Errorf("%s: got outcome %s, want %s", label, outcome, want)
+		}
+		if outcome.Hit() && result.X != 1 {
+			t.Errorf("%s: got result %d, want 1", label, result.X)
+		}
+	}
+
+	check("before Set", grpccache.ColdMiss)
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour, StaleWhileRevalidate: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	check("fresh", grpccache.FreshHit)
+	clock.Advance(90 * time.Minute)
+	check("stale", grpccache.StaleHit)
+	clock.Advance(time.Hour)
+	check("expired", grpccache.ExpiredMiss)
+	check("after expired", grpccache.ColdMiss) // the expired item was removed
+}
+
+func TestCache_WithFreshnessBudget(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Minute) // stored 10m ago, still fresh
+
+	tests := map[time.Duration]bool{
+		time.Hour:                        true,
+		10 * time.Minute:                 true,
+		10*time.Minute - time.Nanosecond: false,
+		0:                                false,
+	}
+	for budget, wantCached := range tests {
+		ctx := grpccache.WithFreshnessBudget(ctx, budget)
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != wantCached {
+			t.Errorf("freshness budget %s: got Get cached %v, want %v", budget, cached, wantCached)
+		}
+	}
+
+	// The budget only applies to calls made with its ctx.
+	if !isCached(t, c, 1) {
+		t.Error("1 not cached without a freshness budget, want it cached")
+	}
+
+	// Storing the result again restarts its age.
+	if err := c.Set(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, grpccache.CacheControl{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	var result testpb.TestResult
+	if cached, err := c.Get(grpccache.WithFreshnessBudget(ctx, time.Minute), "Test.TestMethod", &testpb.TestOp{A: 1}, &result); err != nil {
+		t.Fatal(err)
+	} else if !cached {
+		t.Error("got Get cached false for a newly stored result, want true")
+	}
+}
+
+func TestCache_MaxStale(t *testing.T) {
+	var ts flakyServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	clock := &fakeClock{t: time.Now()}
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{MaxStale: time.Hour}}
+	grpccache.SetNow(c.Cache, clock.Now)
+	ctx := context.Background()
+
+	if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute) // expired (MaxAge is 1m)
+	if isCached(t, c.Cache, 1) {
+		t.Fatal("expired result returned by Get")
+	}
+
+	// Return the expired result if the server is unavailable.
+	ts.setFail(true, nil)
+	r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.X != 1 {
+		t.Errorf("got X == %d, want 1", r.X)
+	}
+
+	// But not if the server returned an error result.
+	ts.setFail(true, grpc.Errorf(codes.NotFound, "not found"))
+	if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got error %v, want NotFound", err)
+	}
+
+	// Or if the result expired more than MaxStale ago.
+	ts.setFail(true, nil)
+	clock.Advance(time.Hour)
+	if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got error %v, want Unavailable", err)
+	}
+}
+
+func TestCache_LRU(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{MaxSize: 3 * entrySize("Test.TestMethod", 4)} // each result below is 4 bytes
+
+	for _, a := range []int32{200, 201, 202} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Access 200 so that 201 becomes the least recently used.
+	if !isCached(t, c, 200) {
+		t.Fatal("200 not cached")
+	}
+
+	// Storing 203 evicts 201.
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 203}, &testpb.TestResult{X: 203}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for a, want := range map[int32]bool{200: true, 201: false, 202: true, 203: true} {
+		if cached := isCached(t, c, a); cached != want {
+			t.Errorf("%d: got cached %v, want %v", a, cached, want)
+		}
+	}
+
+	// An item larger than MaxSize is not stored and does not evict
+	// anything.
+	c.MaxSize = 3
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 204}, &testpb.TestResult{X: 204}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(t, c, 204) {
+		t.Error("204 cached, want it to be too large to store")
+	}
+}
+
+func TestCache_Resize(t *testing.T) {
+	ctx := context.Background()
+	var evicted []string
+	c := &grpccache.Cache{
+		MaxSize: 4 * entrySize("Test.TestMethod", 4), // each result below is 4 bytes
+		OnEvict: func(key string, reason grpccache.EvictReason) {
+			if reason != grpccache.EvictSize {
+				t.Errorf("got reason %v, want %v", reason, grpccache.EvictSize)
+			}
+			evicted = append(evicted, key)
+		},
+	}
+	for _, a := range []int32{200, 201, 202, 203} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(evicted) != 0 {
+		t.Fatalf("got %d evicted before Resize, want 0", len(evicted))
+	}
+
+	// Access 200 so that 201 and 202 are the least recently used.
+	if !isCached(t, c, 200) {
+		t.Fatal("200 not cached")
+	}
+
+	maxSize := 2*entrySize("Test.TestMethod", 4) + 1
+	c.Resize(maxSize)
+	if got := c.SizeBytes(); got > maxSize {
+		t.Errorf("got size %d, want <= %d", got, maxSize)
+	}
+	if got, want := c.MaxSize, maxSize; got != want {
+		t.Errorf("got MaxSize %d, want %d", got, want)
+	}
+	if len(evicted) != 2 {
+		t.Errorf("got %d evicted, want 2", len(evicted))
+	}
+	for a, want := range map[int32]bool{200: true, 201: false, 202: false, 203: true} {
+		if cached := isCached(t, c, a); cached != want {
+			t.Errorf("%d: got cached %v, want %v", a, cached, want)
+		}
+	}
+
+	// Growing the cache evicts nothing.
+	c.Resize(0)
+	if got, want := c.Len(), 2; got != want {
+		t.Errorf("after growing: got %d entries, want %d", got, want)
+	}
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	ctx := context.Background()
+	const n = 3
+	c := &grpccache.Cache{MaxEntries: n}
+
+	for a := int32(0); a < n+1; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.Len(); got != n {
+		t.Errorf("got %d entries, want %d", got, n)
+	}
+	if isCached(t, c, 0) {
+		t.Error("0 cached, want it to have been evicted")
+	}
+	for a := int32(1); a < n+1; a++ {
+		if !isCached(t, c, a) {
+			t.Errorf("%d not cached", a)
+		}
+	}
+
+	c.Clear()
+	if got := c.Len(); got != 0 {
+		t.Errorf("after Clear: got %d entries, want 0", got)
+	}
+}
+
+func TestCache_Shards(t *testing.T) {
+	ctx := context.Background()
+	const n = 20
+	c := &grpccache.Cache{Shards: 4, MaxEntries: n, MaxSize: (n + 5) * entrySize("Test.TestMethod", 4)}
+
+	for a := int32(0); a < 2*n; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1000 + a}, &testpb.TestResult{X: 1000 + a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if c.Len() > n {
+			t.Fatalf("after storing %d: got %d entries, want at most %d", a, c.Len(), n)
+		}
+		if c.SizeBytes() > c.MaxSize {
+			t.Fatalf("after storing %d: got size %d, want at most %d", a, c.SizeBytes(), c.MaxSize)
+		}
+	}
+	if got := c.Len(); got != n {
+		t.Errorf("got %d entries, want %d", got, n)
+	}
+	if got, want := c.SizeBytes(), n*entrySize("Test.TestMethod", 4); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+	if !isCached(t, c, 1000+2*n-1) {
+		t.Error("most recently stored item not cached")
+	}
+
+	var forEach int
+	c.ForEach(func(string, int, grpccache.CacheControl, time.Time) bool {
+		forEach++
+		return true
+	})
+	if forEach != n {
+		t.Errorf("got %d items from ForEach, want %d", forEach, n)
+	}
+
+	if got := c.InvalidateMethod("Test.TestMethod"); got != n {
+		t.Errorf("got %d invalidated, want %d", got, n)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("after InvalidateMethod: got %d entries, want 0", got)
+	}
+
+	for a := int32(0); a < n; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1000 + a}, &testpb.TestResult{X: 1000 + a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Clear()
+	if got := c.Len(); got != 0 {
+		t.Errorf("after Clear: got %d entries, want 0", got)
+	}
+	if got := c.SizeBytes(); got != 0 {
+		t.Errorf("after Clear: got size %d, want 0", got)
+	}
+}
+
+// Storing an item that is larger than MaxSize over an existing key
+// must delete the existing item and subtract its size.
+func TestCache_StoreOverSizeReplacesExisting(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{MaxSize: entrySize("Test.TestMethod", 3)}
+
+	store := func(a int32, result *testpb.TestResult) {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, result, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, a := range []int32{1, 2} {
+		store(a, &testpb.TestResult{X: a}) // 3 bytes
+		if got, want := c.SizeBytes(), entrySize("Test.TestMethod", 3); got != want {
+			t.Fatalf("%d: got size %d, want %d", a, got, want)
+		}
+
+		store(a, &testpb.TestResult{X: 1 << 30}) // 7 bytes, larger than MaxSize
+		if got, want := c.SizeBytes(), uint64(0); got != want {
+			t.Errorf("%d: got size %d, want %d", a, got, want)
+		}
+		if isCached(t, c, a) {
+			t.Errorf("%d cached, want stale entry to have been deleted", a)
+		}
+	}
+}
+
+func TestCache_Compress(t *testing.T) {
+	ctx := context.Background()
+	arg := &testpb.TestOp{A: 1}
+	result := &testpb.TestOp{B: make([]*testpb.T, 200)} // 800 bytes, below MinByteGzip
+	for i := range result.B {
+		result.B[i] = &testpb.T{A: true}
+	}
+
+	var sizes []uint64
+	for _, compress := range []bool{false, true} {
+		c := &grpccache.Cache{Compress: compress}
+		if err := c.Store(ctx, "Test.TestMethod", arg, result, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		var got testpb.TestOp
+		cached, err := c.Get(ctx, "Test.TestMethod", arg, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached {
+			t.Fatalf("Compress=%v: not cached", compress)
+		}
+		if !reflect.DeepEqual(&got, result) {
+			t.Errorf("Compress=%v: got %v, want %v", compress, &got, result)
+		}
+		sizes = append(sizes, c.SizeBytes())
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("got compressed size %d, want it to be less than uncompressed size %d", sizes[1], sizes[0])
+	}
+}
+
+// jsonMarshaler is a grpccache.Marshaler that uses JSON and counts
+// its calls.
+type jsonMarshaler struct {
+	marshals, unmarshals int
+}
+
+func (m *jsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	m.marshals++
+	return json.Marshal(v)
+}
+
+func (m *jsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	m.unmarshals++
+	return json.Unmarshal(data, v)
+}
+
+func TestCache_Marshaler(t *testing.T) {
+	ctx := context.Background()
+	m := &jsonMarshaler{}
+	c := &grpccache.Cache{Marshaler: m}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if want := 2; m.marshals != want { // arg (for the key) and result
+		t.Errorf("got %d Marshal calls, want %d", m.marshals, want)
+	}
+
+	if !isCached(t, c, 1) {
+		t.Fatal("1 not cached")
+	}
+	if want := 3; m.marshals != want {
+		t.Errorf("got %d Marshal calls, want %d", m.marshals, want)
+	}
+	if want := 1; m.unmarshals != want {
+		t.Errorf("got %d Unmarshal calls, want %d", m.unmarshals, want)
+	}
+}
+
+// slowMarshaler is a grpccache.Marshaler (using JSON) that blocks
+// when marshaling a TestResult with X == 2, until release is closed.
+type slowMarshaler struct {
+	started, release chan struct{}
+}
+
+func (m *slowMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if r, ok := v.(*testpb.TestResult); ok && r.X == 2 {
+		close(m.started)
+		<-m.release
+	}
+	return json.Marshal(v)
+}
+
+func (m *slowMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestCache_Store_slowMarshalDoesNotBlockGet(t *testing.T) {
+	ctx := context.Background()
+	m := &slowMarshaler{started: make(chan struct{}), release: make(chan struct{})}
+	c := &grpccache.Cache{Marshaler: m}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	storeDone := make(chan error)
+	go func() {
+		storeDone <- c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, maxAgeTrailer(time.Hour))
+	}()
+	<-m.started
+
+	getDone := make(chan bool)
+	go func() {
+		var result testpb.TestResult
+		cached, _ := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		getDone <- cached
+	}()
+	select {
+	case cached := <-getDone:
+		if !cached {
+			t.Error("1 not cached")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get blocked by concurrent Store")
+	}
+
+	close(m.release)
+	if err := <-storeDone; err != nil {
+		t.Fatal(err)
+	}
+	if !isCached(t, c, 2) {
+		t.Error("2 not cached")
+	}
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	for _, a := range []int32{1, 2} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := c.Invalidate(ctx, "Test.TestMethod", &testpb.TestOp{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("Invalidate returned false, want true")
+	}
+	if isCached(t, c, 1) {
+		t.Error("1 cached after Invalidate")
+	}
+	if !isCached(t, c, 2) {
+		t.Error("2 not cached, want it to survive Invalidate of 1")
+	}
+	if got, want := c.SizeBytes(), entrySize("Test.TestMethod", 3); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+
+	removed, err = c.Invalidate(ctx, "Test.TestMethod", &testpb.TestOp{A: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed {
+		t.Error("Invalidate of absent item returned true, want false")
+	}
+}
+
+func TestCache_TTLFunc(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{
+		MaxAgeCap: time.Minute,
+		// Results with X > 0 are fresh for X seconds.
+		TTLFunc: func(method string, result proto.Message) (time.Duration, bool) {
+			x := result.(*testpb.TestResult).X
+			return time.Duration(x) * time.Second, x > 0
+		},
+	}
+	grpccache.SetNow(c, clock.Now)
+
+	for _, a := range []int32{10, 20, 120, 0} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(30*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// With no cache control from the server, TTLFunc still applies.
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 5}, &testpb.TestResult{X: 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// TTLFunc does not override NoStore.
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 6}, &testpb.TestResult{X: 6}, metadata.MD{"grpccache-no-store": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(t, c, 6) {
+		t.Error("6 cached, want NoStore to take precedence over TTLFunc")
+	}
+
+	clock.Advance(15 * time.Second)
+	for a, want := range map[int32]bool{5: false, 10: false, 20: true, 120: true, 0: true} {
+		if cached := isCached(t, c, a); cached != want {
+			t.Errorf("after 15s: %d: got cached %v, want %v", a, cached, want)
+		}
+	}
+
+	// 0 has the server's MaxAge (TTLFunc returned !ok), and 120 is
+	// limited by MaxAgeCap.
+	clock.Advance(30 * time.Second)
+	for a, want := range map[int32]bool{20: false, 120: true, 0: false} {
+		if cached := isCached(t, c, a); cached != want {
+			t.Errorf("after 45s: %d: got cached %v, want %v", a, cached, want)
+		}
+	}
+	clock.Advance(30 * time.Second)
+	if isCached(t, c, 120) {
+		t.Error("after 75s: 120 cached, want it to have expired after MaxAgeCap")
+	}
+}
+
+func TestCache_Touch(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{MaxAgeCap: 3 * time.Hour}
+	grpccache.SetNow(c, clock.Now)
+
+	if touched, err := c.Touch(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if touched {
+		t.Error("got touched true for a missing item, want false")
+	}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Minute)
+	if touched, err := c.Touch(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if !touched {
+		t.Error("got touched false, want true")
+	}
+
+	clock.Advance(time.Hour) // past the original expiry
+	if !isCached(t, c, 1) {
+		t.Error("not cached after its original expiry, want the touched item to be cached")
+	}
+	clock.Advance(time.Hour) // past the extended expiry
+	if isCached(t, c, 1) {
+		t.Error("cached after its extended expiry")
+	}
+
+	// The extended expiry is capped by MaxAgeCap.
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Touch(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, 10*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(3*time.Hour - time.Minute)
+	if !isCached(t, c, 2) {
+		t.Error("not cached before MaxAgeCap elapsed")
+	}
+	clock.Advance(2 * time.Minute)
+	if isCached(t, c, 2) {
+		t.Error("cached after MaxAgeCap elapsed")
+	}
+}
+
+func TestCache_InvalidateMethod(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	// "A-B" begins with "A-", but its results must not be removed by
+	// InvalidateMethod("A").
+	methods := []string{"A", "A-B", "B"}
+	for _, method := range methods {
+		for a := int32(1); a <= 2; a++ {
+			if err := c.Store(ctx, method, &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got, want := c.InvalidateMethod("A"), 2; got != want {
+		t.Errorf("got %d removed, want %d", got, want)
+	}
+	for _, method := range methods {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, method, &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := method != "A"; cached != want {
+			t.Errorf("method %q: got cached %v, want %v", method, cached, want)
+		}
+	}
+	if got, want := c.Len(), 4; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+	if got, want := c.SizeBytes(), 2*entrySize("A-B", 3)+2*entrySize("B", 3); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+}
+
+func TestCache_Namespace(t *testing.T) {
+	ctx := context.Background()
+	var storage mapStorage // shared by all caches
+	v1 := &grpccache.Cache{Storage: &storage, Namespace: "v1"}
+	v2 := &grpccache.Cache{Storage: &storage, Namespace: "v2"}
+	none := &grpccache.Cache{Storage: &storage}
+
+	if err := v1.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if isCached(t, v2, 1) {
+		t.Error("v2: got v1's item, want namespaces to be separate")
+	}
+	if isCached(t, none, 1) {
+		t.Error("no namespace: got v1's item, want namespaces to be separate")
+	}
+	if !isCached(t, &grpccache.Cache{Storage: &storage, Namespace: "v1"}, 1) {
+		t.Error("v1: not cached in another cache with the same namespace")
+	}
+	for key := range storage.items {
+		if !strings.HasPrefix(key, "v1/Test.TestMethod|") {
+			t.Errorf("got key %q, want it to begin with the namespace", key)
+		}
+	}
+
+	// InvalidateMethod finds keys in the namespace.
+	c := &grpccache.Cache{Namespace: "v1"}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.InvalidateMethod("Test.TestMethod"); n != 1 {
+		t.Errorf("got %d removed, want 1", n)
+	}
+}
+
+func TestCache_ClearFunc(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+	for _, method := range []string{"Config", "A", "B"} {
+		if err := c.Store(ctx, method, &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := c.ClearFunc(func(key string) bool { return strings.HasPrefix(key, "Config|") }); n != 2 {
+		t.Errorf("got %d removed, want 2", n)
+	}
+	for _, method := range []string{"Config", "A", "B"} {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, method, &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := method == "Config"; cached != want {
+			t.Errorf("method %q: got cached %v, want %v", method, cached, want)
+		}
+	}
+	if got, want := c.Len(), 1; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+	if got, want := c.SizeBytes(), entrySize("Config", 3); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+}
+
+func TestCache_nilArg(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	// Two nullary methods, called with a nil arg and a nil pointer.
+	if err := c.Store(ctx, "Test.A", nil, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(ctx, "Test.B", (*testpb.TestOp)(nil), &testpb.TestResult{X: 2}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Len(), 2; got != want {
+		t.Errorf("got %d entries, want %d (one for each method)", got, want)
+	}
+
+	for _, test := range []struct {
+		method string
+		arg    proto.Message
+		want   int32
+	}{
+		{"Test.A", nil, 1},
+		{"Test.A", (*testpb.TestOp)(nil), 1},
+		{"Test.A", &emptypb.Empty{}, 1}, // an empty arg shares the nil arg's key
+		{"Test.B", nil, 2},
+		{"Test.B", &emptypb.Empty{}, 2},
+	} {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, test.method, test.arg, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached {
+			t.Errorf("%s %#v: not cached", test.method, test.arg)
+			continue
+		}
+		if result.X != test.want {
+			t.Errorf("%s %#v: got result %d, want %d", test.method, test.arg, result.X, test.want)
+		}
+	}
+
+	if removed, err := c.Invalidate(ctx, "Test.A", nil); err != nil {
+		t.Fatal(err)
+	} else if !removed {
+		t.Error("Invalidate: got removed false, want true")
+	}
+	if got, want := c.Len(), 1; got != want {
+		t.Errorf("after Invalidate: got %d entries, want %d", got, want)
+	}
+}
+
+// argErrorMarshaler is a grpccache.Marshaler (using JSON) that fails
+// to marshal args (TestOps), so that cache keys can't be computed.
+type argErrorMarshaler struct{}
+
+func (argErrorMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if _, ok := v.(*testpb.TestOp); ok {
+		return nil, errors.New("marshal error")
+	}
+	return json.Marshal(v)
+}
+
+func (argErrorMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestCache_argMarshalError(t *testing.T) {
+	ts := &testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	c := &testpb.CachedTestClient{
+		TestClient: testpb.NewTestClient(cc),
+		Cache:      &grpccache.Cache{Marshaler: argErrorMarshaler{}, SingleFlight: true},
+	}
+
+	// The calls succeed, uncached.
+	for i := 0; i < 2; i++ {
+		result, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.X != 1 {
+			t.Errorf("got result %d, want 1", result.X)
+		}
+	}
+	if want := 2; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d", len(ts.calls), want)
+	}
+	if n := c.Cache.Len(); n != 0 {
+		t.Errorf("got %d cached items, want 0", n)
+	}
+
+	size, wouldStore, err := c.Cache.WouldStore(context.Background(), "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wouldStore || size == 0 {
+		t.Errorf("got WouldStore (%d, %v), want (>0, false)", size, wouldStore)
+	}
+}
+
+func TestCache_KeyFunc(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		// Ignore TestOp.B.
+		KeyFunc: func(ctx context.Context, method string, arg proto.Message) (string, error) {
+			return method + "|" + strconv.Itoa(int(arg.(*testpb.TestOp).A)), nil
+		},
+	}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var result testpb.TestResult
+	cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1, B: []*testpb.T{{A: true}}}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached {
+		t.Error("not cached, want args that differ only in B to share a key")
+	}
+	if isCached(t, c, 2) {
+		t.Error("2 cached")
+	}
+}
+
+func TestCache_MapArgDeterministic(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	// Build equal maps with different insertion orders. Enough keys
+	// are used that a nondeterministic encoding would almost
+	// certainly differ between the two.
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	m1 := make(map[string]string, len(keys))
+	for _, k := range keys {
+		m1[k] = "v" + k
+	}
+	m2 := make(map[string]string, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		m2[keys[i]] = "v" + keys[i]
+	}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1, C: m1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1, C: m2}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached {
+			t.Fatal("not cached, want equal map args to share a key")
+		}
+	}
+}
+
+func TestCache_ForEach(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		KeyFunc: func(ctx context.Context, method string, arg proto.Message) (string, error) {
+			return strconv.Itoa(int(arg.(*testpb.TestOp).A)), nil
+		},
+	}
+	for _, a := range []int32{1, 2, 3} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	var size uint64
+	c.ForEach(func(key string, n int, cc grpccache.CacheControl, expiry time.Time) bool {
+		keys = append(keys, key)
+		size += uint64(n)
+		if cc.MaxAge != time.Hour {
+			t.Errorf("%s: got MaxAge %s, want %s", key, cc.MaxAge, time.Hour)
+		}
+		return true
+	})
+	if want := []string{"3", "2", "1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+	if got, want := size, c.SizeBytes(); got != want {
+		t.Errorf("got total size %d, want %d", got, want)
+	}
+
+	// Stop early.
+	var n int
+	c.ForEach(func(string, int, grpccache.CacheControl, time.Time) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("got %d calls after returning false, want 1", n)
+	}
+}
+
+func TestCache_MaxResultSize(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		MaxResultSize: map[string]uint64{"Capped": 3},
+	}
+
+	for _, test := range []struct {
+		method string
+		x      int32
+		want   bool
+	}{
+		{"Capped", 1, true},    // 3 bytes
+		{"Capped", 200, false}, // 4 bytes
+		{"Uncapped", 200, true},
+	} {
+		arg := &testpb.TestOp{A: test.x}
+		if err := c.Store(ctx, test.method, arg, &testpb.TestResult{X: test.x}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, test.method, arg, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != test.want {
+			t.Errorf("%s %d: got cached %v, want %v", test.method, test.x, cached, test.want)
+		}
+	}
+}
+
+func TestCache_CacheableFunc(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		// Treat negative results as partial.
+		CacheableFunc: func(method string, result proto.Message) bool {
+			return result.(*testpb.TestResult).X >= 0
+		},
+	}
+
+	for _, x := range []int32{1, -1} {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: x}, &testpb.TestResult{X: x}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !isCached(t, c, 1) {
+		t.Error("complete result not cached")
+	}
+	if isCached(t, c, -1) {
+		t.Error("partial result cached")
+	}
+
+	// A partial result removes a previously cached result.
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: -1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("got %d entries, want 0", got)
+	}
+}
+
+func TestCache_WouldStore(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		MaxResultSize: map[string]uint64{"Capped": 3},
+		MaxSize:       entrySize("Uncapped", 3),
+	}
+
+	for _, test := range []struct {
+		method   string
+		x        int32
+		wantSize uint64
+		want     bool
+	}{
+		{"Capped", 1, 3, true},
+		{"Capped", 200, 4, false},   // exceeds MaxResultSize
+		{"Uncapped", 1, 3, true},    // fits in MaxSize
+		{"Uncapped", 200, 4, false}, // exceeds MaxSize
+	} {
+		arg, result := &testpb.TestOp{A: test.x}, &testpb.TestResult{X: test.x}
+		size, wouldStore, err := c.WouldStore(ctx, test.method, arg, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != test.wantSize || wouldStore != test.want {
+			t.Errorf("%s %d: got WouldStore (%d, %v), want (%d, %v)", test.method, test.x, size, wouldStore, test.wantSize, test.want)
+		}
+
+		// Compare to what Store actually does.
+		if err := c.Store(ctx, test.method, arg, result, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		cached, err := c.Get(ctx, test.method, arg, &testpb.TestResult{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != wouldStore {
+			t.Errorf("%s %d: got WouldStore %v, but Store stored it: %v", test.method, test.x, wouldStore, cached)
+		}
+	}
+
+	var nilResult *testpb.TestResult
+	if _, wouldStore, err := c.WouldStore(ctx, "Uncapped", &testpb.TestOp{}, nilResult); err != nil {
+		t.Fatal(err)
+	} else if wouldStore {
+		t.Error("got WouldStore true for a nil result, want false")
+	}
+}
+
+func TestCache_SizeBytes(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{
+		KeyFunc: func(ctx context.Context, method string, arg proto.Message) (string, error) {
+			return "key", nil
+		},
+	}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// 3-byte key, 3-byte result
+	if got, want := c.SizeBytes(), uint64(3+3+grpccache.EntryOverhead); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+
+	// A MaxSize that fits the data but not the key and overhead
+	// rejects the item.
+	c.Clear()
+	c.MaxSize = 3 + 3 + grpccache.EntryOverhead - 1
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("got %d entries, want the item to be too large to store", got)
+	}
+}
+
+// entrySize returns the number of bytes that a result of dataLen
+// bytes, stored under the default key for method, counts toward the
+// cache size.
+func entrySize(method string, dataLen int) uint64 {
+	const hashLen = 44 // base64-encoded SHA-256
+	return uint64(len(method)+len("|")+hashLen+dataLen) + grpccache.EntryOverhead
+}
+
+func maxAgeTrailer(maxAge time.Duration) metadata.MD {
+	return metadata.MD{"grpccache-max-age": maxAge.String()}
+}
+
+// isCached reports whether the result for TestOp{A: a} is in c.
+func TestCache_WithCache(t *testing.T) {
+	ts := &testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	tenant1, tenant2 := &grpccache.Cache{}, &grpccache.Cache{}
+	ctx1 := grpccache.WithCache(context.Background(), tenant1)
+	ctx2 := grpccache.WithCache(context.Background(), tenant2)
+	for _, ctx := range []context.Context{ctx1, ctx2, ctx1, ctx2} {
+		if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 2; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d (one per cache)", len(ts.calls), want)
+	}
+	if !isCached(t, tenant1, 1) || !isCached(t, tenant2, 1) {
+		t.Error("result not cached in each context's cache")
+	}
+	if c.Cache.Len() != 0 {
+		t.Errorf("got %d items in the client's own cache, want 0", c.Cache.Len())
+	}
+
+	// A nil cache in the context disables caching.
+	ctx := grpccache.WithCache(context.Background(), nil)
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 4; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d", len(ts.calls), want)
+	}
+}
+
+func isCached(t *testing.T, c *grpccache.Cache, a int32) bool {
+	var result testpb.TestResult
+	cached, err := c.Get(context.Background(), "Test.TestMethod", &testpb.TestOp{A: a}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached && result.X != a {
+		t.Errorf("got cached result %d, want %d", result.X, a)
+	}
+	return cached
+}
+
+type testServer struct {
+	calls []*testpb.TestOp
+
+	maxAge time.Duration
+}
+
+func (s *testServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls = append(s.calls, op)
+
+	// Calls to SetCacheControl are merged, and the shortest MaxAge
+	// wins. Make a call here with a longer MaxAge, to ensure that the
+	// following call's MaxAge indeed takes effect.
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: 2 * s.maxAge})
+
+	// Set cache control.
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: s.maxAge})
+
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func BenchmarkCache_GetParallel(b *testing.B) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+	const n = 100
+	for a := int32(0); a < n; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var a int32
+		for pb.Next() {
+			var result testpb.TestResult
+			if _, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: a % n}, &result); err != nil {
+				b.Fatal(err)
+			}
+			a++
+		}
+	})
+}
+
+func BenchmarkCache_StoreGetParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ctx := context.Background()
+			c := &grpccache.Cache{Shards: shards}
+			const n = 100
+
+			b.RunParallel(func(pb *testing.PB) {
+				var a int32
+				for pb.Next() {
+					op := &testpb.TestOp{A: a % n}
+					if a%4 == 0 {
+						if err := c.Store(ctx, "Test.TestMethod", op, &testpb.TestResult{X: op.A}, maxAgeTrailer(time.Hour)); err != nil {
+							b.Fatal(err)
+						}
+					} else {
+						var result testpb.TestResult
+						if _, err := c.Get(ctx, "Test.TestMethod", op, &result); err != nil {
+							b.Fatal(err)
+						}
+					}
+					a++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCachedClient_nilCache(b *testing.B) {
+	ctx := context.Background()
+	clients := map[string]testpb.TestClient{
+		"raw":     &optsClient{},
+		"wrapped": &testpb.CachedTestClient{TestClient: &optsClient{}},
+	}
+	for label, c := range clients {
+		b.Run(label, func(b *testing.B) {
+			op := &testpb.TestOp{A: 1}
+			for i := 0; i < b.N; i++ {
+				if _, err := c.TestMethod(ctx, op); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCache_Hash(b *testing.B) {
+	fnvHash := func(data []byte) string {
+		h := fnv.New64a()
+		h.Write(data)
+		return strconv.FormatUint(h.Sum64(), 36)
+	}
+
+	ctx := context.Background()
+	arg := &testpb.TestOp{A: 1, B: make([]*testpb.T, 100)}
+	for i := range arg.B {
+		arg.B[i] = &testpb.T{A: true}
+	}
+
+	for _, bm := range []struct {
+		name string
+		hash func([]byte) string
+	}{
+		{"default", nil},
+		{"fnv", fnvHash},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			c := &grpccache.Cache{Hash: bm.hash}
+			var result testpb.TestResult
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Get(ctx, "Test.TestMethod", arg, &result); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// nilResultClient is a testpb.TestClient whose method returns a nil
+// result (and no error), as a server might.
+type nilResultClient struct {
+	calls int
+}
+
+func (c *nilResultClient) TestMethod(ctx context.Context, op *testpb.TestOp, opts ...grpc.CallOption) (*testpb.TestResult, error) {
+	c.calls++
+	return nil, nil
+}
+
+// optsClient is a testpb.TestClient that records the number of call
+// options passed to each call.
+type optsClient struct {
+	numOpts []int
+}
+
+func (c *optsClient) TestMethod(ctx context.Context, op *testpb.TestOp, opts ...grpc.CallOption) (*testpb.TestResult, error) {
+	c.numOpts = append(c.numOpts, len(opts))
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+// flakyServer is a testpb.TestServer that fails with Unavailable
+// (or err, if set) while fail is set.
+type flakyServer struct {
+	mu   sync.Mutex
+	fail bool
+	err  error
+}
+
+func (s *flakyServer) setFail(fail bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail, s.err = fail, err
+}
+
+func (s *flakyServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, grpc.Errorf(codes.Unavailable, "unavailable")
+	}
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Minute})
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+// versionServer is a testpb.TestServer whose results are its current
+// version, which tests change to simulate writes.
+type versionServer struct {
+	mu      sync.Mutex
+	version int32
+	calls   int
+}
+
+func (s *versionServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour})
+	return &testpb.TestResult{X: s.version}, nil
 }
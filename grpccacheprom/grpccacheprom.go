@@ -0,0 +1,57 @@
+// Package grpccacheprom provides a Prometheus collector for the
+// performance statistics of a grpccache.Cache.
+package grpccacheprom // import "sourcegraph.com/sqs/grpccache/grpccacheprom"
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sourcegraph.com/sqs/grpccache"
+)
+
+// collector is a prometheus.Collector for a grpccache.Cache.
+type collector struct {
+	c *grpccache.Cache
+
+	hits, misses, expirations, evictions, stores *prometheus.Desc
+	entries, size                                *prometheus.Desc
+}
+
+// NewCollector returns a prometheus.Collector that exports c's Stats
+// (as counters) and its number of entries and size (as gauges). The
+// metrics are cache-wide (with no per-key or per-method labels), so
+// their cardinality is fixed.
+//
+// constLabels are added to all metrics. They distinguish the metrics
+// of multiple caches registered with the same registry (e.g.,
+// prometheus.Labels{"cache": "users"}).
+func NewCollector(c *grpccache.Cache, constLabels prometheus.Labels) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("grpccache", "", name), help, nil, constLabels)
+	}
+	return &collector{
+		c:           c,
+		hits:        desc("hits_total", "Number of cache lookups that returned a cached result."),
+		misses:      desc("misses_total", "Number of cache lookups that found no fresh cached result."),
+		expirations: desc("expirations_total", "Number of cached results removed because they expired."),
+		evictions:   desc("evictions_total", "Number of cached results evicted to satisfy the cache's size limits."),
+		stores:      desc("stores_total", "Number of results stored in the cache."),
+		entries:     desc("entries", "Number of results in the cache's in-memory storage."),
+		size:        desc("size_bytes", "Size of the cache's in-memory storage, in bytes."),
+	}
+}
+
+func (x *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{x.hits, x.misses, x.expirations, x.evictions, x.stores, x.entries, x.size} {
+		ch <- d
+	}
+}
+
+func (x *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := x.c.Stats()
+	ch <- prometheus.MustNewConstMetric(x.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(x.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(x.expirations, prometheus.CounterValue, float64(stats.Expirations))
+	ch <- prometheus.MustNewConstMetric(x.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(x.stores, prometheus.CounterValue, float64(stats.Stores))
+	ch <- prometheus.MustNewConstMetric(x.entries, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(x.size, prometheus.GaugeValue, float64(x.c.SizeBytes()))
+}
@@ -0,0 +1,71 @@
+package grpccacheprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCollector(t *testing.T) {
+	c := &grpccache.Cache{}
+	ctx := context.Background()
+	trailer := metadata.MD{"grpccache-max-age": time.Hour.String()}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, trailer); err != nil {
+		t.Fatal(err)
+	}
+	var result testpb.TestResult
+	for _, a := range []int32{1, 1, 2} {
+		if _, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector(c, prometheus.Labels{"cache": "test"})); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		if len(mf.Metric) != 1 {
+			t.Fatalf("%s: got %d metrics, want 1", mf.GetName(), len(mf.Metric))
+		}
+		m := mf.Metric[0]
+		if len(m.Label) != 1 || m.Label[0].GetName() != "cache" || m.Label[0].GetValue() != "test" {
+			t.Errorf("%s: got labels %v, want cache=test", mf.GetName(), m.Label)
+		}
+		if m.Counter != nil {
+			got[mf.GetName()] = m.Counter.GetValue()
+		} else {
+			got[mf.GetName()] = m.Gauge.GetValue()
+		}
+	}
+	want := map[string]float64{
+		"grpccache_hits_total":        2,
+		"grpccache_misses_total":      1,
+		"grpccache_expirations_total": 0,
+		"grpccache_evictions_total":   0,
+		"grpccache_stores_total":      1,
+		"grpccache_entries":           1,
+		"grpccache_size_bytes":        float64(c.SizeBytes()),
+	}
+	for name, wantV := range want {
+		if gotV, ok := got[name]; !ok {
+			t.Errorf("metric %s not gathered", name)
+		} else if gotV != wantV {
+			t.Errorf("%s: got %v, want %v", name, gotV, wantV)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d metric families, want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,105 @@
+package grpccache
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// UnaryClientInterceptor returns a gRPC client interceptor that
+// caches the results of unary method calls in c. It is an alternative
+// to the code-genned CachedXyzClient wrappers (which it behaves
+// identically to) that requires no code generation:
+//
+//	grpc.Dial(addr, grpc.WithUnaryInterceptor(grpccache.UnaryClientInterceptor(c)))
+//
+// Results are cached under the same method names that the generated
+// wrappers use (e.g., "Xyz.Method" for "/pkg.Xyz/Method"), so
+// InvalidateMethod works the same way for both. As with the wrappers,
+// a cache set by WithCache in a call's context is used instead of c.
+func UnaryClientInterceptor(c *Cache) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, fullMethod string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		c := Internal_CacheFromContext(ctx, c)
+		arg, ok := req.(proto.Message)
+		result, ok2 := reply.(proto.Message)
+		if c == nil || !ok || !ok2 {
+			return invoker(ctx, fullMethod, req, reply, cc, opts...)
+		}
+		return c.GetOrCall(ctx, methodName(fullMethod), arg, result, func(ctx context.Context, callOpts ...grpc.CallOption) (interface{}, error) {
+			// Make the call into a new result message (not reply,
+			// because it might be called in the background by
+			// Revalidate, after the interceptor has returned).
+			v := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+			if err := invoker(ctx, fullMethod, req, v, cc, append(opts[:len(opts):len(opts)], callOpts...)...); err != nil {
+				return nil, err
+			}
+			return v, nil
+		})
+	}
+}
+
+// UnaryServerInterceptor returns a gRPC server interceptor that sends
+// the cache-control set by unary method handlers (via
+// SetCacheControl) to the client in the response trailer. It is an
+// alternative to the code-genned CachedXyzServer wrappers (which it
+// behaves identically to) that requires no code generation:
+//
+//	grpc.NewServer(grpc.UnaryInterceptor(grpccache.UnaryServerInterceptor()))
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cc := Internal_WithCacheControl(ctx)
+		result, err := handler(ctx, req)
+		if err == ErrNotModified {
+			Internal_SetNotModified(cc)
+			result, err = &notModifiedResult{}, nil
+		}
+		if !cc.IsZero() {
+			if err := Internal_SetCacheControlTrailer(ctx, *cc); err != nil {
+				return nil, err
+			}
+		}
+		return result, err
+	}
+}
+
+// notModifiedResult is the empty result that UnaryServerInterceptor
+// sends for ErrNotModified. (Unlike the generated wrappers, it doesn't
+// know the method's result type, but an empty message of any type
+// has the same encoding.)
+type notModifiedResult struct{}
+
+func (*notModifiedResult) Reset()         {}
+func (*notModifiedResult) String() string { return "" }
+func (*notModifiedResult) ProtoMessage()  {}
+
+// methodName returns the name that the CachedXyzClient wrappers use
+// for a gRPC method (e.g., "Xyz.Method" for "/pkg.Xyz/Method").
+func methodName(fullMethod string) string {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	i := strings.Index(fullMethod, "/")
+	if i == -1 {
+		return fullMethod
+	}
+	service, meth := fullMethod[:i], fullMethod[i+1:]
+	if j := strings.LastIndex(service, "."); j != -1 {
+		service = service[j+1:]
+	}
+	return service + "." + meth
+}
+
+// copyMessage overwrites dst with a copy of src, which must be of the
+// same type.
+func copyMessage(dst, src proto.Message) {
+	if src, ok := src.(protov2.Message); ok {
+		dst := dst.(protov2.Message)
+		protov2.Reset(dst)
+		protov2.Merge(dst, src)
+		return
+	}
+	dst.Reset()
+	proto.Merge(dst, src)
+}
@@ -0,0 +1,129 @@
+package grpccache_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	ts := &testServer{maxAge: time.Hour}
+	c := &grpccache.Cache{}
+	cc, done := newTestClient(t, ts, grpc.WithUnaryInterceptor(grpccache.UnaryClientInterceptor(c)))
+	defer done()
+	client := testpb.NewTestClient(cc) // not a CachedTestClient
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		r, err := client.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != 1 {
+			t.Errorf("got X == %d, want 1", r.X)
+		}
+	}
+	if want := 1; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d", len(ts.calls), want)
+	}
+
+	// Results are cached under the same method names as the
+	// generated wrappers use.
+	if !isCached(t, c, 1) {
+		t.Error("result not cached under Test.TestMethod")
+	}
+}
+
+func TestUnaryClientInterceptor_error(t *testing.T) {
+	var ts notFoundServer
+	c := &grpccache.Cache{}
+	cc, done := newTestClient(t, &ts, grpc.WithUnaryInterceptor(grpccache.UnaryClientInterceptor(c)))
+	defer done()
+	client := testpb.NewTestClient(cc)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.TestMethod(ctx, &testpb.TestOp{A: 1}); grpc.Code(err) != codes.NotFound {
+			t.Fatalf("got error %v, want NotFound", err)
+		}
+	}
+	if want := 1; ts.calls != want {
+		t.Errorf("got %d calls, want %d", ts.calls, want)
+	}
+}
+
+// uncachedServer is a testpb.TestServer that doesn't set any
+// cache-control.
+type uncachedServer struct{}
+
+func (uncachedServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{maxAge: time.Hour}
+	gs := grpc.NewServer(grpc.UnaryInterceptor(grpccache.UnaryServerInterceptor()))
+	testpb.RegisterTestServer(gs, ts) // not a CachedTestServer
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			t.Log("warning: Serve:", err)
+		}
+	}()
+	defer gs.Stop()
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 1; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d", len(ts.calls), want)
+	}
+}
+
+// The trailer is only set if the handler set a cache-control.
+func TestUnaryServerInterceptor_noCacheControl(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer(grpc.UnaryInterceptor(grpccache.UnaryServerInterceptor()))
+	testpb.RegisterTestServer(gs, uncachedServer{})
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			t.Log("warning: Serve:", err)
+		}
+	}()
+	defer gs.Stop()
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	var trailer metadata.MD
+	if _, err := testpb.NewTestClient(cc).TestMethod(context.Background(), &testpb.TestOp{A: 1}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if len(trailer) != 0 {
+		t.Errorf("got trailer %v, want none", trailer)
+	}
+}
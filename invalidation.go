@@ -0,0 +1,34 @@
+package grpccache
+
+// RegisterInvalidation registers the methods whose cached results
+// become stale when a call to writeMethod succeeds (e.g., a "List"
+// method whose results are changed by a "Create" method). After each
+// successful call to writeMethod through the cache (via the
+// CachedXyzClient wrappers, UnaryClientInterceptor, or Store), all
+// cached results of the methods in invalidates are removed (as if by
+// InvalidateMethod), regardless of the call's args.
+//
+// Calling it again for the same writeMethod adds to the methods that
+// it invalidates. Like InvalidateMethod, invalidation only supports
+// the default in-memory storage. Calls to methods that the generator
+// was told to skip (with -skip) don't go through the cache, so they
+// invalidate nothing.
+func (c *Cache) RegisterInvalidation(writeMethod string, invalidates []string) {
+	c.invalidationsMu.Lock()
+	defer c.invalidationsMu.Unlock()
+	if c.invalidations == nil {
+		c.invalidations = map[string][]string{}
+	}
+	c.invalidations[writeMethod] = append(c.invalidations[writeMethod], invalidates...)
+}
+
+// invalidateAfter removes the cached results of the methods that a
+// successful call to method invalidates (see RegisterInvalidation).
+func (c *Cache) invalidateAfter(method string) {
+	c.invalidationsMu.RLock()
+	methods := c.invalidations[method]
+	c.invalidationsMu.RUnlock()
+	for _, m := range methods {
+		c.InvalidateMethod(m)
+	}
+}
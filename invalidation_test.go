@@ -0,0 +1,64 @@
+package grpccache_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_RegisterInvalidation(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+	c.RegisterInvalidation("Test.Create", []string{"Test.List"})
+	c.RegisterInvalidation("Test.Create", []string{"Test.Count"})
+
+	isCachedMethod := func(method string) bool {
+		var result testpb.TestResult
+		cached, err := c.Get(ctx, method, &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cached
+	}
+	storeReads := func() {
+		for _, method := range []string{"Test.List", "Test.Count", "Test.Get"} {
+			if err := c.Store(ctx, method, &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	storeReads()
+	// A failed write invalidates nothing.
+	if err := c.StoreError(ctx, "Test.Create", &testpb.TestOp{A: 2}, grpc.Errorf(codes.Internal, "failed"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !isCachedMethod("Test.List") {
+		t.Error("Test.List not cached after a failed write")
+	}
+
+	// A successful write (whose result is not cached) invalidates
+	// the registered methods, regardless of their args.
+	if err := c.Store(ctx, "Test.Create", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]bool{"Test.List": false, "Test.Count": false, "Test.Get": true} {
+		if got := isCachedMethod(method); got != want {
+			t.Errorf("after write: %s: got cached %v, want %v", method, got, want)
+		}
+	}
+
+	// Writes invalidate even with WithNoCache.
+	storeReads()
+	if err := c.Store(grpccache.WithNoCache(ctx), "Test.Create", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if isCachedMethod("Test.List") {
+		t.Error("Test.List cached after a write with WithNoCache")
+	}
+}
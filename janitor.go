@@ -0,0 +1,47 @@
+package grpccache
+
+import "time"
+
+// StartJanitor starts a goroutine that removes expired items from the
+// cache every interval. Without it, expired items are only removed
+// when a Get for the same key notices they have expired.
+//
+// The janitor only applies to the default in-memory storage; other
+// Storage implementations are responsible for their own expiry.
+//
+// Call StopJanitor to stop the goroutine. Calling StartJanitor while
+// the janitor is already running has no effect.
+func (c *Cache) StartJanitor(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.janitorStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	c.janitorStop = stop
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if c.Storage == nil {
+					c.memoryStorage().removeExpired()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the goroutine started by StartJanitor, if any.
+func (c *Cache) StopJanitor() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.janitorStop != nil {
+		close(c.janitorStop)
+		c.janitorStop = nil
+	}
+}
@@ -0,0 +1,36 @@
+package grpccache_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_Janitor(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.StartJanitor(5 * time.Millisecond)
+	defer c.StopJanitor()
+
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d entries, want the expired entry to be removed", c.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := c.SizeBytes(), entrySize("Test.TestMethod", 3); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,37 @@
+package grpccache
+
+import "log"
+
+// A Logger receives the log lines of a Cache (see Cache.Logger). It
+// may be called concurrently.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// stdLogger is the Logger that is used when Cache.Log is set.
+type stdLogger struct{}
+
+func (stdLogger) Logf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// logger returns the Logger that c logs to, or nil if logging is
+// disabled.
+func (c *Cache) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	if c.Log {
+		return stdLogger{}
+	}
+	return nil
+}
+
+// logging reports whether c logs. Callers check it before calling
+// logf, to avoid formatting arguments that won't be logged.
+func (c *Cache) logging() bool { return c.logger() != nil }
+
+// logf logs a line (if logging is enabled).
+func (c *Cache) logf(format string, args ...interface{}) {
+	if l := c.logger(); l != nil {
+		l.Logf(format, args...)
+	}
+}
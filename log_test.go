@@ -0,0 +1,61 @@
+package grpccache_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_Logger(t *testing.T) {
+	ctx := context.Background()
+	var logger captureLogger
+	c := &grpccache.Cache{Logger: &logger}
+
+	isCached(t, c, 1)
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	isCached(t, c, 1)
+
+	lines := logger.get()
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines %q, want 3", len(lines), lines)
+	}
+	for i, prefix := range []string{"Cache: MISS ", "Cache: STORE ", "Cache: HIT "} {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d: got %q, want prefix %q", i, lines[i], prefix)
+		}
+	}
+
+	// Nothing is logged without a Logger.
+	c.Logger = nil
+	isCached(t, c, 1)
+	if got := len(logger.get()); got != 3 {
+		t.Errorf("got %d lines after unsetting Logger, want 3", got)
+	}
+}
+
+// captureLogger is a grpccache.Logger that records the lines it
+// receives.
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Logf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
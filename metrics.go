@@ -0,0 +1,42 @@
+package grpccache
+
+// A MetricsSink receives per-method metrics from the CachedXyzClient
+// wrappers generated with grpccache-gen's -metrics flag (see
+// Cache.Metrics), so that they can be exported labeled by method
+// (e.g., as Prometheus counters with a "method" label). The method
+// names are the "Service.Method" names used by the wrappers, so their
+// cardinality is bounded by the service definitions.
+//
+// Its methods are called concurrently, so they must be safe for
+// concurrent use.
+type MetricsSink interface {
+	// ObserveGet is called after each cache lookup for a call to
+	// method, with whether it found a cached result (or error).
+	ObserveGet(method string, hit bool)
+
+	// ObserveStore is called after the result (or error) of each
+	// call to method that was made (because there was no cached
+	// result) is passed to the cache, whether or not it was
+	// cacheable.
+	ObserveStore(method string)
+}
+
+// Internal_ObserveGet is an internal func called by the code-genned
+// CachedXyzClient wrapper methods (generated with the -metrics flag).
+// It should not be called by user code. It reports a lookup to
+// c.Metrics, if set.
+func Internal_ObserveGet(c *Cache, method string, hit bool) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveGet(method, hit)
+	}
+}
+
+// Internal_ObserveStore is an internal func called by the code-genned
+// CachedXyzClient wrapper methods (generated with the -metrics flag).
+// It should not be called by user code. It reports a store to
+// c.Metrics, if set.
+func Internal_ObserveStore(c *Cache, method string) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveStore(method)
+	}
+}
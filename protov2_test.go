@@ -0,0 +1,66 @@
+package grpccache_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb/v2pb"
+)
+
+// v2TestServer is a v2pb.TestServer (whose types are generated for
+// the google.golang.org/protobuf runtime).
+type v2TestServer struct {
+	v2pb.UnimplementedTestServer
+	calls int
+}
+
+func (s *v2TestServer) TestMethod(ctx context.Context, op *v2pb.TestOp) (*v2pb.TestResult, error) {
+	s.calls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour})
+	return &v2pb.TestResult{X: op.A}, nil
+}
+
+func TestCachedTest_protobufV2(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts v2TestServer
+	gs := grpc.NewServer()
+	v2pb.RegisterTestServer(gs, &v2pb.CachedTestServer{TestServer: &ts})
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			t.Log("warning: Serve:", err)
+		}
+	}()
+	defer gs.Stop()
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := &v2pb.CachedTestClient{TestClient: v2pb.NewTestClient(cc), Cache: &grpccache.Cache{SingleFlight: true}}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		// Map fields must be marshaled deterministically so that
+		// each call has the same cache key.
+		r, err := c.TestMethod(ctx, &v2pb.TestOp{A: 7, C: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != 7 {
+			t.Errorf("got X == %d, want 7", r.X)
+		}
+	}
+	if want := 1; ts.calls != want {
+		t.Errorf("got %d calls, want %d", ts.calls, want)
+	}
+	if n := c.Cache.Len(); n != 1 {
+		t.Errorf("got %d cached items, want 1", n)
+	}
+}
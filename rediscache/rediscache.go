@@ -0,0 +1,147 @@
+// Package rediscache provides a grpccache.Storage that stores cached
+// results in Redis.
+package rediscache // import "sourcegraph.com/sqs/grpccache/rediscache"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"sourcegraph.com/sqs/grpccache"
+)
+
+// Storage is a grpccache.Storage that stores cached results in Redis.
+// Each result is stored with a Redis TTL derived from its expiry, so
+// Redis (not the client) is responsible for removing expired items.
+type Storage struct {
+	// Pool is the pool of Redis connections to use.
+	Pool *redis.Pool
+
+	// Prefix is prepended to the grpccache key to form the Redis
+	// key. If empty, "grpccache:" is used.
+	Prefix string
+}
+
+var _ grpccache.Storage = (*Storage)(nil)
+
+func (s *Storage) key(key string) string {
+	if s.Prefix == "" {
+		return "grpccache:" + key
+	}
+	return s.Prefix + key
+}
+
+// header is stored before the result data in each Redis value.
+type header struct {
+	CC     grpccache.CacheControl
+	Expiry time.Time
+}
+
+// encode returns a Redis value consisting of the length of the
+// JSON-encoded header (as a uvarint), the header, and data.
+func encode(data []byte, cc grpccache.CacheControl, expiry time.Time) ([]byte, error) {
+	h, err := json.Marshal(header{CC: cc, Expiry: expiry})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(h)+len(data))
+	n := binary.PutUvarint(buf, uint64(len(h)))
+	buf = append(buf[:n], h...)
+	return append(buf, data...), nil
+}
+
+var errMalformed = errors.New("rediscache: malformed value")
+
+// decode decodes a Redis value produced by encode.
+func decode(v []byte) (data []byte, cc grpccache.CacheControl, expiry time.Time, err error) {
+	hlen, n := binary.Uvarint(v)
+	if n <= 0 || uint64(len(v)-n) < hlen {
+		return nil, cc, expiry, errMalformed
+	}
+	var h header
+	if err := json.Unmarshal(v[n:n+int(hlen)], &h); err != nil {
+		return nil, cc, expiry, err
+	}
+	return v[n+int(hlen):], h.CC, h.Expiry, nil
+}
+
+// Get implements grpccache.Storage.
+func (s *Storage) Get(key string) ([]byte, grpccache.CacheControl, time.Time, bool, error) {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	v, err := redis.Bytes(conn.Do("GET", s.key(key)))
+	if err == redis.ErrNil {
+		return nil, grpccache.CacheControl{}, time.Time{}, false, nil
+	} else if err != nil {
+		return nil, grpccache.CacheControl{}, time.Time{}, false, err
+	}
+	data, cc, expiry, err := decode(v)
+	if err != nil {
+		return nil, grpccache.CacheControl{}, time.Time{}, false, err
+	}
+	return data, cc, expiry, true, nil
+}
+
+// Set implements grpccache.Storage.
+func (s *Storage) Set(key string, data []byte, cc grpccache.CacheControl, expiry time.Time) error {
+	ttl := expiry.Sub(time.Now())
+	if ttl <= 0 {
+		return nil
+	}
+	secs := int64((ttl + time.Second - 1) / time.Second) // round up
+
+	v, err := encode(data, cc, expiry)
+	if err != nil {
+		return err
+	}
+
+	conn := s.Pool.Get()
+	defer conn.Close()
+	if cc.Immutable && expiry.After(time.Now().AddDate(100, 0, 0)) {
+		// Immutable results never expire, unless the Cache's
+		// MaxAgeCap limited their expiry (but Redis may still evict
+		// them, depending on its maxmemory-policy).
+		_, err = conn.Do("SET", s.key(key), v)
+		return err
+	}
+	_, err = conn.Do("SET", s.key(key), v, "EX", secs)
+	return err
+}
+
+// Delete implements grpccache.Storage.
+func (s *Storage) Delete(key string) error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", s.key(key))
+	return err
+}
+
+// Clear implements grpccache.Storage. It deletes all keys that begin
+// with the Storage's prefix.
+func (s *Storage) Clear() error {
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		vs, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.key("*")))
+		if err != nil {
+			return err
+		}
+		var keys []interface{}
+		if _, err := redis.Scan(vs, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package rediscache
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) },
+	}
+	return &Storage{Pool: pool}, mr
+}
+
+func TestStorage(t *testing.T) {
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	cc := grpccache.CacheControl{MaxAge: 90 * time.Second}
+	expiry := time.Now().Add(cc.MaxAge)
+	if err := s.Set("k", []byte("data"), cc, expiry); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := mr.TTL("grpccache:k"), 90*time.Second; got != want {
+		t.Errorf("got TTL %s, want %s", got, want)
+	}
+
+	data, gotCC, gotExpiry, ok, err := s.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("not found")
+	}
+	if !bytes.Equal(data, []byte("data")) {
+		t.Errorf("got data %q, want %q", data, "data")
+	}
+	if !reflect.DeepEqual(gotCC, cc) {
+		t.Errorf("got cache control %+v, want %+v", gotCC, cc)
+	}
+	if !gotExpiry.Equal(expiry) {
+		t.Errorf("got expiry %s, want %s", gotExpiry, expiry)
+	}
+
+	// Redis expires the item.
+	mr.FastForward(91 * time.Second)
+	if _, _, _, ok, err := s.Get("k"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Error("found item after its TTL elapsed")
+	}
+
+	if err := s.Set("k1", []byte("1"), cc, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("k2", []byte("2"), cc, expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Set("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, _ := s.Get("k1"); ok {
+		t.Error("found item after Delete")
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, _ := s.Get("k2"); ok {
+		t.Error("found item after Clear")
+	}
+	if !mr.Exists("other") {
+		t.Error("Clear deleted a key without the grpccache prefix")
+	}
+}
+
+func TestStorage_Cache(t *testing.T) {
+	s, mr := newTestStorage(t)
+	defer mr.Close()
+
+	ctx := context.Background()
+	c := &grpccache.Cache{Storage: s}
+	trailer := metadata.MD{"grpccache-max-age": time.Hour.String()}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, trailer); err != nil {
+		t.Fatal(err)
+	}
+
+	var result testpb.TestResult
+	cached, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached {
+		t.Fatal("not cached")
+	}
+	if result.X != 1 {
+		t.Errorf("got result %d, want 1", result.X)
+	}
+}
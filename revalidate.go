@@ -0,0 +1,63 @@
+package grpccache
+
+import (
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// Revalidate refreshes a stale cached result (returned by GetStale) in
+// the background. It calls fn via Do. fn should make the underlying
+// gRPC method call and Store its result. It is called by the
+// CachedXyzClient auto-generated wrapper methods.
+//
+// If the same item is already being revalidated, Revalidate does
+// nothing (regardless of SingleFlight), so that many concurrent stale
+// hits only cause one background call.
+//
+// If the cached result has an ETag (see CacheControl.ETag), it is
+// sent to the server in the request metadata (see RequestETag).
+//
+// fn is called with a context that carries ctx's values but not its
+// deadline or cancellation, because the caller that triggered the
+// revalidation has usually returned (and canceled ctx) by the time fn
+// is called.
+func (c *Cache) Revalidate(ctx context.Context, method string, arg proto.Message, fn func(ctx context.Context) (interface{}, error)) {
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
+		return
+	}
+	c.revalidatingMu.Lock()
+	if _, inFlight := c.revalidating[cacheKey]; inFlight {
+		c.revalidatingMu.Unlock()
+		return
+	}
+	if c.revalidating == nil {
+		c.revalidating = map[string]struct{}{}
+	}
+	c.revalidating[cacheKey] = struct{}{}
+	c.revalidatingMu.Unlock()
+
+	// The caller's WithTrailer must not be set after it returns.
+	ctx = WithTrailer(detachedContext{ctx}, nil)
+	go func() {
+		defer func() {
+			c.revalidatingMu.Lock()
+			delete(c.revalidating, cacheKey)
+			c.revalidatingMu.Unlock()
+		}()
+		ctx := c.withCachedETag(ctx, method, arg)
+		if _, err := c.Do(ctx, method, arg, func() (interface{}, error) { return fn(ctx) }); err != nil && c.logging() {
+			c.logf("Cache: REVALIDATE %s %s failed: %s", method, truncate(arg), err)
+		}
+	}()
+}
+
+// detachedContext is a context.Context that has the values of the
+// underlying context but is never canceled and has no deadline.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
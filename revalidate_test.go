@@ -0,0 +1,139 @@
+package grpccache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// swrServer is a testpb.TestServer that returns the number of calls it
+// has handled (including the current one) as the result, with a
+// StaleWhileRevalidate window.
+type swrServer struct {
+	mu    sync.Mutex
+	calls int
+
+	delay time.Duration // how long each call takes
+}
+
+func (s *swrServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Minute, StaleWhileRevalidate: 2 * time.Minute})
+	return &testpb.TestResult{X: int32(s.calls)}, nil
+}
+
+func (s *swrServer) numCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var ts swrServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	clock := &fakeClock{t: time.Now()}
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	grpccache.SetNow(c.Cache, clock.Now)
+	ctx := context.Background()
+
+	call := func(wantX int32, wantCalls int) {
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != wantX {
+			t.Errorf("got result %d, want %d", r.X, wantX)
+		}
+		if got := ts.numCalls(); got != wantCalls {
+			t.Errorf("got %d server calls, want %d", got, wantCalls)
+		}
+	}
+
+	call(1, 1) // miss
+	call(1, 1) // fresh
+
+	// Stale but within the StaleWhileRevalidate window: the stale
+	// result is returned and refreshed in the background.
+	clock.Advance(90 * time.Second)
+	call(1, 1)
+	deadline := time.Now().Add(time.Second)
+	for {
+		var result testpb.TestResult
+		cached, err := c.Cache.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached && result.X == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale result was not refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	call(2, 2) // fresh again
+
+	// Past the StaleWhileRevalidate window: a miss.
+	clock.Advance(4 * time.Minute)
+	call(3, 3)
+}
+
+func TestCache_Revalidate_concurrent(t *testing.T) {
+	ts := swrServer{delay: 50 * time.Millisecond}
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	clock := &fakeClock{t: time.Now()}
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+	grpccache.SetNow(c.Cache, clock.Now)
+	ctx := context.Background()
+
+	if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Many concurrent stale hits cause only one refresh (even
+	// without SingleFlight).
+	clock.Advance(90 * time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.X != 1 {
+				t.Errorf("got result %d, want stale result 1", r.X)
+			}
+		}()
+	}
+	wg.Wait()
+	deadline := time.Now().Add(time.Second)
+	for {
+		var result testpb.TestResult
+		cached, err := c.Cache.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached && result.X == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stale result was not refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got, want := ts.numCalls(), 2; got != want {
+		t.Errorf("got %d server calls, want %d", got, want)
+	}
+}
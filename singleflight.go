@@ -0,0 +1,47 @@
+package grpccache
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+// Do calls fn and returns its result. It is called by the
+// CachedXyzClient auto-generated wrapper methods to make the
+// underlying gRPC method call (and store its result) after a cache
+// miss.
+//
+// If c.SingleFlight is set, concurrent calls to Do for the same
+// method and arg share a single call to fn: duplicate callers wait
+// for the in-flight call and receive (a copy of) its result. This
+// prevents a burst of cache misses for a popular item from all
+// reaching the server. Calls with Strong consistency (see
+// WithConsistency) are never shared.
+//
+// Do may be called on a nil *Cache, in which case it just calls fn.
+func (c *Cache) Do(ctx context.Context, method string, arg proto.Message, fn func() (interface{}, error)) (interface{}, error) {
+	if c == nil || !c.SingleFlight || getNoCache(ctx) || getConsistency(ctx) == Strong {
+		return fn()
+	}
+
+	cacheKey, ok := c.cacheKeyOrSkip(ctx, method, arg)
+	if !ok {
+		return fn()
+	}
+
+	v, err, shared := c.flight.Do(cacheKey, fn)
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		// Give each caller its own copy so that callers can't
+		// observe each other's modifications.
+		switch m := v.(type) {
+		case protov2.Message:
+			v = protov2.Clone(m)
+		case proto.Message:
+			v = proto.Clone(m)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,70 @@
+package grpccache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// slowServer is a testpb.TestServer that takes a while to respond
+// and counts its calls.
+type slowServer struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *slowServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour})
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func TestCache_SingleFlight(t *testing.T) {
+	var ts slowServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+
+	c := &testpb.CachedTestClient{
+		TestClient: testpb.NewTestClient(cc),
+		Cache:      &grpccache.Cache{SingleFlight: true},
+	}
+
+	const n = 10
+	results := make([]*testpb.TestResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = r
+		}(i)
+	}
+	wg.Wait()
+
+	if want := 1; ts.calls != want {
+		t.Errorf("got %d server calls, want %d", ts.calls, want)
+	}
+	for i, r := range results {
+		if r == nil || r.X != 1 {
+			t.Errorf("result %d: got %v, want X=1", i, r)
+		}
+		for j := 0; j < i; j++ {
+			if r == results[j] {
+				t.Errorf("results %d and %d share a pointer, want separate copies", i, j)
+			}
+		}
+	}
+}
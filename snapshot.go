@@ -0,0 +1,118 @@
+package grpccache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// snapshotVersion is the version of the format written by Dump. Load
+// rejects snapshots with other versions.
+const snapshotVersion = 1
+
+// ErrDumpUnsupported is returned by Dump if the cache uses a custom
+// Storage (which can't be iterated over).
+var ErrDumpUnsupported = errors.New("grpccache: Dump is only supported by the default in-memory storage")
+
+// snapshotHeader is the first value in a snapshot written by Dump.
+type snapshotHeader struct {
+	Version int
+	Vary    map[string][]string // see Cache.vary
+	Entries int                 // number of snapshotEntry values that follow
+}
+
+// snapshotEntry is a cached item in a snapshot written by Dump.
+type snapshotEntry struct {
+	Key    string
+	Data   []byte
+	CC     CacheControl
+	Expiry time.Time
+}
+
+// Dump writes all unexpired items in the cache to w, so that they can
+// be restored (e.g., after a restart) by Load. Each item keeps its
+// original expiry (so its remaining TTL after Load is its TTL when
+// dumped, minus the time between Dump and Load).
+//
+// Dump is only supported by the default in-memory storage. For other
+// storages, it returns ErrDumpUnsupported.
+func (c *Cache) Dump(w io.Writer) error {
+	if c.Storage != nil {
+		return ErrDumpUnsupported
+	}
+
+	now := c.timeNow()
+	var entries []snapshotEntry
+	for _, e := range c.memoryStorage().snapshot() {
+		if e.expiry.After(now) {
+			entries = append(entries, snapshotEntry{Key: e.key, Data: e.protoBytes, CC: e.cc, Expiry: e.expiry})
+		}
+	}
+
+	c.varyMu.RLock()
+	hdr := snapshotHeader{Version: snapshotVersion, Vary: c.vary, Entries: len(entries)}
+	enc := gob.NewEncoder(w)
+	err := enc.Encode(hdr)
+	c.varyMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write the least recently used items first, so that Load
+	// restores the LRU order.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := enc.Encode(entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads items written by Dump from r and adds them to the cache
+// (replacing existing items with the same keys). Items that have
+// expired since they were dumped (or that have no data) are skipped.
+// Items are added subject to MaxSize and MaxEntries, as if they were
+// stored by Store.
+func (c *Cache) Load(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var hdr snapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	if hdr.Version != snapshotVersion {
+		return fmt.Errorf("grpccache: unsupported snapshot version %d (want %d)", hdr.Version, snapshotVersion)
+	}
+
+	// Restore the Vary of methods that haven't had a response since
+	// the cache was created, so that their varied keys can be found.
+	c.varyMu.Lock()
+	for method, vary := range hdr.Vary {
+		if _, present := c.vary[method]; !present {
+			if c.vary == nil {
+				c.vary = map[string][]string{}
+			}
+			c.vary[method] = vary
+		}
+	}
+	c.varyMu.Unlock()
+
+	storage := c.storage()
+	now := c.timeNow()
+	for i := 0; i < hdr.Entries; i++ {
+		var e snapshotEntry
+		if err := dec.Decode(&e); err != nil {
+			return err
+		}
+		if !e.Expiry.After(now) || len(e.Data) == 0 {
+			// Skip expired items and corrupt ones (which could never
+			// be unmarshaled).
+			continue
+		}
+		if err := storage.Set(e.Key, e.Data, e.CC, e.Expiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
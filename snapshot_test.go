@@ -0,0 +1,137 @@
+package grpccache_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_DumpLoad(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	c := &grpccache.Cache{}
+	grpccache.SetNow(c, clock.Now)
+	ctx := context.Background()
+
+	maxAges := map[int32]time.Duration{1: time.Hour, 2: 2 * time.Hour, 3: 10 * time.Minute}
+	for a := int32(1); a <= 3; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(maxAges[a])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiries := map[string]time.Time{}
+	c.ForEach(func(key string, _ int, _ grpccache.CacheControl, expiry time.Time) bool {
+		expiries[key] = expiry
+		return true
+	})
+
+	var buf bytes.Buffer
+	if err := c.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Clear()
+	clock.Advance(30 * time.Minute)
+	if err := c.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// A=3 expired between Dump and Load.
+	if n := c.Len(); n != 2 {
+		t.Errorf("got %d items after Load, want 2", n)
+	}
+	for a, want := range map[int32]bool{1: true, 2: true, 3: false} {
+		if cached := isCached(t, c, a); cached != want {
+			t.Errorf("A=%d: got cached %v, want %v", a, cached, want)
+		}
+	}
+	c.ForEach(func(key string, _ int, _ grpccache.CacheControl, expiry time.Time) bool {
+		if !expiry.Equal(expiries[key]) {
+			t.Errorf("%s: got expiry %s, want %s", key, expiry, expiries[key])
+		}
+		return true
+	})
+
+	// Remaining TTLs are restored: A=1 expires 30m after Load.
+	clock.Advance(31 * time.Minute)
+	if isCached(t, c, 1) {
+		t.Error("A=1 still cached after its TTL elapsed")
+	}
+	if !isCached(t, c, 2) {
+		t.Error("A=2 not cached")
+	}
+}
+
+func TestCache_Load_badVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(struct{ Version int }{99}); err != nil {
+		t.Fatal(err)
+	}
+	c := &grpccache.Cache{}
+	if err := c.Load(&buf); err == nil {
+		t.Error("got nil error, want unsupported version error")
+	}
+}
+
+func TestCache_Load_emptyData(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+	for a := int32(1); a <= 2; a++ {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := c.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the snapshot with the first entry's data removed.
+	type header struct {
+		Version int
+		Vary    map[string][]string
+		Entries int
+	}
+	type entry struct {
+		Key    string
+		Data   []byte
+		CC     grpccache.CacheControl
+		Expiry time.Time
+	}
+	dec := gob.NewDecoder(&buf)
+	var hdr header
+	if err := dec.Decode(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	var corrupt bytes.Buffer
+	enc := gob.NewEncoder(&corrupt)
+	if err := enc.Encode(hdr); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < hdr.Entries; i++ {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			e.Data = nil
+		}
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c2 := &grpccache.Cache{}
+	if err := c2.Load(&corrupt); err != nil {
+		t.Fatal(err)
+	}
+	if n := c2.Len(); n != 1 {
+		t.Errorf("got %d cached items, want 1 (the entry with empty data skipped)", n)
+	}
+	for a := int32(1); a <= 2; a++ {
+		isCached(t, c2, a) // must not panic
+	}
+}
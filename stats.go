@@ -0,0 +1,109 @@
+package grpccache
+
+import "sync/atomic"
+
+// Stats describes the performance of a Cache. The counters are
+// cumulative over the lifetime of the Cache; they are not reset by
+// Clear.
+type Stats struct {
+	Hits        uint64 // Get calls that returned a cached result
+	Misses      uint64 // Get calls that found no fresh cached result (including expired)
+	Expirations uint64 // items removed because they expired
+	Evictions   uint64 // items removed to satisfy MaxSize or MaxEntries
+	Stores      uint64 // results passed to the Storage by Store
+
+	Entries int // number of items currently in the default in-memory storage
+}
+
+// cacheStats holds the counters that are updated atomically.
+type cacheStats struct {
+	hits, misses, expirations, evictions, stores uint64
+}
+
+// Stats returns statistics about the cache's performance.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&c.stats.hits),
+		Misses:      atomic.LoadUint64(&c.stats.misses),
+		Expirations: atomic.LoadUint64(&c.stats.expirations),
+		Evictions:   atomic.LoadUint64(&c.stats.evictions),
+		Stores:      atomic.LoadUint64(&c.stats.stores),
+		Entries:     c.Len(),
+	}
+}
+
+// MethodStat describes the performance of a Cache for calls to a
+// single method (see MethodStats).
+type MethodStat struct {
+	Hits   uint64 // Get calls that returned a cached result
+	Misses uint64 // Get calls that found no fresh cached result (including expired)
+}
+
+// HitRate returns the fraction of Get calls that were hits, or 0 if
+// there were none.
+func (s MethodStat) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// methodCounters holds a method's counters, which are updated
+// atomically.
+type methodCounters struct {
+	hits, misses uint64
+}
+
+// MethodStats returns statistics about the cache's performance for
+// each method that Get has been called for. The counters are
+// cumulative over the lifetime of the Cache (like Stats). The number
+// of methods is bounded by the service definitions, so the memory
+// used is too.
+func (c *Cache) MethodStats() map[string]MethodStat {
+	c.methodStatsMu.RLock()
+	defer c.methodStatsMu.RUnlock()
+	stats := make(map[string]MethodStat, len(c.methodStats))
+	for method, m := range c.methodStats {
+		stats[method] = MethodStat{
+			Hits:   atomic.LoadUint64(&m.hits),
+			Misses: atomic.LoadUint64(&m.misses),
+		}
+	}
+	return stats
+}
+
+// methodCounters returns the counters of method, creating them if
+// needed.
+func (c *Cache) methodCounters(method string) *methodCounters {
+	c.methodStatsMu.RLock()
+	m := c.methodStats[method]
+	c.methodStatsMu.RUnlock()
+	if m != nil {
+		return m
+	}
+
+	c.methodStatsMu.Lock()
+	defer c.methodStatsMu.Unlock()
+	if m = c.methodStats[method]; m == nil {
+		if c.methodStats == nil {
+			c.methodStats = map[string]*methodCounters{}
+		}
+		m = &methodCounters{}
+		c.methodStats[method] = m
+	}
+	return m
+}
+
+// countHit counts a Get call for method that returned a cached
+// result.
+func (c *Cache) countHit(method string) {
+	atomic.AddUint64(&c.stats.hits, 1)
+	atomic.AddUint64(&c.methodCounters(method).hits, 1)
+}
+
+// countMiss counts a Get call for method that found no fresh cached
+// result.
+func (c *Cache) countMiss(method string) {
+	atomic.AddUint64(&c.stats.misses, 1)
+	atomic.AddUint64(&c.methodCounters(method).misses, 1)
+}
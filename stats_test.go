@@ -0,0 +1,83 @@
+package grpccache_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_Stats(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{MaxEntries: 2}
+	clock := &fakeClock{t: time.Now()}
+	grpccache.SetNow(c, clock.Now)
+
+	store := func(a int32, maxAge time.Duration) {
+		if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: a}, &testpb.TestResult{X: a}, maxAgeTrailer(maxAge)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	isCached(t, c, 1) // miss
+	store(1, time.Hour)
+	isCached(t, c, 1) // hit
+	isCached(t, c, 1) // hit
+	store(2, time.Second)
+	clock.Advance(2 * time.Second)
+	isCached(t, c, 2) // expired
+	store(2, time.Hour)
+	store(3, time.Hour) // evicts 1
+
+	want := grpccache.Stats{
+		Hits:        2,
+		Misses:      2,
+		Expirations: 1,
+		Evictions:   1,
+		Stores:      4,
+		Entries:     2,
+	}
+	if got := c.Stats(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCache_MethodStats(t *testing.T) {
+	ctx := context.Background()
+	c := &grpccache.Cache{}
+
+	get := func(method string, a int32) {
+		var result testpb.TestResult
+		if _, err := c.Get(ctx, method, &testpb.TestOp{A: a}, &result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Store(ctx, "Test.A", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test.A: 3 hits, 1 miss. Test.B: 0 hits, 2 misses.
+	get("Test.A", 1)
+	get("Test.A", 1)
+	get("Test.A", 1)
+	get("Test.A", 2)
+	get("Test.B", 1)
+	get("Test.B", 1)
+
+	want := map[string]grpccache.MethodStat{
+		"Test.A": {Hits: 3, Misses: 1},
+		"Test.B": {Hits: 0, Misses: 2},
+	}
+	if got := c.MethodStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := c.MethodStats()["Test.A"].HitRate(), 0.75; got != want {
+		t.Errorf("got Test.A hit rate %v, want %v", got, want)
+	}
+	if got := c.MethodStats()["Test.B"].HitRate(); got != 0 {
+		t.Errorf("got Test.B hit rate %v, want 0", got)
+	}
+}
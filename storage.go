@@ -0,0 +1,421 @@
+package grpccache
+
+import (
+	"container/list"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Storage stores the marshaled results held by a Cache. It is not
+// concerned with serialization or cache keys; the Cache computes
+// those and passes them to the Storage.
+//
+// The Cache logs errors returned by Get, Set, and Delete, treating
+// them as misses (or as results that weren't stored), so that calls
+// are still made (uncached) while the Storage is unavailable.
+//
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the data, cache control, and expiry stored under
+	// key. If there is no such item, ok is false. Get may return an
+	// item that has expired; the Cache checks the expiry.
+	Get(key string) (data []byte, cc CacheControl, expiry time.Time, ok bool, err error)
+
+	// Set stores data under key, replacing any existing item.
+	Set(key string, data []byte, cc CacheControl, expiry time.Time) error
+
+	// Delete removes the item stored under key, if any.
+	Delete(key string) error
+
+	// Clear removes all items.
+	Clear() error
+}
+
+type cacheEntry struct {
+	key        string
+	protoBytes []byte
+	cc         CacheControl
+	expiry     time.Time
+}
+
+// EntryOverhead is the estimated number of bytes of memory used by
+// each item in the default in-memory storage, in addition to its key
+// and data. It approximates the size of the bookkeeping structures
+// (the entry itself, with its CacheControl and expiry, plus its LRU
+// list element and map slot) on a 64-bit platform.
+const EntryOverhead = 160
+
+// entrySize returns the number of bytes that an item with the given
+// key and data counts toward the cache size.
+func entrySize(key string, data []byte) uint64 {
+	return uint64(len(key)+len(data)) + EntryOverhead
+}
+
+// size returns the number of bytes that e counts toward the cache
+// size.
+func (e *cacheEntry) size() uint64 { return entrySize(e.key, e.protoBytes) }
+
+// memoryStorage is the default Storage. It holds items in memory and
+// evicts the least recently used items when the cache exceeds its
+// MaxSize or MaxEntries.
+//
+// Items are partitioned by key across one or more shards (see
+// Cache.Shards), each with its own lock and LRU list, so that
+// operations on different shards don't contend. With more than one
+// shard, eviction is least recently used within a shard, which
+// approximates LRU across the whole cache.
+type memoryStorage struct {
+	// size and n are the total size and number of items in all
+	// shards. They are updated atomically by holders of a shard's
+	// write lock. (They are first for 64-bit alignment.)
+	size, n int64
+
+	c      *Cache         // the cache that owns this storage (for limits, stats, and logging)
+	policy EvictionPolicy // if non-nil, chooses items to evict (instead of the shards' LRU lists)
+	shards []*memoryShard
+}
+
+// memoryShard holds a partition of a memoryStorage's items.
+type memoryShard struct {
+	// mu protects results, size, and the entries. Get only needs a
+	// read lock, so concurrent Gets don't block each other (except
+	// briefly, to update lru).
+	mu      sync.RWMutex
+	results map[string]*list.Element // cache key -> element (of *cacheEntry) in lru
+	size    uint64                   // current size of this shard
+
+	lruMu sync.Mutex // protects lru (also held by writers of mu)
+	lru   *list.List // most recently used entries at the front
+}
+
+func newMemoryStorage(c *Cache) *memoryStorage {
+	n := c.Shards
+	if n < 1 {
+		n = 1
+	}
+	s := &memoryStorage{c: c, policy: c.EvictionPolicy, shards: make([]*memoryShard, n)}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{
+			results: map[string]*list.Element{},
+			lru:     list.New(),
+		}
+	}
+	return s
+}
+
+// shard returns the shard that holds the item with the given key.
+func (s *memoryStorage) shard(key string) *memoryShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	h := fnv.New32a()
+	io.WriteString(h, key)
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *memoryStorage) Get(key string) ([]byte, CacheControl, time.Time, bool, error) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	elem, present := sh.results[key]
+	if !present {
+		return nil, CacheControl{}, time.Time{}, false, nil
+	}
+	sh.lruMu.Lock()
+	sh.lru.MoveToFront(elem)
+	sh.lruMu.Unlock()
+	if s.policy != nil {
+		s.policy.RecordAccess(key)
+	}
+	entry := elem.Value.(*cacheEntry)
+	return entry.protoBytes, entry.cc, entry.expiry, true, nil
+}
+
+func (s *memoryStorage) Set(key string, data []byte, cc CacheControl, expiry time.Time) error {
+	sh := s.shard(key)
+	sh.lock()
+
+	if maxSize := s.c.maxSize(); maxSize != 0 && entrySize(key, data) > maxSize {
+		elem, ok := sh.results[key]
+		if ok {
+			// Delete it because it's probably stale anyway.
+			s.removeElement(sh, elem)
+		}
+		sh.unlock()
+		if ok {
+			s.c.onEvict(key, EvictSize)
+		}
+		return nil
+	}
+
+	entry := &cacheEntry{
+		key:        key,
+		protoBytes: data,
+		cc:         cc,
+		expiry:     expiry,
+	}
+	if elem, ok := sh.results[key]; ok {
+		old := elem.Value.(*cacheEntry).size()
+		sh.size -= old
+		atomic.AddInt64(&s.size, -int64(old))
+		elem.Value = entry
+		sh.lru.MoveToFront(elem)
+	} else {
+		sh.results[key] = sh.lru.PushFront(entry)
+		atomic.AddInt64(&s.n, 1)
+	}
+	sh.size += entry.size()
+	atomic.AddInt64(&s.size, int64(entry.size()))
+
+	if s.policy != nil {
+		s.policy.RecordStore(key, entry.size())
+		sh.unlock()
+		s.c.onEvictKeys(s.evictByPolicy(), EvictSize)
+		return nil
+	}
+
+	// Evict least recently used entries (other than the one just
+	// stored) until the cache fits within MaxSize and MaxEntries.
+	evicted := s.evict(sh, entry, nil)
+	sh.unlock()
+
+	// If this shard has nothing else to evict, evict from the
+	// others. Only one shard is locked at a time, to avoid deadlock.
+	for _, other := range s.shards {
+		if !s.overLimit() {
+			break
+		}
+		if other != sh {
+			other.lock()
+			evicted = s.evict(other, nil, evicted)
+			other.unlock()
+		}
+	}
+
+	s.c.onEvictKeys(evicted, EvictSize)
+	return nil
+}
+
+// evict removes the least recently used entries in sh (other than
+// keep) until s fits within MaxSize and MaxEntries, or sh has no more
+// entries to remove. It appends the keys of the removed entries to
+// evicted (if Cache.OnEvict is set) and returns the result. The caller
+// must hold the lock acquired by sh.lock.
+func (s *memoryStorage) evict(sh *memoryShard, keep *cacheEntry, evicted []string) []string {
+	for s.overLimit() {
+		oldest := sh.lru.Back()
+		if oldest == nil || oldest.Value == keep {
+			break
+		}
+		key := oldest.Value.(*cacheEntry).key
+		if s.c.logging() {
+			s.c.logf("Cache: EVICT   %s", key)
+		}
+		s.removeElement(sh, oldest)
+		atomic.AddUint64(&s.c.stats.evictions, 1)
+		if s.c.OnEvict != nil {
+			evicted = append(evicted, key)
+		}
+	}
+	return evicted
+}
+
+// evictByPolicy removes the items chosen by s.policy until s fits
+// within MaxSize and MaxEntries, or the policy has no more items to
+// evict. (The policy may choose the item that was just stored.) It
+// returns the keys of the removed items (if Cache.OnEvict is set).
+// The caller must not hold any shard's lock.
+func (s *memoryStorage) evictByPolicy() (evicted []string) {
+	for s.overLimit() {
+		var need uint64
+		if size, maxSize := s.sizeBytes(), s.c.maxSize(); maxSize != 0 && size > maxSize {
+			need = size - maxSize
+		}
+		keys := s.policy.Evict(need)
+		if len(keys) == 0 {
+			break
+		}
+		for _, key := range keys {
+			sh := s.shard(key)
+			sh.lock()
+			elem, ok := sh.results[key]
+			if ok {
+				if s.c.logging() {
+					s.c.logf("Cache: EVICT   %s", key)
+				}
+				s.removeElement(sh, elem)
+				atomic.AddUint64(&s.c.stats.evictions, 1)
+			}
+			sh.unlock()
+			if ok && s.c.OnEvict != nil {
+				evicted = append(evicted, key)
+			}
+		}
+	}
+	return evicted
+}
+
+// shrink evicts items until s fits within MaxSize and MaxEntries
+// (e.g., after they were lowered by Cache.Resize).
+func (s *memoryStorage) shrink() {
+	if s.policy != nil {
+		s.c.onEvictKeys(s.evictByPolicy(), EvictSize)
+		return
+	}
+	var evicted []string
+	for _, sh := range s.shards {
+		if !s.overLimit() {
+			break
+		}
+		sh.lock()
+		evicted = s.evict(sh, nil, evicted)
+		sh.unlock()
+	}
+	s.c.onEvictKeys(evicted, EvictSize)
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	sh := s.shard(key)
+	sh.lock()
+	defer sh.unlock()
+	if elem, ok := sh.results[key]; ok {
+		s.removeElement(sh, elem)
+	}
+	return nil
+}
+
+func (s *memoryStorage) Clear() error {
+	for _, sh := range s.shards {
+		sh.lock()
+		var cleared []string
+		if s.c.OnEvict != nil || s.policy != nil {
+			cleared = make([]string, 0, len(sh.results))
+			for key := range sh.results {
+				cleared = append(cleared, key)
+			}
+		}
+		if s.policy != nil {
+			for _, key := range cleared {
+				s.policy.Remove(key)
+			}
+		}
+		atomic.AddInt64(&s.size, -int64(sh.size))
+		atomic.AddInt64(&s.n, -int64(len(sh.results)))
+		sh.results = map[string]*list.Element{}
+		sh.lru = list.New()
+		sh.size = 0
+		sh.unlock()
+		if s.c.OnEvict != nil {
+			s.c.onEvictKeys(cleared, EvictInvalidated)
+		}
+	}
+	return nil
+}
+
+// lock acquires exclusive access to sh.
+func (sh *memoryShard) lock() {
+	sh.mu.Lock()
+	sh.lruMu.Lock()
+}
+
+func (sh *memoryShard) unlock() {
+	sh.lruMu.Unlock()
+	sh.mu.Unlock()
+}
+
+// len returns the number of items in s.
+func (s *memoryStorage) len() int {
+	return int(atomic.LoadInt64(&s.n))
+}
+
+// sizeBytes returns the total size of the items in s.
+func (s *memoryStorage) sizeBytes() uint64 {
+	return uint64(atomic.LoadInt64(&s.size))
+}
+
+// snapshot returns the entries in s, from most to least recently used
+// (within each shard, if there is more than one). The entries must
+// not be modified.
+func (s *memoryStorage) snapshot() []*cacheEntry {
+	entries := make([]*cacheEntry, 0, s.len())
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		sh.lruMu.Lock()
+		for elem := sh.lru.Front(); elem != nil; elem = elem.Next() {
+			entries = append(entries, elem.Value.(*cacheEntry))
+		}
+		sh.lruMu.Unlock()
+		sh.mu.RUnlock()
+	}
+	return entries
+}
+
+// overLimit reports whether s exceeds MaxSize or MaxEntries.
+func (s *memoryStorage) overLimit() bool {
+	maxSize := s.c.maxSize()
+	return (maxSize != 0 && s.sizeBytes() > maxSize) || (s.c.MaxEntries > 0 && s.len() > s.c.MaxEntries)
+}
+
+// removeElement removes elem from sh. The caller must hold the lock
+// acquired by sh.lock.
+func (s *memoryStorage) removeElement(sh *memoryShard, elem *list.Element) {
+	entry := sh.lru.Remove(elem).(*cacheEntry)
+	delete(sh.results, entry.key)
+	if s.policy != nil {
+		s.policy.Remove(entry.key)
+	}
+	sh.size -= entry.size()
+	atomic.AddInt64(&s.size, -int64(entry.size()))
+	atomic.AddInt64(&s.n, -1)
+}
+
+// removeFunc removes all items from s whose key satisfies f, for the
+// given reason (passed to Cache.OnEvict). It returns the number of
+// items removed.
+func (s *memoryStorage) removeFunc(f func(key string) bool, reason EvictReason) int {
+	var n int
+	for _, sh := range s.shards {
+		var removed []string
+		sh.lock()
+		for key, elem := range sh.results {
+			if f(key) {
+				s.removeElement(sh, elem)
+				n++
+				if s.c.OnEvict != nil {
+					removed = append(removed, key)
+				}
+			}
+		}
+		sh.unlock()
+		s.c.onEvictKeys(removed, reason)
+	}
+	return n
+}
+
+// removeExpired removes all expired items from s (except those kept
+// for Cache.MaxStale).
+func (s *memoryStorage) removeExpired() {
+	now := s.c.timeNow()
+	for _, sh := range s.shards {
+		var expired []string
+		sh.lock()
+		for key, elem := range sh.results {
+			if entry := elem.Value.(*cacheEntry); now.After(s.c.removeAfter(entry.expiry)) {
+				s.removeElement(sh, elem)
+				atomic.AddUint64(&s.c.stats.expirations, 1)
+				if s.c.logging() {
+					s.c.logf("Cache: EXPIRED %s (size %d)", key, s.sizeBytes())
+				}
+				if s.c.OnEvict != nil {
+					expired = append(expired, key)
+				}
+			}
+		}
+		sh.unlock()
+		s.c.onEvictKeys(expired, EvictExpired)
+	}
+}
@@ -0,0 +1,161 @@
+package grpccache_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// mapStorage is a grpccache.Storage backed by a map.
+type mapStorage struct {
+	mu      sync.Mutex
+	items   map[string]mapStorageItem
+	deletes int
+}
+
+type mapStorageItem struct {
+	data   []byte
+	cc     grpccache.CacheControl
+	expiry time.Time
+}
+
+func (s *mapStorage) Get(key string) ([]byte, grpccache.CacheControl, time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	return item.data, item.cc, item.expiry, ok, nil
+}
+
+func (s *mapStorage) Set(key string, data []byte, cc grpccache.CacheControl, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.items == nil {
+		s.items = map[string]mapStorageItem{}
+	}
+	s.items[key] = mapStorageItem{data: data, cc: cc, expiry: expiry}
+	return nil
+}
+
+func (s *mapStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+	s.deletes++
+	return nil
+}
+
+func (s *mapStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = nil
+	return nil
+}
+
+func (s *mapStorage) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// failingStorage is a grpccache.Storage that is unavailable.
+type failingStorage struct{}
+
+var errStorageUnavailable = errors.New("storage unavailable")
+
+func (failingStorage) Get(key string) ([]byte, grpccache.CacheControl, time.Time, bool, error) {
+	return nil, grpccache.CacheControl{}, time.Time{}, false, errStorageUnavailable
+}
+
+func (failingStorage) Set(key string, data []byte, cc grpccache.CacheControl, expiry time.Time) error {
+	return errStorageUnavailable
+}
+
+func (failingStorage) Delete(key string) error { return errStorageUnavailable }
+func (failingStorage) Clear() error            { return errStorageUnavailable }
+
+func TestCache_Storage(t *testing.T) {
+	ctx := context.Background()
+	storage := &mapStorage{}
+	c := &grpccache.Cache{Storage: storage}
+	clock := &fakeClock{t: time.Now()}
+	grpccache.SetNow(c, clock.Now)
+
+	start := clock.Now()
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, maxAgeTrailer(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storage.len(), 2; got != want {
+		t.Fatalf("got %d items in storage, want %d", got, want)
+	}
+	for _, item := range storage.items {
+		if want := start.Add(item.cc.MaxAge); !item.expiry.Equal(want) {
+			t.Errorf("got expiry %s, want %s", item.expiry, want)
+		}
+	}
+
+	if !isCached(t, c, 1) {
+		t.Error("1 not cached")
+	}
+	clock.Advance(2 * time.Second)
+	if isCached(t, c, 2) {
+		t.Error("2 cached, want it to have expired")
+	}
+	if got, want := storage.deletes, 1; got != want {
+		t.Errorf("got %d deletes, want %d", got, want)
+	}
+
+	c.Clear()
+	if got := storage.len(); got != 0 {
+		t.Errorf("after Clear: got %d items in storage, want 0", got)
+	}
+}
+
+func TestCache_Storage_errors(t *testing.T) {
+	ts := &testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, ts)
+	defer done()
+	c := &testpb.CachedTestClient{
+		TestClient: testpb.NewTestClient(cc),
+		Cache:      &grpccache.Cache{Storage: failingStorage{}},
+	}
+
+	// The calls succeed, uncached.
+	for i := 0; i < 2; i++ {
+		result, err := c.TestMethod(context.Background(), &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.X != 1 {
+			t.Errorf("got result %d, want 1", result.X)
+		}
+	}
+	if want := 2; len(ts.calls) != want {
+		t.Errorf("got %d calls, want %d", len(ts.calls), want)
+	}
+}
+
+func TestCache_Storage_badData(t *testing.T) {
+	ctx := context.Background()
+	storage := &mapStorage{}
+	c := &grpccache.Cache{Storage: storage}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for key, item := range storage.items {
+		item.data = nil
+		storage.items[key] = item
+	}
+
+	// The corrupt item is treated as a miss.
+	if isCached(t, c, 1) {
+		t.Error("got cached result with corrupt data, want miss")
+	}
+}
@@ -0,0 +1,173 @@
+package grpccache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// StreamResults holds all of the results of a call to a
+// server-streaming method, which are cached together as a single
+// item (see GetOrCallStream). It is the result message passed to
+// CacheableFunc, TTLFunc, and other hooks for server-streaming
+// methods.
+type StreamResults struct {
+	Results []proto.Message
+
+	newResult func() proto.Message // allocates a result (for unmarshaling)
+}
+
+func (r *StreamResults) Reset() { r.Results = nil }
+
+func (r *StreamResults) String() string {
+	s := make([]string, len(r.Results))
+	for i, result := range r.Results {
+		s[i] = result.String()
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func (*StreamResults) ProtoMessage() {}
+
+// marshalStreamResults marshals each of r's results using m,
+// prefixing each with its length (as a uvarint).
+func marshalStreamResults(m Marshaler, r *StreamResults) ([]byte, error) {
+	var data []byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, result := range r.Results {
+		b, err := m.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+		data = append(data, lenBuf[:n]...)
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+// unmarshalStreamResults is the inverse of marshalStreamResults.
+func unmarshalStreamResults(m Marshaler, data []byte, r *StreamResults) error {
+	if r.newResult == nil {
+		return errors.New("grpccache: StreamResults has no result type")
+	}
+	r.Results = nil
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return fmt.Errorf("grpccache: malformed stream results (%d bytes remaining)", len(data))
+		}
+		data = data[n:]
+		result := r.newResult()
+		if err := m.Unmarshal(data[:size], result); err != nil {
+			return err
+		}
+		r.Results = append(r.Results, result)
+		data = data[size:]
+	}
+	return nil
+}
+
+// GetOrCallStream returns a stream of the cached results of a call to
+// the server-streaming method with arg, if there are any. Otherwise it
+// makes the call (using call), receives all of the stream's results,
+// stores them (per the cache-control in the stream's header and
+// trailer), and returns a stream that replays them. It is used by the
+// CachedXyzClient auto-generated wrapper methods for server-streaming
+// methods.
+//
+// result is an instance of the method's result type; it is only used
+// to allocate results. The returned stream's RecvMsg writes each
+// result in turn to its argument (which must be of the same type) and
+// then returns io.EOF (or the error that ended the original stream).
+//
+// All of the stream's results are cached together, so GetOrCallStream
+// must only be used for methods whose streams are finite (and fit in
+// the cache). Streams that end in an error are not cached, except per
+// StoreError. Stale results are not revalidated in the background,
+// and calls are not coalesced by SingleFlight.
+func (c *Cache) GetOrCallStream(ctx context.Context, method string, arg proto.Message, result proto.Message, call func(ctx context.Context) (grpc.ClientStream, error)) (grpc.ClientStream, error) {
+	if c == nil {
+		return call(ctx)
+	}
+
+	resultType := reflect.TypeOf(result).Elem()
+	results := &StreamResults{
+		newResult: func() proto.Message { return reflect.New(resultType).Interface().(proto.Message) },
+	}
+	cached, err := c.Get(ctx, method, arg, results)
+	if cached {
+		return &replayStream{ctx: ctx, results: results.Results, err: err}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := call(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		result := results.newResult()
+		if err = stream.RecvMsg(result); err != nil {
+			break
+		}
+		results.Results = append(results.Results, result)
+	}
+	header, _ := stream.Header()
+	trailer := stream.Trailer()
+	md := Internal_CacheControlMetadata(header, trailer)
+	replay := &replayStream{ctx: stream.Context(), results: results.Results, header: header, trailer: trailer}
+	if err != io.EOF {
+		// Replay the results received before the error, and then the
+		// error.
+		replay.err = err
+		if err := c.StoreError(ctx, method, arg, err, md); err != nil {
+			return nil, err
+		}
+		return replay, nil
+	}
+	if err := c.Store(ctx, method, arg, results, md); err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// replayStream is a grpc.ClientStream that replays the results of a
+// server-streaming call (see GetOrCallStream).
+type replayStream struct {
+	ctx     context.Context
+	results []proto.Message
+	err     error // returned after all results (io.EOF if nil)
+
+	header, trailer metadata.MD
+}
+
+func (s *replayStream) Header() (metadata.MD, error) { return s.header, nil }
+func (s *replayStream) Trailer() metadata.MD         { return s.trailer }
+func (s *replayStream) CloseSend() error             { return nil }
+func (s *replayStream) Context() context.Context     { return s.ctx }
+
+func (s *replayStream) SendMsg(m interface{}) error {
+	return errors.New("grpccache: SendMsg called on a server-streaming call's stream")
+}
+
+func (s *replayStream) RecvMsg(m interface{}) error {
+	if len(s.results) == 0 {
+		if s.err != nil {
+			return s.err
+		}
+		return io.EOF
+	}
+	copyMessage(m.(proto.Message), s.results[0])
+	s.results = s.results[1:]
+	return nil
+}
@@ -0,0 +1,185 @@
+package grpccache_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// streamTestServer is a testpb.StreamTestServer. TestStream sends
+// op.A results, with a max-age of streamMaxAge (if nonzero), which it
+// sets before sending the results (or after, if lateCacheControl).
+type streamTestServer struct {
+	unaryCalls, streamCalls int
+	streamMaxAge            time.Duration
+	lateCacheControl        bool
+}
+
+func (s *streamTestServer) TestUnary(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.unaryCalls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour})
+	return &testpb.TestResult{X: op.A}, nil
+}
+
+func (s *streamTestServer) TestStream(op *testpb.TestOp, stream testpb.StreamTest_TestStreamServer) error {
+	s.streamCalls++
+	if s.streamMaxAge != 0 && !s.lateCacheControl {
+		grpccache.SetCacheControl(stream.Context(), grpccache.CacheControl{MaxAge: s.streamMaxAge})
+	}
+	for i := int32(0); i < op.A; i++ {
+		if err := stream.Send(&testpb.TestResult{X: i}); err != nil {
+			return err
+		}
+	}
+	if s.streamMaxAge != 0 && s.lateCacheControl {
+		grpccache.SetCacheControl(stream.Context(), grpccache.CacheControl{MaxAge: s.streamMaxAge})
+	}
+	return nil
+}
+
+// Streams with no cache-control are not cached, but the generated
+// wrappers must still return all of their results.
+func TestCachedStreamTest(t *testing.T) {
+	var ts streamTestServer
+	c, done := newStreamTestClient(t, &ts)
+	defer done()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.TestUnary(ctx, &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := 1; ts.unaryCalls != want {
+		t.Errorf("got %d unary calls, want %d", ts.unaryCalls, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		if n := recvStreamTest(t, c, 3); n != 3 {
+			t.Errorf("got %d stream results, want 3", n)
+		}
+	}
+	if want := 2; ts.streamCalls != want {
+		t.Errorf("got %d stream calls, want %d", ts.streamCalls, want)
+	}
+}
+
+func TestCachedStreamTest_cached(t *testing.T) {
+	ts := streamTestServer{streamMaxAge: time.Hour}
+	c, done := newStreamTestClient(t, &ts)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		if n := recvStreamTest(t, c, 3); n != 3 {
+			t.Errorf("got %d stream results, want 3", n)
+		}
+	}
+	if want := 1; ts.streamCalls != want {
+		t.Errorf("got %d stream calls, want %d (results should be cached)", ts.streamCalls, want)
+	}
+
+	// Other args are cached separately (including empty streams).
+	for i := 0; i < 2; i++ {
+		if n := recvStreamTest(t, c, 0); n != 0 {
+			t.Errorf("got %d stream results, want 0", n)
+		}
+	}
+	if want := 2; ts.streamCalls != want {
+		t.Errorf("got %d stream calls, want %d", ts.streamCalls, want)
+	}
+}
+
+// The cache-control is sent in the stream's header, unless it is set
+// after the first result is sent (in which case it is sent in the
+// trailer). Either way, the results are cached.
+func TestCachedStreamTest_header(t *testing.T) {
+	for _, late := range []bool{false, true} {
+		ts := streamTestServer{streamMaxAge: time.Hour, lateCacheControl: late}
+		c, done := newStreamTestClient(t, &ts)
+
+		var header, trailer metadata.MD
+		stream, err := c.StreamTestClient.TestStream(context.Background(), &testpb.TestOp{A: 2}, grpc.Header(&header), grpc.Trailer(&trailer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		inHeader, inTrailer := header["grpccache-max-age"] != "", trailer["grpccache-max-age"] != ""
+		if inHeader == late || inTrailer != late {
+			t.Errorf("late %v: got cache-control in header %v and trailer %v, want it only in the %s", late, inHeader, inTrailer, map[bool]string{false: "header", true: "trailer"}[late])
+		}
+
+		for i := 0; i < 2; i++ {
+			if n := recvStreamTest(t, c, 3); n != 3 {
+				t.Errorf("late %v: got %d stream results, want 3", late, n)
+			}
+		}
+		if want := 2; ts.streamCalls != want {
+			t.Errorf("late %v: got %d stream calls, want %d (results should be cached)", late, ts.streamCalls, want)
+		}
+		done()
+	}
+}
+
+// newStreamTestClient starts a server for ts and returns a client
+// (with a cache) that calls it. The caller must call done when
+// finished.
+func newStreamTestClient(t *testing.T, ts *streamTestServer) (c *testpb.CachedStreamTestClient, done func()) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	testpb.RegisterStreamTestServer(gs, &testpb.CachedStreamTestServer{StreamTestServer: ts})
+	go func() {
+		if err := gs.Serve(l); err != nil {
+			t.Log("warning: Serve:", err)
+		}
+	}()
+	cc, err := grpc.Dial(l.Addr().String())
+	if err != nil {
+		gs.Stop()
+		t.Fatal(err)
+	}
+	c = &testpb.CachedStreamTestClient{StreamTestClient: testpb.NewStreamTestClient(cc), Cache: &grpccache.Cache{}}
+	return c, func() {
+		cc.Close()
+		gs.Stop()
+	}
+}
+
+// recvStreamTest calls c.TestStream to get a stream of a results,
+// checks them, and returns the number of results received.
+func recvStreamTest(t *testing.T, c *testpb.CachedStreamTestClient, a int32) int32 {
+	stream, err := c.TestStream(context.Background(), &testpb.TestOp{A: a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int32
+	for {
+		r, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != n {
+			t.Errorf("got result %d, want %d", r.X, n)
+		}
+		n++
+	}
+	return n
+}
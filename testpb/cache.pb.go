@@ -2,7 +2,7 @@
 //
 // Generated by:
 //
-//   go run gen_trace.go -o cache.pb.go -pkg testpb -files sourcegraph.com/sqs/grpccache/testpb@test.pb.go
+//   go run gen_trace.go -o cache.pb.go -pkg testpb -stream StreamTest.TestStream -files sourcegraph.com/sqs/grpccache/testpb@test.pb.go
 //
 // Called via:
 //
@@ -18,11 +18,188 @@ import (
 	"sourcegraph.com/sqs/grpccache"
 )
 
+type CachedStreamTestServer struct{ StreamTestServer }
+
+var _ StreamTestServer = (*CachedStreamTestServer)(nil)
+
+// TestUnary wraps StreamTestServer.TestUnary, sending the cache-control
+// set by the method (via grpccache.SetCacheControl) to the client in the
+// response trailer.
+func (s *CachedStreamTestServer) TestUnary(ctx context.Context, in *TestOp) (*TestResult, error) {
+	ctx, cc := grpccache.Internal_WithCacheControl(ctx)
+	result, err := s.StreamTestServer.TestUnary(ctx, in)
+	if err == grpccache.ErrNotModified {
+		grpccache.Internal_SetNotModified(cc)
+		result, err = new(TestResult), nil
+	}
+	if !cc.IsZero() {
+		if err := grpccache.Internal_SetCacheControlTrailer(ctx, *cc); err != nil {
+			return nil, err
+		}
+	}
+	return result, err
+}
+
+// TestStream wraps StreamTestServer.TestStream, sending the
+// cache-control set by the method (via grpccache.SetCacheControl before
+// it sends its first result) to the client in the stream's header.
+func (s *CachedStreamTestServer) TestStream(in *TestOp, stream StreamTest_TestStreamServer) error {
+	ctx, cc := grpccache.Internal_WithCacheControl(stream.Context())
+	m := &cachedStreamTest_TestStreamServer{StreamTest_TestStreamServer: stream, ctx: ctx, cc: cc}
+	err := s.StreamTestServer.TestStream(in, m)
+	if err := m.sendCacheControl(); err != nil {
+		return err
+	}
+	return err
+}
+
+// cachedStreamTest_TestStreamServer is a StreamTest_TestStreamServer
+// whose context holds the cache-control set by the method, which it
+// sends before the first result.
+type cachedStreamTest_TestStreamServer struct {
+	StreamTest_TestStreamServer
+	ctx  context.Context
+	cc   *grpccache.CacheControl
+	sent bool // whether the cache-control was sent
+}
+
+func (s *cachedStreamTest_TestStreamServer) Context() context.Context { return s.ctx }
+
+func (s *cachedStreamTest_TestStreamServer) Send(m *TestResult) error {
+	if err := s.sendCacheControl(); err != nil {
+		return err
+	}
+	return s.StreamTest_TestStreamServer.Send(m)
+}
+
+// sendCacheControl sends the cache-control set by the method (if any,
+// and if it was not already sent) in the stream's header, or in its
+// trailer if the header was already sent (e.g., because the method set
+// the cache-control after sending a result).
+func (s *cachedStreamTest_TestStreamServer) sendCacheControl() error {
+	if s.sent || s.cc.IsZero() {
+		return nil
+	}
+	s.sent = true
+	return grpccache.Internal_SetCacheControlHeaderOrTrailer(s.ctx, *s.cc)
+}
+
+// CachedStreamTestClient wraps StreamTestClient with client-side caching
+// via grpccache. Calls use Cache, or the cache set by
+// grpccache.WithCache in the call's context (if any). If the cache is
+// nil, calls are passed through to StreamTestClient unchanged (with no
+// caching overhead), so a CachedStreamTestClient with a nil Cache
+// behaves exactly like the underlying client.
+type CachedStreamTestClient struct {
+	StreamTestClient
+	Cache *grpccache.Cache
+}
+
+var _ StreamTestClient = (*CachedStreamTestClient)(nil)
+
+// NewCachedStreamTestClient returns a CachedStreamTestClient that makes
+// calls on cc and caches their results in cache.
+func NewCachedStreamTestClient(cc *grpc.ClientConn, cache *grpccache.Cache) *CachedStreamTestClient {
+	return &CachedStreamTestClient{StreamTestClient: NewStreamTestClient(cc), Cache: cache}
+}
+
+// TestUnary wraps StreamTestClient.TestUnary with client-side caching
+// via grpccache.
+func (s *CachedStreamTestClient) TestUnary(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (*TestResult, error) {
+	cache := grpccache.Internal_CacheFromContext(ctx, s.Cache)
+	if cache == nil {
+		return s.StreamTestClient.TestUnary(ctx, in, opts...)
+	}
+
+	call := func(ctx context.Context) (interface{}, error) {
+		var header, trailer metadata.MD
+
+		result, err := s.StreamTestClient.TestUnary(ctx, in, append(opts[:len(opts):len(opts)], grpc.Header(&header), grpc.Trailer(&trailer))...)
+		md := grpccache.Internal_CacheControlMetadata(header, trailer)
+		if err != nil {
+			if err := cache.StoreError(ctx, "StreamTest.TestUnary", in, err, md); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+		if result != nil {
+			if err := cache.Store(ctx, "StreamTest.TestUnary", in, result, md); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	var cachedResult TestResult
+	cached, revalidate, err := cache.GetStale(ctx, "StreamTest.TestUnary", in, &cachedResult)
+	if revalidate {
+		cache.Revalidate(ctx, "StreamTest.TestUnary", in, call)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		return &cachedResult, nil
+	}
+
+	ctx = grpccache.Internal_WithCachedETag(ctx, cache, "StreamTest.TestUnary", in)
+	result, err := cache.Do(ctx, "StreamTest.TestUnary", in, func() (interface{}, error) { return call(ctx) })
+	if err != nil {
+		var staleResult TestResult
+		if cached, err := cache.GetIfError(ctx, "StreamTest.TestUnary", in, &staleResult, err); cached {
+			if err != nil {
+				return nil, err
+			}
+			return &staleResult, nil
+		}
+		return nil, err
+	}
+	return result.(*TestResult), nil
+}
+
+// TestStream wraps StreamTestClient.TestStream with client-side caching
+// via grpccache. All of the stream's results are received (and cached)
+// before TestStream returns.
+func (s *CachedStreamTestClient) TestStream(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (StreamTest_TestStreamClient, error) {
+	cache := grpccache.Internal_CacheFromContext(ctx, s.Cache)
+	if cache == nil {
+		return s.StreamTestClient.TestStream(ctx, in, opts...)
+	}
+	stream, err := cache.GetOrCallStream(ctx, "StreamTest.TestStream", in, new(TestResult), func(ctx context.Context) (grpc.ClientStream, error) {
+		return s.StreamTestClient.TestStream(ctx, in, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cachedStreamTest_TestStreamClient{stream}, nil
+}
+
+// cachedStreamTest_TestStreamClient is a StreamTest_TestStreamClient
+// that receives the results replayed by grpccache.Cache.GetOrCallStream.
+type cachedStreamTest_TestStreamClient struct{ grpc.ClientStream }
+
+func (s cachedStreamTest_TestStreamClient) Recv() (*TestResult, error) {
+	m := new(TestResult)
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 type CachedTestServer struct{ TestServer }
 
+var _ TestServer = (*CachedTestServer)(nil)
+
+// TestMethod wraps TestServer.TestMethod, sending the cache-control set
+// by the method (via grpccache.SetCacheControl) to the client in the
+// response trailer.
 func (s *CachedTestServer) TestMethod(ctx context.Context, in *TestOp) (*TestResult, error) {
 	ctx, cc := grpccache.Internal_WithCacheControl(ctx)
 	result, err := s.TestServer.TestMethod(ctx, in)
+	if err == grpccache.ErrNotModified {
+		grpccache.Internal_SetNotModified(cc)
+		result, err = new(TestResult), nil
+	}
 	if !cc.IsZero() {
 		if err := grpccache.Internal_SetCacheControlTrailer(ctx, *cc); err != nil {
 			return nil, err
@@ -31,33 +208,75 @@ func (s *CachedTestServer) TestMethod(ctx context.Context, in *TestOp) (*TestRes
 	return result, err
 }
 
+// CachedTestClient wraps TestClient with client-side caching via
+// grpccache. Calls use Cache, or the cache set by grpccache.WithCache in
+// the call's context (if any). If the cache is nil, calls are passed
+// through to TestClient unchanged (with no caching overhead), so a
+// CachedTestClient with a nil Cache behaves exactly like the underlying
+// client.
 type CachedTestClient struct {
 	TestClient
 	Cache *grpccache.Cache
 }
 
+var _ TestClient = (*CachedTestClient)(nil)
+
+// NewCachedTestClient returns a CachedTestClient that makes calls on cc
+// and caches their results in cache.
+func NewCachedTestClient(cc *grpc.ClientConn, cache *grpccache.Cache) *CachedTestClient {
+	return &CachedTestClient{TestClient: NewTestClient(cc), Cache: cache}
+}
+
+// TestMethod wraps TestClient.TestMethod with client-side caching via
+// grpccache.
 func (s *CachedTestClient) TestMethod(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (*TestResult, error) {
-	if s.Cache != nil {
-		var cachedResult TestResult
-		cached, err := s.Cache.Get(ctx, "Test.TestMethod", in, &cachedResult)
+	cache := grpccache.Internal_CacheFromContext(ctx, s.Cache)
+	if cache == nil {
+		return s.TestClient.TestMethod(ctx, in, opts...)
+	}
+
+	call := func(ctx context.Context) (interface{}, error) {
+		var header, trailer metadata.MD
+
+		result, err := s.TestClient.TestMethod(ctx, in, append(opts[:len(opts):len(opts)], grpc.Header(&header), grpc.Trailer(&trailer))...)
+		md := grpccache.Internal_CacheControlMetadata(header, trailer)
 		if err != nil {
+			if err := cache.StoreError(ctx, "Test.TestMethod", in, err, md); err != nil {
+				return nil, err
+			}
 			return nil, err
 		}
-		if cached {
-			return &cachedResult, nil
+		if result != nil {
+			if err := cache.Store(ctx, "Test.TestMethod", in, result, md); err != nil {
+				return nil, err
+			}
 		}
+		return result, nil
 	}
 
-	var trailer metadata.MD
-
-	result, err := s.TestClient.TestMethod(ctx, in, grpc.Trailer(&trailer))
+	var cachedResult TestResult
+	cached, revalidate, err := cache.GetStale(ctx, "Test.TestMethod", in, &cachedResult)
+	if revalidate {
+		cache.Revalidate(ctx, "Test.TestMethod", in, call)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if s.Cache != nil {
-		if err := s.Cache.Store(ctx, "Test.TestMethod", in, result, trailer); err != nil {
-			return nil, err
+	if cached {
+		return &cachedResult, nil
+	}
+
+	ctx = grpccache.Internal_WithCachedETag(ctx, cache, "Test.TestMethod", in)
+	result, err := cache.Do(ctx, "Test.TestMethod", in, func() (interface{}, error) { return call(ctx) })
+	if err != nil {
+		var staleResult TestResult
+		if cached, err := cache.GetIfError(ctx, "Test.TestMethod", in, &staleResult, err); cached {
+			if err != nil {
+				return nil, err
+			}
+			return &staleResult, nil
 		}
+		return nil, err
 	}
-	return result, nil
+	return result.(*TestResult), nil
 }
@@ -2,4 +2,4 @@ package testpb
 
 //go:generate protoc -I. --go_out=plugins=grpc:. test.proto
 
-//go:generate go run ../grpccache-gen/main.go -o cache.pb.go -pkg testpb -files "sourcegraph.com/sqs/grpccache/testpb@test.pb.go"
+//go:generate go run ../grpccache-gen/main.go -o cache.pb.go -pkg testpb -stream StreamTest.TestStream -files "sourcegraph.com/sqs/grpccache/testpb@test.pb.go"
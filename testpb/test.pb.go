@@ -30,8 +30,9 @@ var _ grpc.ClientConn
 var _ = proto.Marshal
 
 type TestOp struct {
-	A int32 `protobuf:"varint,2,opt,name=a" json:"a,omitempty"`
-	B []*T  `protobuf:"bytes,3,rep,name=b" json:"b,omitempty"`
+	A int32             `protobuf:"varint,2,opt,name=a" json:"a,omitempty"`
+	B []*T              `protobuf:"bytes,3,rep,name=b" json:"b,omitempty"`
+	C map[string]string `protobuf:"bytes,4,rep,name=c" json:"c,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *TestOp) Reset()         { *m = TestOp{} }
@@ -45,6 +46,13 @@ func (m *TestOp) GetB() []*T {
 	return nil
 }
 
+func (m *TestOp) GetC() map[string]string {
+	if m != nil {
+		return m.C
+	}
+	return nil
+}
+
 type T struct {
 	A bool `protobuf:"varint,1,opt,name=a" json:"a,omitempty"`
 }
@@ -117,3 +125,121 @@ var _Test_serviceDesc = grpc.ServiceDesc{
 	},
 	Streams: []grpc.StreamDesc{},
 }
+
+// Client API for StreamTest service
+
+type StreamTestClient interface {
+	TestUnary(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (*TestResult, error)
+	TestStream(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (StreamTest_TestStreamClient, error)
+}
+
+type streamTestClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewStreamTestClient(cc *grpc.ClientConn) StreamTestClient {
+	return &streamTestClient{cc}
+}
+
+func (c *streamTestClient) TestUnary(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (*TestResult, error) {
+	out := new(TestResult)
+	err := grpc.Invoke(ctx, "/testpb.StreamTest/TestUnary", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *streamTestClient) TestStream(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (StreamTest_TestStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_StreamTest_serviceDesc.Streams[0], c.cc, "/testpb.StreamTest/TestStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &streamTestTestStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StreamTest_TestStreamClient interface {
+	Recv() (*TestResult, error)
+	grpc.ClientStream
+}
+
+type streamTestTestStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *streamTestTestStreamClient) Recv() (*TestResult, error) {
+	m := new(TestResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for StreamTest service
+
+type StreamTestServer interface {
+	TestUnary(context.Context, *TestOp) (*TestResult, error)
+	TestStream(*TestOp, StreamTest_TestStreamServer) error
+}
+
+func RegisterStreamTestServer(s *grpc.Server, srv StreamTestServer) {
+	s.RegisterService(&_StreamTest_serviceDesc, srv)
+}
+
+func _StreamTest_TestUnary_Handler(srv interface{}, ctx context.Context, codec grpc.Codec, buf []byte) (interface{}, error) {
+	in := new(TestOp)
+	if err := codec.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	out, err := srv.(StreamTestServer).TestUnary(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func _StreamTest_TestStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TestOp)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StreamTestServer).TestStream(m, &streamTestTestStreamServer{stream})
+}
+
+type StreamTest_TestStreamServer interface {
+	Send(*TestResult) error
+	grpc.ServerStream
+}
+
+type streamTestTestStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *streamTestTestStreamServer) Send(m *TestResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _StreamTest_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "testpb.StreamTest",
+	HandlerType: (*StreamTestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TestUnary",
+			Handler:    _StreamTest_TestUnary_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TestStream",
+			Handler:       _StreamTest_TestStream_Handler,
+			ServerStreams: true,
+		},
+	},
+}
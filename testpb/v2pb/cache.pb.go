@@ -0,0 +1,115 @@
+// GENERATED CODE - DO NOT EDIT!
+//
+// Generated by:
+//
+//   go run gen_trace.go -o cache.pb.go -pkg v2pb -files sourcegraph.com/sqs/grpccache/testpb/v2pb@.
+//
+// Called via:
+//
+//   go generate
+//
+
+package v2pb
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+)
+
+type CachedTestServer struct{ TestServer }
+
+var _ TestServer = (*CachedTestServer)(nil)
+
+// TestMethod wraps TestServer.TestMethod, sending the cache-control set
+// by the method (via grpccache.SetCacheControl) to the client in the
+// response trailer.
+func (s *CachedTestServer) TestMethod(ctx context.Context, in *TestOp) (*TestResult, error) {
+	ctx, cc := grpccache.Internal_WithCacheControl(ctx)
+	result, err := s.TestServer.TestMethod(ctx, in)
+	if err == grpccache.ErrNotModified {
+		grpccache.Internal_SetNotModified(cc)
+		result, err = new(TestResult), nil
+	}
+	if !cc.IsZero() {
+		if err := grpccache.Internal_SetCacheControlTrailer(ctx, *cc); err != nil {
+			return nil, err
+		}
+	}
+	return result, err
+}
+
+// CachedTestClient wraps TestClient with client-side caching via
+// grpccache. Calls use Cache, or the cache set by grpccache.WithCache in
+// the call's context (if any). If the cache is nil, calls are passed
+// through to TestClient unchanged (with no caching overhead), so a
+// CachedTestClient with a nil Cache behaves exactly like the underlying
+// client.
+type CachedTestClient struct {
+	TestClient
+	Cache *grpccache.Cache
+}
+
+var _ TestClient = (*CachedTestClient)(nil)
+
+// NewCachedTestClient returns a CachedTestClient that makes calls on cc
+// and caches their results in cache.
+func NewCachedTestClient(cc *grpc.ClientConn, cache *grpccache.Cache) *CachedTestClient {
+	return &CachedTestClient{TestClient: NewTestClient(cc), Cache: cache}
+}
+
+// TestMethod wraps TestClient.TestMethod with client-side caching via
+// grpccache.
+func (s *CachedTestClient) TestMethod(ctx context.Context, in *TestOp, opts ...grpc.CallOption) (*TestResult, error) {
+	cache := grpccache.Internal_CacheFromContext(ctx, s.Cache)
+	if cache == nil {
+		return s.TestClient.TestMethod(ctx, in, opts...)
+	}
+
+	call := func(ctx context.Context) (interface{}, error) {
+		var header, trailer metadata.MD
+
+		result, err := s.TestClient.TestMethod(ctx, in, append(opts[:len(opts):len(opts)], grpc.Header(&header), grpc.Trailer(&trailer))...)
+		md := grpccache.Internal_CacheControlMetadata(header, trailer)
+		if err != nil {
+			if err := cache.StoreError(ctx, "Test.TestMethod", in, err, md); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+		if result != nil {
+			if err := cache.Store(ctx, "Test.TestMethod", in, result, md); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	var cachedResult TestResult
+	cached, revalidate, err := cache.GetStale(ctx, "Test.TestMethod", in, &cachedResult)
+	if revalidate {
+		cache.Revalidate(ctx, "Test.TestMethod", in, call)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		return &cachedResult, nil
+	}
+
+	ctx = grpccache.Internal_WithCachedETag(ctx, cache, "Test.TestMethod", in)
+	result, err := cache.Do(ctx, "Test.TestMethod", in, func() (interface{}, error) { return call(ctx) })
+	if err != nil {
+		var staleResult TestResult
+		if cached, err := cache.GetIfError(ctx, "Test.TestMethod", in, &staleResult, err); cached {
+			if err != nil {
+				return nil, err
+			}
+			return &staleResult, nil
+		}
+		return nil, err
+	}
+	return result.(*TestResult), nil
+}
@@ -0,0 +1,8 @@
+// Package v2pb contains test types generated for the
+// google.golang.org/protobuf runtime (by its protoc-gen-go and by
+// protoc-gen-go-grpc).
+package v2pb
+
+//go:generate protoc -I. --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative test.proto
+
+//go:generate go run ../../grpccache-gen/main.go -o cache.pb.go -pkg v2pb -files "sourcegraph.com/sqs/grpccache/testpb/v2pb@."
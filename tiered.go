@@ -0,0 +1,67 @@
+package grpccache
+
+import "time"
+
+// TieredStorage is a Storage that combines a fast (typically
+// in-memory, process-local) storage L1 with a slower (typically
+// shared, such as Redis) storage L2, so that a miss in L1 can still be
+// a hit in L2. Each item keeps its expiry in both tiers.
+//
+// For example, to back a cache's in-memory storage with Redis:
+//
+//	c := &grpccache.Cache{MaxSize: 64 << 20}
+//	c.Storage = &grpccache.TieredStorage{L1: c.MemoryStorage(), L2: &rediscache.Storage{Pool: pool}}
+type TieredStorage struct {
+	L1, L2 Storage
+}
+
+var _ Storage = (*TieredStorage)(nil)
+
+// Get returns the item from L1 if it is present and unexpired.
+// Otherwise it returns the item from L2 (if present), first copying
+// it to L1 (promoting it).
+func (s *TieredStorage) Get(key string) ([]byte, CacheControl, time.Time, bool, error) {
+	data, cc, expiry, ok, err := s.L1.Get(key)
+	if err != nil {
+		return nil, CacheControl{}, time.Time{}, false, err
+	}
+	if ok && expiry.After(time.Now()) {
+		return data, cc, expiry, true, nil
+	}
+
+	data2, cc2, expiry2, ok2, err := s.L2.Get(key)
+	if err != nil {
+		return nil, CacheControl{}, time.Time{}, false, err
+	}
+	if !ok2 {
+		return data, cc, expiry, ok, nil
+	}
+	if err := s.L1.Set(key, data2, cc2, expiry2); err != nil {
+		return nil, CacheControl{}, time.Time{}, false, err
+	}
+	return data2, cc2, expiry2, true, nil
+}
+
+// Set stores the item in both L1 and L2 (writing through).
+func (s *TieredStorage) Set(key string, data []byte, cc CacheControl, expiry time.Time) error {
+	if err := s.L1.Set(key, data, cc, expiry); err != nil {
+		return err
+	}
+	return s.L2.Set(key, data, cc, expiry)
+}
+
+// Delete removes the item from both L1 and L2.
+func (s *TieredStorage) Delete(key string) error {
+	if err := s.L1.Delete(key); err != nil {
+		return err
+	}
+	return s.L2.Delete(key)
+}
+
+// Clear removes all items from both L1 and L2.
+func (s *TieredStorage) Clear() error {
+	if err := s.L1.Clear(); err != nil {
+		return err
+	}
+	return s.L2.Clear()
+}
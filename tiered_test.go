@@ -0,0 +1,110 @@
+package grpccache_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestTieredStorage_writeThrough(t *testing.T) {
+	ctx := context.Background()
+	l1, l2 := &mapStorage{}, &mapStorage{}
+	c := &grpccache.Cache{Storage: &grpccache.TieredStorage{L1: l1, L2: l2}}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l1.len(), 1; got != want {
+		t.Fatalf("got %d items in L1, want %d", got, want)
+	}
+	if got, want := l2.len(), 1; got != want {
+		t.Fatalf("got %d items in L2, want %d", got, want)
+	}
+	for key, item1 := range l1.items {
+		if item2 := l2.items[key]; !item1.expiry.Equal(item2.expiry) || item1.cc.MaxAge != item2.cc.MaxAge {
+			t.Errorf("got L1 item (cc %+v, expiry %s) != L2 item (cc %+v, expiry %s)", item1.cc, item1.expiry, item2.cc, item2.expiry)
+		}
+	}
+
+	c.Clear()
+	if l1.len() != 0 || l2.len() != 0 {
+		t.Errorf("after Clear: got %d items in L1 and %d in L2, want 0", l1.len(), l2.len())
+	}
+}
+
+func TestTieredStorage_promote(t *testing.T) {
+	ctx := context.Background()
+
+	// Store the item in L2 only (as another process sharing L2 would).
+	l2 := &mapStorage{}
+	if err := (&grpccache.Cache{Storage: l2}).Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var l2Item mapStorageItem
+	for _, item := range l2.items {
+		l2Item = item
+	}
+
+	l1 := &mapStorage{}
+	c := &grpccache.Cache{Storage: &grpccache.TieredStorage{L1: l1, L2: l2}}
+	if !isCached(t, c, 1) {
+		t.Fatal("1 not cached, want it to be cached in L2")
+	}
+	if got, want := l1.len(), 1; got != want {
+		t.Fatalf("got %d items in L1, want %d (promoted from L2)", got, want)
+	}
+	for _, item := range l1.items {
+		if !item.expiry.Equal(l2Item.expiry) || item.cc.MaxAge != l2Item.cc.MaxAge {
+			t.Errorf("got promoted item (cc %+v, expiry %s), want (cc %+v, expiry %s)", item.cc, item.expiry, l2Item.cc, l2Item.expiry)
+		}
+	}
+
+	// Later hits are served from L1.
+	l2.Clear()
+	if !isCached(t, c, 1) {
+		t.Error("1 not cached, want it to be cached in L1")
+	}
+}
+
+func TestTieredStorage_expiredInL1(t *testing.T) {
+	ctx := context.Background()
+	l1, l2 := &mapStorage{}, &mapStorage{}
+	c := &grpccache.Cache{Storage: &grpccache.TieredStorage{L1: l1, L2: l2}}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the item in L1 only (as if L2 had been updated by
+	// another process since it was promoted).
+	for key, item := range l1.items {
+		item.expiry = time.Now().Add(-time.Minute)
+		l1.items[key] = item
+	}
+
+	if !isCached(t, c, 1) {
+		t.Fatal("1 not cached, want it to be cached in L2")
+	}
+	for _, item := range l1.items {
+		if !item.expiry.After(time.Now()) {
+			t.Errorf("got expiry %s in L1, want it to be replaced by the unexpired L2 item", item.expiry)
+		}
+	}
+}
+
+func TestTieredStorage_memoryL1(t *testing.T) {
+	ctx := context.Background()
+	l2 := &mapStorage{}
+	c := &grpccache.Cache{}
+	c.Storage = &grpccache.TieredStorage{L1: c.MemoryStorage(), L2: l2}
+
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	l2.Clear()
+	if !isCached(t, c, 1) {
+		t.Error("1 not cached, want it to be cached in memory")
+	}
+}
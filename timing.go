@@ -0,0 +1,39 @@
+package grpccache
+
+import "time"
+
+// Operations whose durations are passed to Cache.OnTiming.
+const (
+	TimingMarshalKey = "marshal-key" // marshaling an arg to compute its cache key
+	TimingHash       = "hash"        // hashing a marshaled arg (with Cache.Hash)
+	TimingMarshal    = "marshal"     // marshaling (and compressing) a result to store it
+	TimingUnmarshal  = "unmarshal"   // unmarshaling (and decompressing) a cached result
+)
+
+// startTiming returns the start time of an operation, if c.OnTiming
+// is set (otherwise it returns the zero time, to avoid reading the
+// clock).
+func (c *Cache) startTiming() time.Time {
+	if c.OnTiming == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// endTiming calls c.OnTiming (if set) with the duration of op, which
+// started at start (returned by startTiming).
+func (c *Cache) endTiming(op string, start time.Time) {
+	if c.OnTiming != nil {
+		c.OnTiming(op, time.Since(start))
+	}
+}
+
+// unmarshal unmarshals data (a stored result) into result.
+func (c *Cache) unmarshal(data []byte, result interface{}) error {
+	start := c.startTiming()
+	if err := c.codec().Unmarshal(data, result); err != nil {
+		return err
+	}
+	c.endTiming(TimingUnmarshal, start)
+	return nil
+}
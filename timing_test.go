@@ -0,0 +1,59 @@
+package grpccache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+func TestCache_OnTiming(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu      sync.Mutex
+		timings = map[string][]time.Duration{}
+	)
+	c := &grpccache.Cache{
+		OnTiming: func(op string, d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			timings[op] = append(timings[op], d)
+		},
+	}
+
+	arg := &testpb.TestOp{A: 1, C: map[string]string{"a": "1", "b": "2", "c": "3"}}
+	if err := c.Store(ctx, "Test.TestMethod", arg, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var result testpb.TestResult
+	if cached, err := c.Get(ctx, "Test.TestMethod", arg, &result); err != nil {
+		t.Fatal(err)
+	} else if !cached {
+		t.Fatal("not cached")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{
+		grpccache.TimingMarshalKey: 2, // Store and Get
+		grpccache.TimingHash:       2,
+		grpccache.TimingMarshal:    1,
+		grpccache.TimingUnmarshal:  1,
+	}
+	for op, n := range want {
+		if got := len(timings[op]); got != n {
+			t.Errorf("%s: got %d timings, want %d", op, got, n)
+		}
+		for _, d := range timings[op] {
+			if d <= 0 || d > time.Minute {
+				t.Errorf("%s: got implausible duration %s", op, d)
+			}
+		}
+	}
+	if len(timings) != len(want) {
+		t.Errorf("got timings for %d ops (%v), want %d", len(timings), timings, len(want))
+	}
+}
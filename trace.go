@@ -0,0 +1,50 @@
+package grpccache
+
+import "golang.org/x/net/context"
+
+// Cache operations, passed to Cache.Tracer.
+const (
+	TraceGet   = "grpccache.Get"   // Get or GetStale
+	TraceStore = "grpccache.Store" // Store or StoreError
+)
+
+// Outcomes of cache operations, passed to the func returned by
+// Cache.Tracer.
+const (
+	TraceHit       = "hit"        // Get found a cached result (or error)
+	TraceMiss      = "miss"       // Get found no cached result
+	TraceExpired   = "expired"    // Get found an expired result (and removed it)
+	TraceStale     = "stale"      // Get found a stale result (and, unlike GetStale, did not return it)
+	TraceStored    = "stored"     // Store stored the result (or error)
+	TraceNotStored = "not-stored" // Store did not store the result (e.g., because it is not cacheable)
+)
+
+// A Tracer traces a cache operation (e.g., by starting a span in a
+// distributed tracing system, such as OpenTelemetry). It is called
+// when the operation (one of the Trace* operation names) on a result
+// of method starts, and the func it returns is called when the
+// operation finishes, with the outcome (one of the Trace* outcomes)
+// and the operation's error (if any).
+//
+// A Tracer that starts spans would typically start a child span of
+// the span in ctx, tag it with the method and outcome, and end it in
+// the returned func.
+type Tracer func(ctx context.Context, op, method string) (finish func(outcome string, err error))
+
+// trace starts tracing an operation, if c.Tracer is set. The returned
+// func must be called when the operation finishes.
+func (c *Cache) trace(ctx context.Context, op, method string) func(outcome string, err error) {
+	if c.Tracer == nil {
+		return func(string, error) {}
+	}
+	return c.Tracer(ctx, op, method)
+}
+
+// storeOutcome returns the outcome of a Store call that did (or did
+// not) store its result.
+func storeOutcome(stored bool) string {
+	if stored {
+		return TraceStored
+	}
+	return TraceNotStored
+}
@@ -0,0 +1,56 @@
+package grpccache_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// recordingTracer records the operations it traces.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string // "op method outcome"
+}
+
+func (t *recordingTracer) trace(ctx context.Context, op, method string) func(outcome string, err error) {
+	return func(outcome string, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, op+" "+method+" "+outcome)
+	}
+}
+
+func TestCache_Tracer(t *testing.T) {
+	var tr recordingTracer
+	c := &grpccache.Cache{Tracer: tr.trace}
+	ctx := context.Background()
+
+	var result testpb.TestResult
+	if _, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &testpb.TestResult{X: 1}, maxAgeTrailer(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(ctx, "Test.TestMethod", &testpb.TestOp{A: 2}, &testpb.TestResult{X: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "Test.TestMethod", &testpb.TestOp{A: 1}, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"grpccache.Get Test.TestMethod miss",
+		"grpccache.Store Test.TestMethod stored",
+		"grpccache.Store Test.TestMethod not-stored",
+		"grpccache.Get Test.TestMethod hit",
+	}
+	if !reflect.DeepEqual(tr.spans, want) {
+		t.Errorf("got spans %q, want %q", tr.spans, want)
+	}
+}
@@ -0,0 +1,47 @@
+package grpccache
+
+import (
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// setVary records vary (see CacheControl.Vary) as the Vary of the most
+// recent response for method.
+func (c *Cache) setVary(method string, vary []string) {
+	c.varyMu.Lock()
+	defer c.varyMu.Unlock()
+	if len(vary) == 0 {
+		delete(c.vary, method)
+		return
+	}
+	if c.vary == nil {
+		c.vary = map[string][]string{}
+	}
+	c.vary[method] = vary
+}
+
+// varyKeyPart returns the part of the cache key derived from the
+// request metadata in ctx whose keys are in method's Vary.
+func (c *Cache) varyKeyPart(ctx context.Context, method string) string {
+	c.varyMu.RLock()
+	vary := c.vary[method]
+	c.varyMu.RUnlock()
+	if len(vary) == 0 {
+		return ""
+	}
+
+	return metadataKeyPart(ctx, vary)
+}
+
+// metadataKeyPart returns the part of the cache key derived from the
+// values of the given keys in the request metadata in ctx.
+func metadataKeyPart(ctx context.Context, keys []string) string {
+	md, _ := metadata.FromContext(ctx)
+	var s string
+	for _, key := range keys {
+		s += "-" + key + "=" + strconv.Quote(md[key])
+	}
+	return s
+}
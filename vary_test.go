@@ -0,0 +1,95 @@
+package grpccache_test
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"sourcegraph.com/sqs/grpccache"
+	"sourcegraph.com/sqs/grpccache/testpb"
+)
+
+// langServer is a testpb.TestServer whose result depends on the "lang"
+// request metadata.
+type langServer struct {
+	calls int
+}
+
+func (s *langServer) TestMethod(ctx context.Context, op *testpb.TestOp) (*testpb.TestResult, error) {
+	s.calls++
+	grpccache.SetCacheControl(ctx, grpccache.CacheControl{MaxAge: time.Hour, Vary: []string{"lang"}})
+	md, _ := metadata.FromContext(ctx)
+	x := op.A
+	if md["lang"] == "fr" {
+		x += 100
+	}
+	return &testpb.TestResult{X: x}, nil
+}
+
+func TestCacheControl_Vary(t *testing.T) {
+	var ts langServer
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := &testpb.CachedTestClient{TestClient: testpb.NewTestClient(cc), Cache: &grpccache.Cache{}}
+
+	for _, test := range []struct {
+		lang      string
+		wantX     int32
+		wantCalls int
+	}{
+		{"en", 1, 1},
+		{"en", 1, 1},
+		{"fr", 101, 2},
+		{"fr", 101, 2},
+		{"en", 1, 2},
+	} {
+		ctx := metadata.NewContext(context.Background(), metadata.MD{"lang": test.lang})
+		r, err := c.TestMethod(ctx, &testpb.TestOp{A: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.X != test.wantX {
+			t.Errorf("lang %s: got result %d, want %d", test.lang, r.X, test.wantX)
+		}
+		if ts.calls != test.wantCalls {
+			t.Errorf("lang %s: got %d server calls, want %d", test.lang, ts.calls, test.wantCalls)
+		}
+	}
+	if got, want := c.Cache.Len(), 2; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+}
+
+func TestCache_KeyMetadata(t *testing.T) {
+	ts := testServer{maxAge: time.Hour}
+	cc, done := newTestClient(t, &ts)
+	defer done()
+	c := testpb.NewCachedTestClient(cc, &grpccache.Cache{KeyMetadata: []string{"scope"}})
+
+	for _, test := range []struct {
+		scope     string
+		wantCalls int
+	}{
+		{"read", 1},
+		{"read", 1},
+		{"write", 2},
+		{"write", 2},
+		{"", 3},
+		{"read", 3},
+	} {
+		ctx := context.Background()
+		if test.scope != "" {
+			ctx = metadata.NewContext(ctx, metadata.MD{"scope": test.scope})
+		}
+		if _, err := c.TestMethod(ctx, &testpb.TestOp{A: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if len(ts.calls) != test.wantCalls {
+			t.Errorf("scope %q: got %d server calls, want %d", test.scope, len(ts.calls), test.wantCalls)
+		}
+	}
+	if got, want := c.Cache.Len(), 3; got != want {
+		t.Errorf("got %d entries, want %d", got, want)
+	}
+}